@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// Clients holds the AWS service clients for one profile, region and role. The
+// clients are declared as the SDK interfaces, so fakes can take their place.
+type Clients struct {
+	Ecs         ecsiface.ECSAPI
+	Ec2         ec2iface.EC2API
+	Elb         elbiface.ELBAPI
+	S3          s3iface.S3API
+	Lambda      lambdaiface.LambdaAPI
+	Ssm         ssmiface.SSMAPI
+	Autoscaling autoscalingiface.AutoScalingAPI
+
+	// The region the clients are for, needed by tools the clients are handed to
+	Region string
+}
+
+// ClientFactory creates the clients for a profile, region and role to assume.
+type ClientFactory func(profile, region, roleArn string) (*Clients, error)
+
+// newClients is the factory every command gets its clients from. Replace it to
+// run the commands against fakes instead of AWS.
+var newClients ClientFactory = newAwsClients
+
+func newAwsClients(profile, region, roleArn string) (*Clients, error) {
+	sess, cfg, err := getSessionAndConfigForParams(profile, region, roleArn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Clients{
+		Ecs:         ecs.New(sess, cfg),
+		Ec2:         ec2.New(sess, cfg),
+		Elb:         elb.New(sess, cfg),
+		S3:          s3.New(sess, cfg),
+		Lambda:      lambda.New(sess, cfg),
+		Ssm:         ssm.New(sess, cfg),
+		Autoscaling: autoscaling.New(sess, cfg),
+		Region:      aws.StringValue(sess.Config.Copy(cfg).Region),
+	}, nil
+}
+
+// getClients returns the clients for the -profile, -region and -roleArn flags.
+func getClients() (*Clients, error) {
+	return newClients(profile, region, roleArn)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"io"
+	"os"
+	"strconv"
+)
+
+// ClusterCapacity shows the registered and remaining CPU and memory of each
+// container instance of the cluster, with totals. Given a service, it also
+// shows how many more tasks of its task definition would fit.
+func ClusterCapacity(clusterArn, serviceArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	// All instances count towards the capacity, regardless of -maxResults
+	arns, err := listContainerInstanceArns(clusterArn, "", "", clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	resp, err := describeContainerInstanceArns(clusterArn, arns, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	capacity := ClusterCapacityItem{Cluster: ClusterName(&clusterArn), Instances: []ContainerInstanceCapacityItem{}}
+
+	var requirements *taskRequirements
+	if serviceArn != "" {
+		requirements, err = getServiceTaskRequirements(clusterArn, serviceArn, clients)
+		if err != nil {
+			return err
+		}
+
+		capacity.Service = ExtractName(&serviceArn)
+		capacity.TaskDefinition = requirements.taskDefinition
+		capacity.TaskCpu = requirements.cpu
+		capacity.TaskMemory = requirements.memory
+		capacity.Total.Fits = aws.Int64(0)
+	}
+
+	for i := 0; i < len(resp.ContainerInstances); i++ {
+		item := newContainerInstanceCapacityItem(resp.ContainerInstances[i])
+
+		if requirements != nil {
+			item.Fits = aws.Int64(requirements.fits(resp.ContainerInstances[i]))
+			*capacity.Total.Fits += *item.Fits
+		}
+
+		capacity.Total.Instances++
+		capacity.Total.RegisteredCpu += item.RegisteredCpu
+		capacity.Total.RemainingCpu += item.RemainingCpu
+		capacity.Total.RegisteredMemory += item.RegisteredMemory
+		capacity.Total.RemainingMemory += item.RemainingMemory
+		capacity.Total.RunningTasks += item.RunningTasks
+		capacity.Total.PendingTasks += item.PendingTasks
+
+		capacity.Instances = append(capacity.Instances, item)
+	}
+
+	header, rows := capacityRows(capacity)
+
+	return printFormatted(capacity, header, rows, func() error {
+		err := printTable(header, rows)
+		if err != nil {
+			return err
+		}
+
+		if requirements != nil {
+			printCapacitySummary(os.Stdout, capacity)
+		}
+
+		return nil
+	})
+}
+
+func newContainerInstanceCapacityItem(instance *ecs.ContainerInstance) ContainerInstanceCapacityItem {
+	item := ContainerInstanceCapacityItem{
+		InstanceId:       aws.StringValue(instance.Ec2InstanceId),
+		InstanceType:     getAttribute(instance.Attributes, "ecs.instance-type"),
+		AvailabilityZone: getAttribute(instance.Attributes, "ecs.availability-zone"),
+		Status:           aws.StringValue(instance.Status),
+		AgentConnected:   aws.BoolValue(instance.AgentConnected),
+		RegisteredCpu:    getResource(instance.RegisteredResources, "CPU"),
+		RemainingCpu:     getResource(instance.RemainingResources, "CPU"),
+		RegisteredMemory: getResource(instance.RegisteredResources, "MEMORY"),
+		RemainingMemory:  getResource(instance.RemainingResources, "MEMORY"),
+		RunningTasks:     aws.Int64Value(instance.RunningTasksCount),
+		PendingTasks:     aws.Int64Value(instance.PendingTasksCount),
+	}
+
+	if instance.VersionInfo != nil {
+		item.AgentVersion = aws.StringValue(instance.VersionInfo.AgentVersion)
+	}
+
+	return item
+}
+
+// capacityRows returns the table of instances, ending with the totals.
+func capacityRows(capacity ClusterCapacityItem) ([]string, [][]string) {
+	header := []string{"instance id", "type", "az", "status", "agent", "connected", "cpu free", "cpu total",
+		"memory free", "memory total", "running", "pending"}
+
+	if capacity.Service != "" {
+		header = append(header, "fits")
+	}
+
+	var rows [][]string
+
+	for i := 0; i < len(capacity.Instances); i++ {
+		item := capacity.Instances[i]
+
+		row := []string{item.InstanceId, item.InstanceType, item.AvailabilityZone, item.Status, item.AgentVersion,
+			strconv.FormatBool(item.AgentConnected), formatInt(item.RemainingCpu), formatInt(item.RegisteredCpu),
+			formatInt(item.RemainingMemory), formatInt(item.RegisteredMemory), formatInt(item.RunningTasks),
+			formatInt(item.PendingTasks)}
+
+		if item.Fits != nil {
+			row = append(row, formatInt(*item.Fits))
+		}
+
+		rows = append(rows, row)
+	}
+
+	total := capacity.Total
+	row := []string{fmt.Sprintf("total (%d)", total.Instances), "", "", "", "", "", formatInt(total.RemainingCpu),
+		formatInt(total.RegisteredCpu), formatInt(total.RemainingMemory), formatInt(total.RegisteredMemory),
+		formatInt(total.RunningTasks), formatInt(total.PendingTasks)}
+
+	if total.Fits != nil {
+		row = append(row, formatInt(*total.Fits))
+	}
+
+	return header, append(rows, row)
+}
+
+func printCapacitySummary(out io.Writer, capacity ClusterCapacityItem) {
+	needs := fmt.Sprintf("%d MiB of memory", capacity.TaskMemory)
+	if capacity.TaskCpu > 0 {
+		needs = fmt.Sprintf("%d CPU units and %s", capacity.TaskCpu, needs)
+	}
+
+	//noinspection GoUnhandledErrorResult
+	fmt.Fprintf(out, "\nA task of %s (%s) needs %s, %d more would fit in the cluster\n",
+		capacity.Service, capacity.TaskDefinition, needs, *capacity.Total.Fits)
+}
+
+func formatInt(value int64) string {
+	return strconv.FormatInt(value, 10)
+}
+
+func getAttribute(attributes []*ecs.Attribute, name string) string {
+	for i := 0; i < len(attributes); i++ {
+		if aws.StringValue(attributes[i].Name) == name {
+			return aws.StringValue(attributes[i].Value)
+		}
+	}
+
+	return ""
+}
+
+func getResource(resources []*ecs.Resource, name string) int64 {
+	for i := 0; i < len(resources); i++ {
+		if aws.StringValue(resources[i].Name) == name {
+			return aws.Int64Value(resources[i].IntegerValue)
+		}
+	}
+
+	return 0
+}
+
+// taskRequirements is what a task reserves on a container instance: CPU units,
+// MiB of memory and the host ports it maps statically.
+type taskRequirements struct {
+	taskDefinition string
+	cpu            int64
+	memory         int64
+	hostPorts      []string
+}
+
+// getServiceTaskRequirements returns the requirements of the task definition
+// the service runs.
+func getServiceTaskRequirements(clusterArn, serviceArn string, clients *Clients) (*taskRequirements, error) {
+	service, err := describeService(clusterArn, serviceArn, clients.Ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	definition, err := describeTaskDefinition(*service.Services[0].TaskDefinition, clients.Ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	requirements := newTaskRequirements(definition.TaskDefinition)
+
+	if requirements.memory == 0 {
+		return nil, stateError("Task definition " + requirements.taskDefinition + " reserves no memory, so any number of tasks would fit")
+	}
+
+	return requirements, nil
+}
+
+// newTaskRequirements returns the requirements of the task definition. Task
+// level CPU and memory take precedence over the sum of the containers, where
+// the memory reservation of a container takes precedence over its limit.
+func newTaskRequirements(definition *ecs.TaskDefinition) *taskRequirements {
+	requirements := &taskRequirements{taskDefinition: ExtractName(definition.TaskDefinitionArn)}
+
+	for i := 0; i < len(definition.ContainerDefinitions); i++ {
+		container := definition.ContainerDefinitions[i]
+
+		requirements.cpu += aws.Int64Value(container.Cpu)
+
+		if container.MemoryReservation != nil {
+			requirements.memory += *container.MemoryReservation
+		} else {
+			requirements.memory += aws.Int64Value(container.Memory)
+		}
+
+		for j := 0; j < len(container.PortMappings); j++ {
+			mapping := container.PortMappings[j]
+
+			port := aws.Int64Value(mapping.HostPort)
+			if aws.StringValue(definition.NetworkMode) == ecs.NetworkModeHost && port == 0 {
+				port = aws.Int64Value(mapping.ContainerPort)
+			}
+
+			if port > 0 && aws.StringValue(definition.NetworkMode) != ecs.NetworkModeAwsvpc {
+				requirements.hostPorts = append(requirements.hostPorts, strconv.FormatInt(port, 10))
+			}
+		}
+	}
+
+	if cpu, err := strconv.ParseInt(aws.StringValue(definition.Cpu), 10, 64); err == nil {
+		requirements.cpu = cpu
+	}
+
+	if memory, err := strconv.ParseInt(aws.StringValue(definition.Memory), 10, 64); err == nil {
+		requirements.memory = memory
+	}
+
+	return requirements
+}
+
+// fits returns how many more tasks fit on the container instance. Instances
+// that are draining or whose agent is disconnected take no tasks, and a task
+// mapping a static host port fits only once per instance.
+func (r *taskRequirements) fits(instance *ecs.ContainerInstance) int64 {
+	if aws.StringValue(instance.Status) != ecs.ContainerInstanceStatusActive || !aws.BoolValue(instance.AgentConnected) {
+		return 0
+	}
+
+	fits := getResource(instance.RemainingResources, "MEMORY") / r.memory
+
+	if r.cpu > 0 {
+		byCpu := getResource(instance.RemainingResources, "CPU") / r.cpu
+		if byCpu < fits {
+			fits = byCpu
+		}
+	}
+
+	if len(r.hostPorts) == 0 || fits == 0 {
+		return fits
+	}
+
+	usedPorts := getResourceSet(instance.RemainingResources, "PORTS")
+	for i := 0; i < len(r.hostPorts); i++ {
+		for j := 0; j < len(usedPorts); j++ {
+			if r.hostPorts[i] == usedPorts[j] {
+				return 0
+			}
+		}
+	}
+
+	return 1
+}
+
+func getResourceSet(resources []*ecs.Resource, name string) []string {
+	for i := 0; i < len(resources); i++ {
+		if aws.StringValue(resources[i].Name) == name {
+			return aws.StringValueSlice(resources[i].StringSetValue)
+		}
+	}
+
+	return nil
+}
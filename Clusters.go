@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"regexp"
+	"strings"
 )
 
 func ClusterName(a *string) string {
@@ -18,62 +20,83 @@ func ClusterName(a *string) string {
 	return res[0][1]
 }
 
-func ListClusters() {
-	resp := listClusters(nil)
+func ListClusters() error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := listClusters(clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	items := []ClusterItem{}
+	var rows [][]string
 
 	for i := 0; i < len(resp.ClusterArns); i++ {
-		name := ClusterName(resp.ClusterArns[i])
-		fmt.Println(name)
+		item := ClusterItem{Name: ClusterName(resp.ClusterArns[i]), Arn: *resp.ClusterArns[i]}
 
 		if verboseLevel > 0 {
-			servicesResp := listServices(*resp.ClusterArns[i], nil)
+			servicesResp, err := listServices(*resp.ClusterArns[i], clients.Ecs)
+			if err != nil {
+				return err
+			}
+
 			for j := 0; j < len(servicesResp.ServiceArns); j++ {
-				fmt.Println("  " + ClusterName(servicesResp.ServiceArns[j]))
+				item.Services = append(item.Services, ClusterName(servicesResp.ServiceArns[j]))
 			}
 		}
+
+		items = append(items, item)
+		rows = append(rows, []string{item.Name, strings.Join(item.Services, ","), item.Arn})
 	}
 
+	return printFormatted(items, []string{"name", "services", "arn"}, rows, func() error {
+		for i := 0; i < len(items); i++ {
+			fmt.Println(items[i].Name)
+
+			for j := 0; j < len(items[i].Services); j++ {
+				fmt.Println("  " + items[i].Services[j])
+			}
+		}
+
+		return nil
+	})
 }
 
-func GetClusterArn(name string, svc *ecs.ECS) string {
-	clusterArns := listClusters(svc)
+func GetClusterArn(name string, svc ecsiface.ECSAPI) (string, error) {
+	clusterArns, err := listClusters(svc)
+	if err != nil {
+		return "", err
+	}
 
 	for i := 0; i < len(clusterArns.ClusterArns); i++ {
 		arn := clusterArns.ClusterArns[i]
 
 		if ClusterName(arn) == name {
-			return *arn
+			return *arn, nil
 		}
 	}
 
-	return ""
+	return "", notFoundError("No cluster named " + name)
 }
 
-func listClusters(svc *ecs.ECS) *ecs.ListClustersOutput {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
-	}
+func listClusters(svc ecsiface.ECSAPI) (*ecs.ListClustersOutput, error) {
+	result := new(ecs.ListClustersOutput)
 
-	var marker = new(string)
-	var result = new(ecs.ListClustersOutput)
-
-	for marker != nil && len(result.ClusterArns) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
-
-		params := &ecs.ListClustersInput{
-			NextToken: marker,
-			MaxResults: &maxResult,
-		}
-
-		resp, err := svc.ListClusters(params)
-		assertError(err)
+	params := &ecs.ListClustersInput{
+		MaxResults: pageSize(1, 100),
+	}
 
-		result.ClusterArns = append(result.ClusterArns, resp.ClusterArns...)
-		marker = result.NextToken
+	err := svc.ListClustersPages(params, func(page *ecs.ListClustersOutput, lastPage bool) bool {
+		result.ClusterArns = append(result.ClusterArns, page.ClusterArns...)
+		return morePages(len(result.ClusterArns), lastPage)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result
+	result.ClusterArns = result.ClusterArns[:limitItems(len(result.ClusterArns))]
+	return result, nil
 }
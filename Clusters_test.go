@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestListClusters(t *testing.T) {
+	fake := newFakeEcs()
+	definitionArn := fake.addTaskDefinition("editor", 1, "registry/editorservice:1.0.0")
+	writerArn := fake.addCluster("writer")
+	fake.addService(writerArn, "editor", definitionArn, 1)
+	fake.addService(writerArn, "renderer", definitionArn, 1)
+	fake.addCluster("reader")
+	fake.addService(fake.addCluster("batch"), "importer", definitionArn, 1)
+
+	tests := []struct {
+		name    string
+		format  string
+		verbose int
+		want    string
+	}{
+		{
+			name:   "names",
+			format: formatText,
+			want:   "writer\nreader\nbatch\n",
+		},
+		{
+			name:    "with their services",
+			format:  formatText,
+			verbose: 1,
+			want:    "writer\n  editor\n  renderer\nreader\nbatch\n  importer\n",
+		},
+		{
+			name:    "as a table",
+			format:  formatTable,
+			verbose: 1,
+			want: "NAME    SERVICES         ARN\n" +
+				"writer  editor,renderer  " + fakeArnPrefix + "cluster/writer\n" +
+				"reader                   " + fakeArnPrefix + "cluster/reader\n" +
+				"batch   importer         " + fakeArnPrefix + "cluster/batch\n",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+			withOutputFormat(t, test.format)
+
+			previousVerbose := verboseLevel
+			verboseLevel = test.verbose
+			defer func() { verboseLevel = previousVerbose }()
+
+			output, err := captureStdout(t, ListClusters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", output, test.want)
+			}
+		})
+	}
+}
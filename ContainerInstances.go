@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+)
+
+// Max instances per DescribeAutoScalingInstances call
+const describeAutoScalingInstancesLimit = 50
+
+// DrainInstance sets the container instance of the EC2 instance to DRAINING,
+// and waits until its tasks have stopped and the services of the cluster are
+// stable again, with the tasks running on other instances.
+func DrainInstance(clusterArn, ec2InstanceId string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	instance, err := findContainerInstance(clusterArn, ec2InstanceId, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	err = drainContainerInstance(clusterArn, instance, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	err = waitForClusterServices(clusterArn, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Drained %s, its tasks run on other instances\n", ec2InstanceId)
+	return nil
+}
+
+// RollInstances replaces the container instances of the cluster one at a time,
+// e.g. to move the cluster to a new AMI. Each instance is drained and then
+// terminated, and the next one is only rolled when its auto scaling group has
+// replaced it, the replacement has joined the cluster and the services of the
+// cluster are stable. With -dryRun the instances are only listed.
+func RollInstances(clusterArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	arns, err := listContainerInstanceArns(clusterArn, "", "", clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	if len(arns) == 0 {
+		return notFoundError("No container instances in cluster " + ClusterName(&clusterArn))
+	}
+
+	resp, err := describeContainerInstanceArns(clusterArn, arns, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	instances := resp.ContainerInstances
+
+	var ec2InstanceIds []*string
+	for i := 0; i < len(instances); i++ {
+		ec2InstanceIds = append(ec2InstanceIds, instances[i].Ec2InstanceId)
+	}
+
+	// Every instance must be replaced by a group, so check all before touching any
+	groups, err := getAutoScalingGroups(ec2InstanceIds, clients.Autoscaling)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(instances); i++ {
+		id := aws.StringValue(instances[i].Ec2InstanceId)
+		if groups[id] == "" {
+			return stateError("Instance " + id + " is not in an auto scaling group, so it would not be replaced")
+		}
+	}
+
+	activeCount, err := countActiveContainerInstances(clusterArn, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		for i := 0; i < len(instances); i++ {
+			id := aws.StringValue(instances[i].Ec2InstanceId)
+			fmt.Printf("Would roll %s (%s, %d running tasks) in auto scaling group %s\n", id,
+				aws.StringValue(instances[i].Status), aws.Int64Value(instances[i].RunningTasksCount), groups[id])
+		}
+
+		return nil
+	}
+
+	rolled := make(map[string]bool)
+
+	for i := 0; i < len(instances); i++ {
+		instance := instances[i]
+		id := aws.StringValue(instance.Ec2InstanceId)
+
+		fmt.Printf("Rolling %s, %d of %d\n", id, i+1, len(instances))
+
+		err = drainContainerInstance(clusterArn, instance, clients.Ecs)
+		if err != nil {
+			return err
+		}
+
+		// The tasks must run elsewhere before the instance goes away
+		err = waitForClusterServices(clusterArn, clients.Ecs)
+		if err != nil {
+			return err
+		}
+
+		_, err = clients.Autoscaling.TerminateInstanceInAutoScalingGroup(&autoscaling.TerminateInstanceInAutoScalingGroupInput{
+			InstanceId:                     aws.String(id),
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		})
+		if err != nil {
+			return err
+		}
+
+		rolled[id] = true
+		fmt.Printf("[%s] Terminated, waiting for auto scaling group %s to replace it\n", id, groups[id])
+
+		err = waitFor("the replacement of "+id+" to join the cluster", printReasons(id, func() (string, error) {
+			reason, err := autoScalingGroupReplacing(groups[id], rolled, clients.Autoscaling)
+			if err != nil || reason != "" {
+				return reason, err
+			}
+
+			count, err := countActiveContainerInstances(clusterArn, clients.Ecs)
+			if err != nil {
+				return "", err
+			}
+
+			if count < activeCount {
+				return fmt.Sprintf("%d of %d container instances are active", count, activeCount), nil
+			}
+
+			return "", nil
+		}))
+		if err != nil {
+			return err
+		}
+
+		err = waitForClusterServices(clusterArn, clients.Ecs)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Rolled %d instances of cluster %s\n", len(instances), ClusterName(&clusterArn))
+	return nil
+}
+
+// findContainerInstance returns the container instance of the EC2 instance.
+func findContainerInstance(clusterArn, ec2InstanceId string, svc ecsiface.ECSAPI) (*ecs.ContainerInstance, error) {
+	arns, err := listContainerInstanceArns(clusterArn, "ec2InstanceId == "+ec2InstanceId, "", svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arns) == 0 {
+		return nil, notFoundError("Instance " + ec2InstanceId + " is not a container instance of cluster " + ClusterName(&clusterArn))
+	}
+
+	resp, err := describeContainerInstanceArns(clusterArn, arns[:1], svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.ContainerInstances) == 0 {
+		return nil, notFoundError("Could not describe the container instance of " + ec2InstanceId)
+	}
+
+	return resp.ContainerInstances[0], nil
+}
+
+// listContainerInstanceArns lists all container instances of the cluster that
+// match the cluster query language filter and status, if given. Unlike the
+// list commands, it does not stop at -maxResults.
+func listContainerInstanceArns(clusterArn, filter, status string, svc ecsiface.ECSAPI) ([]*string, error) {
+	var arns []*string
+
+	params := &ecs.ListContainerInstancesInput{
+		Cluster:    aws.String(clusterArn),
+		MaxResults: aws.Int64(100),
+	}
+
+	if filter != "" {
+		params.Filter = aws.String(filter)
+	}
+
+	if status != "" {
+		params.Status = aws.String(status)
+	}
+
+	err := svc.ListContainerInstancesPages(params, func(page *ecs.ListContainerInstancesOutput, lastPage bool) bool {
+		arns = append(arns, page.ContainerInstanceArns...)
+		return !lastPage
+	})
+
+	return arns, err
+}
+
+// countActiveContainerInstances counts the container instances of the cluster
+// that take tasks, that is those that are active with a connected agent.
+func countActiveContainerInstances(clusterArn string, svc ecsiface.ECSAPI) (int, error) {
+	arns, err := listContainerInstanceArns(clusterArn, "agentConnected == true", ecs.ContainerInstanceStatusActive, svc)
+	return len(arns), err
+}
+
+// drainContainerInstance sets the container instance to DRAINING, unless it
+// already is, and waits until it runs no more tasks.
+func drainContainerInstance(clusterArn string, instance *ecs.ContainerInstance, svc ecsiface.ECSAPI) error {
+	id := aws.StringValue(instance.Ec2InstanceId)
+
+	if aws.StringValue(instance.Status) != ecs.ContainerInstanceStatusDraining {
+		resp, err := svc.UpdateContainerInstancesState(&ecs.UpdateContainerInstancesStateInput{
+			Cluster:            aws.String(clusterArn),
+			ContainerInstances: []*string{instance.ContainerInstanceArn},
+			Status:             aws.String(ecs.ContainerInstanceStatusDraining),
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(resp.Failures) > 0 {
+			return stateError("Could not drain " + id + ": " + aws.StringValue(resp.Failures[0].Reason))
+		}
+	}
+
+	fmt.Printf("[%s] Draining, %d running tasks\n", id, aws.Int64Value(instance.RunningTasksCount))
+
+	return waitFor("the tasks on "+id+" to stop", printReasons(id, func() (string, error) {
+		resp, err := describeContainerInstanceArns(clusterArn, []*string{instance.ContainerInstanceArn}, svc)
+		if err != nil {
+			return "", err
+		}
+
+		if len(resp.ContainerInstances) == 0 {
+			return "", notFoundError("Container instance " + id + " is gone from cluster " + ClusterName(&clusterArn))
+		}
+
+		current := resp.ContainerInstances[0]
+		running := aws.Int64Value(current.RunningTasksCount)
+		pending := aws.Int64Value(current.PendingTasksCount)
+
+		if running+pending > 0 {
+			return fmt.Sprintf("%d running and %d pending tasks", running, pending), nil
+		}
+
+		return "", nil
+	}))
+}
+
+// waitForClusterServices waits until every service of the cluster is stable,
+// see waitForUpdatedTaskDefinition.
+func waitForClusterServices(clusterArn string, svc ecsiface.ECSAPI) error {
+	serviceArns, err := listServiceArns(clusterArn, svc)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(serviceArns); i++ {
+		err = waitForUpdatedTaskDefinition(clusterArn, *serviceArns[i], "", svc)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getAutoScalingGroups returns the name of the auto scaling group of each of
+// the instances that is in one, by instance ID.
+func getAutoScalingGroups(ec2InstanceIds []*string, svc autoscalingiface.AutoScalingAPI) (map[string]string, error) {
+	groups := make(map[string]string)
+
+	for start := 0; start < len(ec2InstanceIds); start += describeAutoScalingInstancesLimit {
+		end := start + describeAutoScalingInstancesLimit
+		if end > len(ec2InstanceIds) {
+			end = len(ec2InstanceIds)
+		}
+
+		resp, err := svc.DescribeAutoScalingInstances(&autoscaling.DescribeAutoScalingInstancesInput{
+			InstanceIds: ec2InstanceIds[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < len(resp.AutoScalingInstances); i++ {
+			instance := resp.AutoScalingInstances[i]
+			groups[aws.StringValue(instance.InstanceId)] = aws.StringValue(instance.AutoScalingGroupName)
+		}
+	}
+
+	return groups, nil
+}
+
+// autoScalingGroupReplacing returns why the group is still replacing
+// instances, or an empty string when as many instances as desired are in
+// service, not counting those rolled.
+func autoScalingGroupReplacing(groupName string, rolled map[string]bool, svc autoscalingiface.AutoScalingAPI) (string, error) {
+	resp, err := svc.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []*string{aws.String(groupName)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.AutoScalingGroups) == 0 {
+		return "", notFoundError("Auto scaling group " + groupName + " not found")
+	}
+
+	group := resp.AutoScalingGroups[0]
+
+	inService := 0
+	for i := 0; i < len(group.Instances); i++ {
+		instance := group.Instances[i]
+		if !rolled[aws.StringValue(instance.InstanceId)] && aws.StringValue(instance.LifecycleState) == autoscaling.LifecycleStateInService {
+			inService++
+		}
+	}
+
+	desired := aws.Int64Value(group.DesiredCapacity)
+	if int64(inService) < desired {
+		return fmt.Sprintf("auto scaling group %s has %d of %d instances in service", groupName, inService, desired), nil
+	}
+
+	return "", nil
+}
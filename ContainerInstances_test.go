@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWaitForClusterServicesWaitsForEveryService(t *testing.T) {
+	defer func(limit int64) { maxResult = limit }(maxResult)
+
+	fake := newFakeEcs()
+	clusterArn := fake.addCluster("writer")
+	definitionArn := fake.addTaskDefinition("editor", 1, "registry/editorservice:1.0.0")
+	fake.addService(clusterArn, "editor", definitionArn, 1)
+	fake.addService(clusterArn, "renderer", definitionArn, 1)
+	fake.addService(clusterArn, "search", definitionArn, 1)
+	withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+
+	// The last service, beyond -maxResults and the first page, is still starting its task
+	maxResult = 1
+	fake.services[2].Deployments[0] = fakeDeployment(definitionArn, 0, 1)
+
+	_, err := captureStdout(t, func() error { return waitForClusterServices(clusterArn, fake) })
+	if err == nil || exitCodeFor(err) != exitTimeout {
+		t.Errorf("error = %v, want a timeout waiting for the search service", err)
+	}
+}
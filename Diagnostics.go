@@ -0,0 +1,332 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Finds the PID of the JVM in a container, as the first JVM listed by jcmd
+const jvmPidCommand = `pid=$(jcmd | grep -v JCmd | head -1 | cut -d" " -f1); `
+
+// diagnosticsStep is one file of a diagnostics bundle, and the command whose
+// output goes into it. Commands run either on the instance or in the container.
+type diagnosticsStep struct {
+	filename    string
+	command     string
+	inContainer bool
+	wait        time.Duration
+}
+
+// CollectDiagnostics collects thread dumps, a heap histogram, the latest log
+// lines and disk and memory usage from every running task of the service.
+// Each task gets a directory in the bundle, which is optionally zipped and
+// uploaded to the bucket given by -s3bucket.
+func CollectDiagnostics(clusterArn, serviceArn string) error {
+	if transport == transportEcs {
+		return usageError("collectDiagnostics needs the instances of the tasks, use -transport ssh or ssm")
+	}
+
+	if threadDumps < 0 {
+		return usageError("-threadDumps must not be negative")
+	}
+
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	containers, err := getServiceContainers(clusterArn, serviceArn, clients)
+	if err != nil {
+		return err
+	}
+
+	// Ask for a passphrase before starting, rather than from several instances at once
+	if transport == transportSsh {
+		if _, err := sshClientConfig(sshPem); err != nil {
+			return err
+		}
+	}
+
+	dir, err := createDiagnosticsDir(ExtractName(&serviceArn))
+	if err != nil {
+		return err
+	}
+
+	steps := diagnosticsSteps()
+
+	var targets []remoteTarget
+	for i := 0; i < len(containers); i++ {
+		container := containers[i]
+
+		name := "fargate"
+		if container.instance != nil {
+			name = *container.instance.InstanceId
+		}
+
+		targets = append(targets, remoteTarget{
+			id:   taskId(container.taskArn),
+			name: name,
+			run: func(stdout, stderr io.Writer, cancel <-chan struct{}) error {
+				if container.instance == nil {
+					return usageError("Task runs on Fargate, which collectDiagnostics can't reach")
+				}
+
+				return collectTaskDiagnostics(container, steps, filepath.Join(dir, taskId(container.taskArn)), stdout, cancel)
+			},
+		})
+	}
+
+	collectErr := runOnTargets(targets, "task")
+
+	fmt.Println("Diagnostics written to " + dir)
+
+	if !zipDiagnostics && bucket == "" {
+		return collectErr
+	}
+
+	zipFile := dir + ".zip"
+
+	err = zipDir(dir, zipFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Diagnostics zipped to " + zipFile)
+
+	if bucket != "" {
+		key := filename
+		if key == "" {
+			key = "diagnostics/" + ExtractName(&serviceArn) + "-" + filepath.Base(dir) + ".zip"
+		}
+
+		err = uploadFileToS3Bucket(bucket, key, zipFile, clients.S3)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Diagnostics uploaded to s3://" + bucket + "/" + key)
+	}
+
+	return collectErr
+}
+
+// diagnosticsSteps returns the steps to run for each task, with -threadDumps
+// thread dumps -threadDumpInterval apart.
+func diagnosticsSteps() []diagnosticsStep {
+	var steps []diagnosticsStep
+
+	for i := 1; i <= threadDumps; i++ {
+		step := diagnosticsStep{
+			filename:    fmt.Sprintf("thread-dump-%d.txt", i),
+			command:     jvmPidCommand + "jcmd $pid Thread.print",
+			inContainer: true,
+		}
+
+		if i > 1 {
+			step.wait = threadDumpInterval
+		}
+
+		steps = append(steps, step)
+	}
+
+	return append(steps,
+		diagnosticsStep{filename: "heap-histogram.txt", command: jvmPidCommand + "jcmd $pid GC.class_histogram", inContainer: true},
+		diagnosticsStep{filename: "docker.log", command: fmt.Sprintf("docker logs --tail %d {container} 2>&1", logLines)},
+		diagnosticsStep{filename: "df.txt", command: "df -h"},
+		diagnosticsStep{filename: "free.txt", command: "free -m"},
+	)
+}
+
+// collectTaskDiagnostics runs the steps for the task, writing the output of
+// each to its file in dir. Failing steps don't stop the others, their output
+// is kept for what it's worth and the first failure is returned.
+func collectTaskDiagnostics(container serviceContainer, steps []diagnosticsStep, dir string, progress io.Writer, cancel <-chan struct{}) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	run := func(command, filename string) error {
+		file, err := os.Create(filepath.Join(dir, filename))
+		if err != nil {
+			return err
+		}
+
+		err = runRemoteCommand(container.instance, sshPem, command, file, file, cancel)
+		closeErr := file.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+
+		return err
+	}
+
+	// SSM cuts off the output of a command, so there the output goes to files
+	// on the instance, which are fetched when all steps are done
+	fetch := func() error { return nil }
+
+	if transport == transportSsm {
+		clients, err := getClients()
+		if err != nil {
+			return err
+		}
+
+		remoteDir, err := ssmMktemp(clients.Ssm, container.instance, "-d", cancel)
+		if err != nil {
+			return err
+		}
+
+		defer ssmRemove(clients.Ssm, container.instance, remoteDir)
+
+		run = func(command, filename string) error {
+			return ssmCommandToFile(clients.Ssm, container.instance, command, remoteDir+"/"+filename, cancel)
+		}
+
+		fetch = func() error {
+			return ssmFetch(clients.Ssm, container.instance, remoteDir+"/*", dir, ioutil.Discard, cancel)
+		}
+	}
+
+	runtimeId := *container.container.RuntimeId
+
+	var firstErr error
+
+	for i := 0; i < len(steps); i++ {
+		step := steps[i]
+
+		select {
+		case <-cancel:
+			return stateError("Cancelled")
+		case <-time.After(step.wait):
+		}
+
+		command := step.command
+		if step.inContainer {
+			command = "docker exec " + runtimeId + " sh -c " + shellQuote(command)
+		} else {
+			command = strings.ReplaceAll(command, "{container}", runtimeId)
+		}
+
+		err = run(command, step.filename)
+
+		status := "done"
+		if err != nil {
+			status = "failed: " + err.Error()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintf(progress, "%s %s\n", step.filename, status)
+	}
+
+	err = fetch()
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintf(progress, "fetching failed: %s\n", err.Error())
+
+		return err
+	}
+
+	return firstErr
+}
+
+// createDiagnosticsDir creates the timestamped directory for the bundle, below
+// -output if given.
+func createDiagnosticsDir(serviceName string) (string, error) {
+	if output == "" {
+		return CreateDirUsingServerPathWithDate(serviceName)
+	}
+
+	return CreateDir(output, filepath.Join(serviceName, time.Now().Format("20060102-150405")))
+}
+
+// zipDir writes the files below dir to the zip file, with paths relative to
+// the parent of dir.
+func zipDir(dir, zipFile string) error {
+	file, err := os.Create(zipFile)
+	if err != nil {
+		return err
+	}
+
+	writer := zip.NewWriter(file)
+	base := filepath.Dir(dir)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(name)
+		header.Method = zip.Deflate
+
+		entry, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		content, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		//noinspection GoUnhandledErrorResult
+		defer content.Close()
+
+		_, err = io.Copy(entry, content)
+		return err
+	})
+
+	closeErr := writer.Close()
+	fileErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return fileErr
+}
+
+func uploadFileToS3Bucket(bucket, key, path string, svc s3iface.S3API) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	_, err = svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   file,
+	})
+
+	return err
+}
@@ -2,48 +2,288 @@ package main
 
 import (
 	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
-// ListEc2Instances lists EC2 instances filtered by "running" instances and,
-// if supplied, instance name.
-func ListEc2Instances(instanceNameFilter string) {
-	resp := listEc2Instances()
+// ec2InstanceColumn is a column of listEc2Instances, selected with -columns
+type ec2InstanceColumn struct {
+	name   string
+	header string
+	value  func(item Ec2InstanceItem) string
+}
+
+var ec2InstanceColumns = []ec2InstanceColumn{
+	{"id", "instance id", func(item Ec2InstanceItem) string { return item.InstanceId }},
+	{"name", "name", func(item Ec2InstanceItem) string { return item.Name }},
+	{"state", "state", func(item Ec2InstanceItem) string { return item.State }},
+	{"public-ip", "public ip", func(item Ec2InstanceItem) string { return item.PublicIpAddress }},
+	{"private-ip", "private ip", func(item Ec2InstanceItem) string { return item.PrivateIpAddress }},
+	{"type", "type", func(item Ec2InstanceItem) string { return item.InstanceType }},
+	{"az", "az", func(item Ec2InstanceItem) string { return item.AvailabilityZone }},
+	{"launch-time", "launch time", func(item Ec2InstanceItem) string { return item.LaunchTime }},
+	{"ami", "ami", func(item Ec2InstanceItem) string { return item.ImageId }},
+	{"cluster", "cluster", func(item Ec2InstanceItem) string { return item.Cluster }},
+}
+
+const defaultEc2InstanceColumns = "id,name,state,public-ip,private-ip"
+
+// ListEc2Instances lists the EC2 instances selected by -filter and, if
+// supplied, instance name, which are the running ones by default. The columns
+// of the table are selected with -columns, which gives a table also without
+// -format.
+func ListEc2Instances(instanceNameFilter string) error {
+	columns, err := selectEc2InstanceColumns()
+	if err != nil {
+		return err
+	}
+
+	filters, err := ec2Filters(instanceNameFilter)
+	if err != nil {
+		return err
+	}
+
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := listEc2Instances(clients.Ec2, filters)
+	if err != nil {
+		return err
+	}
+
+	// Cluster membership takes a few calls to ECS, so it's only looked up when asked for
+	var clusters map[string]string
+	if hasColumn(columns, "cluster") {
+		clusters, err = getInstanceClusters(clients.Ecs)
+		if err != nil {
+			return err
+		}
+	}
+
+	var instances []*ec2.Instance
+	items := []Ec2InstanceItem{}
+	var rows [][]string
 
 	for i := 0; i < len(resp.Reservations); i++ {
 		for j := 0; j < len(resp.Reservations[i].Instances); j++ {
 			instance := resp.Reservations[i].Instances[j]
 
-			if *instance.State.Name == "running" {
-				instanceName := getName(instance.Tags)
-
-				if instanceNameFilter == "" || instanceNameFilter == instanceName {
-					if verboseLevel == 2 {
-						if instance.PublicIpAddress != nil {
-							fmt.Printf("%s %s %s: %s \n", tabs(18, *instance.PublicIpAddress), tabs(30, instanceName), *instance.InstanceId, *instance.State.Name)
-						} else if instance.PrivateIpAddress != nil {
-							fmt.Printf("%s %s %s: %s \n", tabs(18, "("+*instance.PrivateIpAddress+")"), tabs(30, instanceName), *instance.InstanceId, *instance.State.Name)
-						} else {
-							fmt.Printf("%s, %s: %s \n", instanceName, *instance.InstanceId, *instance.State.Name)
-						}
-					} else if verboseLevel == 1 {
-						fmt.Println(instanceName)
-					} else {
-						fmt.Println(*instance.InstanceId)
-					}
+			item := newEc2InstanceItem(instance)
+			item.Cluster = clusters[item.InstanceId]
+
+			var row []string
+			for k := 0; k < len(columns); k++ {
+				row = append(row, columns[k].value(item))
+			}
+
+			instances = append(instances, instance)
+			items = append(items, item)
+			rows = append(rows, row)
+		}
+	}
+
+	var header []string
+	for i := 0; i < len(columns); i++ {
+		header = append(header, columns[i].header)
+	}
+
+	format := outputFormat
+	if columnNames != "" && format == formatText {
+		format = formatTable
+	}
+
+	return printFormattedAs(format, items, header, rows, func() error {
+		for i := 0; i < len(instances); i++ {
+			instance := instances[i]
+			instanceName := getName(instance.Tags)
+
+			if verboseLevel == 2 {
+				if instance.PublicIpAddress != nil {
+					fmt.Printf("%s %s %s: %s \n", tabs(18, *instance.PublicIpAddress), tabs(30, instanceName), *instance.InstanceId, *instance.State.Name)
+				} else if instance.PrivateIpAddress != nil {
+					fmt.Printf("%s %s %s: %s \n", tabs(18, "("+*instance.PrivateIpAddress+")"), tabs(30, instanceName), *instance.InstanceId, *instance.State.Name)
+				} else {
+					fmt.Printf("%s, %s: %s \n", instanceName, *instance.InstanceId, *instance.State.Name)
 				}
+			} else if verboseLevel == 1 {
+				fmt.Println(instanceName)
+			} else {
+				fmt.Println(*instance.InstanceId)
+			}
+		}
+
+		return nil
+	})
+}
+
+func newEc2InstanceItem(instance *ec2.Instance) Ec2InstanceItem {
+	item := Ec2InstanceItem{
+		InstanceId: *instance.InstanceId,
+		Name:       getName(instance.Tags),
+		State:      *instance.State.Name,
+	}
+
+	if instance.PublicIpAddress != nil {
+		item.PublicIpAddress = *instance.PublicIpAddress
+	}
+
+	if instance.PrivateIpAddress != nil {
+		item.PrivateIpAddress = *instance.PrivateIpAddress
+	}
+
+	item.InstanceType = aws.StringValue(instance.InstanceType)
+	item.ImageId = aws.StringValue(instance.ImageId)
+
+	if instance.Placement != nil {
+		item.AvailabilityZone = aws.StringValue(instance.Placement.AvailabilityZone)
+	}
+
+	if instance.LaunchTime != nil {
+		item.LaunchTime = instance.LaunchTime.UTC().Format(time.RFC3339)
+	}
+
+	return item
+}
+
+// selectEc2InstanceColumns returns the columns given by -columns, or the
+// default ones.
+func selectEc2InstanceColumns() ([]ec2InstanceColumn, error) {
+	names := columnNames
+	if names == "" {
+		names = defaultEc2InstanceColumns
+	}
+
+	var result []ec2InstanceColumn
+	var available []string
+
+	for i := 0; i < len(ec2InstanceColumns); i++ {
+		available = append(available, ec2InstanceColumns[i].name)
+	}
+
+	fields := strings.Split(names, ",")
+	for i := 0; i < len(fields); i++ {
+		name := strings.TrimSpace(fields[i])
+		found := false
+
+		for j := 0; j < len(ec2InstanceColumns); j++ {
+			if ec2InstanceColumns[j].name == name {
+				result = append(result, ec2InstanceColumns[j])
+				found = true
 			}
 		}
+
+		if !found {
+			return nil, usageError("Unknown column '" + name + "', available columns: " + strings.Join(available, ", "))
+		}
 	}
+
+	return result, nil
+}
+func hasColumn(columns []ec2InstanceColumn, name string) bool {
+	for i := 0; i < len(columns); i++ {
+		if columns[i].name == name {
+			return true
+		}
+	}
+
+	return false
 }
 
-func GetEntity(loadBalancerId, entityId string) {
-	resp := listLoadBalancers()
+// ec2Filters returns the filters given by -filter, which are comma separated
+// name=value pairs like tag:Team=editor,instance-state-name=stopped. Values
+// may contain the wildcards * and ?, and a name given several times matches
+// any of its values. The instance name, if given, is matched against the Name
+// tag. Only running instances are selected unless the state is filtered on.
+func ec2Filters(name string) ([]*ec2.Filter, error) {
+	var filters []*ec2.Filter
+
+	add := func(filterName, value string) {
+		for i := 0; i < len(filters); i++ {
+			if *filters[i].Name == filterName {
+				filters[i].Values = append(filters[i].Values, aws.String(value))
+				return
+			}
+		}
+
+		filters = append(filters, &ec2.Filter{Name: aws.String(filterName), Values: []*string{aws.String(value)}})
+	}
+
+	if filter != "" {
+		pairs := strings.Split(filter, ",")
+		for i := 0; i < len(pairs); i++ {
+			parts := strings.SplitN(pairs[i], "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || parts[1] == "" {
+				return nil, usageError("Invalid filter '" + pairs[i] + "', expected name=value, e.g. tag:Team=editor or instance-state-name=stopped")
+			}
+
+			add(strings.TrimSpace(parts[0]), parts[1])
+		}
+	}
+
+	if name != "" {
+		add("tag:Name", name)
+	}
+
+	stateFiltered := false
+	for i := 0; i < len(filters); i++ {
+		if *filters[i].Name == "instance-state-name" || *filters[i].Name == "instance-state-code" {
+			stateFiltered = true
+		}
+	}
+
+	if !stateFiltered {
+		add("instance-state-name", ec2.InstanceStateNameRunning)
+	}
+
+	return filters, nil
+}
+
+// getInstanceClusters returns the name of the ECS cluster each container
+// instance belongs to, by EC2 instance ID.
+func getInstanceClusters(svc ecsiface.ECSAPI) (map[string]string, error) {
+	clusters, err := listClusters(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+
+	for i := 0; i < len(clusters.ClusterArns); i++ {
+		containerInstances, err := describeContainerInstances(*clusters.ClusterArns[i], svc)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 0; j < len(containerInstances.ContainerInstances); j++ {
+			result[aws.StringValue(containerInstances.ContainerInstances[j].Ec2InstanceId)] = ClusterName(clusters.ClusterArns[i])
+		}
+	}
+
+	return result, nil
+}
+
+func GetEntity(loadBalancerId, entityId string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := listLoadBalancers(clients.Elb)
+	if err != nil {
+		return err
+	}
+
 	host := ""
 
 	for i := 0; i < len(resp.LoadBalancerDescriptions); i++ {
@@ -52,94 +292,197 @@ func GetEntity(loadBalancerId, entityId string) {
 		}
 	}
 
-	if host != "" {
-		url := "http://" + host + "/api/newsItem/" + entityId
+	if host == "" {
+		return notFoundError("No host found for load balancer: " + loadBalancerId)
+	}
 
-		if verboseLevel > 0 {
-			fmt.Printf("Fetching from url [%s]\n", url)
-		}
+	url := "http://" + host + "/api/newsItem/" + entityId
 
-		resp, err := http.Get(url)
-		assertError(err)
+	if verboseLevel > 0 {
+		fmt.Printf("Fetching from url [%s]\n", url)
+	}
 
-		if resp.StatusCode == 200 {
-			//noinspection GoUnhandledErrorResult
-			defer resp.Body.Close()
+	entityResp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
 
-			body, err := ioutil.ReadAll(resp.Body)
-			assertError(err)
+	//noinspection GoUnhandledErrorResult
+	defer entityResp.Body.Close()
 
-			fmt.Println(string(body))
-		} else {
-			fmt.Println(resp.StatusCode)
+	if entityResp.StatusCode == 200 {
+		body, err := ioutil.ReadAll(entityResp.Body)
+		if err != nil {
+			return err
 		}
-		return
+
+		fmt.Println(string(body))
 	} else {
-		errState("No host found for load balancer: " + loadBalancer)
+		fmt.Println(entityResp.StatusCode)
 	}
 
+	return nil
 }
 
-func ListLoadBalancers() {
-	resp := listLoadBalancers()
+func ListLoadBalancers() error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := listLoadBalancers(clients.Elb)
+	if err != nil {
+		return err
+	}
+
+	instances, err := listEc2Instances(clients.Ec2, nil)
+	if err != nil {
+		return err
+	}
+
+	items := []LoadBalancerItem{}
+	var rows [][]string
 
 	for i := 0; i < len(resp.LoadBalancerDescriptions); i++ {
 		loadBalancer := resp.LoadBalancerDescriptions[i]
-		instances := listEc2Instances()
-
-		if verboseLevel == 0 {
-			fmt.Println(*loadBalancer.LoadBalancerName)
-		} else if verboseLevel == 1 {
-			fmt.Println(*loadBalancer.DNSName)
-		} else {
-			fmt.Printf("%s (%s)\n", *loadBalancer.LoadBalancerName, *loadBalancer.DNSName)
-			for j := 0; j < len(loadBalancer.Instances); j++ {
-				instanceItem := loadBalancer.Instances[j]
-
-				for k := 0; k < len(instances.Reservations); k++ {
-					//fmt.Printf("Iterating over reservation %d/%d containing %d instances\n", k, len(instances.Reservations), len(instances.Reservations[k].Instances))
-					instance := getInstanceForId(instances.Reservations[k].Instances, *instanceItem.InstanceId)
-
-					if instance != nil {
-						fmt.Printf("  * %s (%s): %s, %s\n", *instance.InstanceId, *instance.PublicIpAddress, getName(instance.Tags), *instance.State.Name)
-					}
+		item := LoadBalancerItem{Name: *loadBalancer.LoadBalancerName, DNSName: *loadBalancer.DNSName}
+
+		for j := 0; j < len(loadBalancer.Instances); j++ {
+			instanceItem := loadBalancer.Instances[j]
+
+			for k := 0; k < len(instances.Reservations); k++ {
+				instance := getInstanceForId(instances.Reservations[k].Instances, *instanceItem.InstanceId)
+
+				if instance != nil {
+					item.Instances = append(item.Instances, newEc2InstanceItem(instance))
 				}
 			}
 		}
+
+		var instanceIds []string
+		for j := 0; j < len(item.Instances); j++ {
+			instanceIds = append(instanceIds, item.Instances[j].InstanceId)
+		}
+
+		items = append(items, item)
+		rows = append(rows, []string{item.Name, item.DNSName, strings.Join(instanceIds, ",")})
 	}
+
+	return printFormatted(items, []string{"name", "dns name", "instances"}, rows, func() error {
+		for i := 0; i < len(items); i++ {
+			loadBalancer := items[i]
+
+			if verboseLevel == 0 {
+				fmt.Println(loadBalancer.Name)
+			} else if verboseLevel == 1 {
+				fmt.Println(loadBalancer.DNSName)
+			} else {
+				fmt.Printf("%s (%s)\n", loadBalancer.Name, loadBalancer.DNSName)
+				for j := 0; j < len(loadBalancer.Instances); j++ {
+					instance := loadBalancer.Instances[j]
+					fmt.Printf("  * %s (%s): %s, %s\n", instance.InstanceId, instance.PublicIpAddress, instance.Name, instance.State)
+				}
+			}
+		}
+
+		return nil
+	})
 }
 
-func GetInstanceForId(instanceId string) *ec2.Instance {
-	resp := listEc2Instances()
+func GetInstanceForId(instanceId string) (*ec2.Instance, error) {
+	clients, err := getClients()
+	if err != nil {
+		return nil, err
+	}
+
+	filters := []*ec2.Filter{{Name: aws.String("instance-id"), Values: []*string{aws.String(instanceId)}}}
+
+	resp, err := listEc2Instances(clients.Ec2, filters)
+	if err != nil {
+		return nil, err
+	}
 
 	for i := 0; i < len(resp.Reservations); i++ {
 		for j := 0; j < len(resp.Reservations[i].Instances); j++ {
 			instance := resp.Reservations[i].Instances[j]
 
 			if *instance.InstanceId == instanceId {
-				return instance
+				return instance, nil
 			}
 		}
 	}
 
-	return nil
+	return nil, notFoundError("No instance with ID " + instanceId)
 }
 
-func GetInstancesForName(name string) []*ec2.Instance {
-	resp := listEc2Instances()
+// GetInstancesForName returns the running instances with the name, which may
+// contain the wildcards * and ?.
+func GetInstancesForName(name string) ([]*ec2.Instance, error) {
+	filters := []*ec2.Filter{
+		{Name: aws.String("tag:Name"), Values: []*string{aws.String(name)}},
+		{Name: aws.String("instance-state-name"), Values: []*string{aws.String(ec2.InstanceStateNameRunning)}},
+	}
+
+	instances, err := getInstancesForFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances) == 0 {
+		return nil, notFoundError("No instances with name " + name)
+	}
+
+	return instances, nil
+}
+
+// GetInstancesForFilter returns the instances selected by -filter and, if
+// supplied, instance name, see ec2Filters.
+func GetInstancesForFilter(name string) ([]*ec2.Instance, error) {
+	filters, err := ec2Filters(name)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := getInstancesForFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instances) == 0 {
+		return nil, notFoundError("No instances matching " + describeEc2Filters(filters))
+	}
+
+	return instances, nil
+}
+
+func getInstancesForFilters(filters []*ec2.Filter) ([]*ec2.Instance, error) {
+	clients, err := getClients()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := listEc2Instances(clients.Ec2, filters)
+	if err != nil {
+		return nil, err
+	}
+
 	var result []*ec2.Instance
 
 	for i := 0; i < len(resp.Reservations); i++ {
-		for j := 0; j < len(resp.Reservations[i].Instances); j++ {
-			instance := resp.Reservations[i].Instances[j]
+		result = append(result, resp.Reservations[i].Instances...)
+	}
 
-			if getName(instance.Tags) == name {
-				result = append(result, instance)
-			}
-		}
+	return result, nil
+}
+
+func describeEc2Filters(filters []*ec2.Filter) string {
+	var result []string
+
+	for i := 0; i < len(filters); i++ {
+		result = append(result, *filters[i].Name+"="+strings.Join(aws.StringValueSlice(filters[i].Values), "|"))
 	}
 
-	return result
+	return strings.Join(result, ",")
 }
 
 func getInstanceForId(instances []*ec2.Instance, instanceId string) *ec2.Instance {
@@ -163,57 +506,80 @@ func getName(tags []*ec2.Tag) string {
 	return "-"
 }
 
-func listLoadBalancers() *elb.DescribeLoadBalancersOutput {
-	sess, cfg := getSessionAndConfig()
-	svc := elb.New(sess, cfg)
+func listLoadBalancers(svc elbiface.ELBAPI) (*elb.DescribeLoadBalancersOutput, error) {
+	result := new(elb.DescribeLoadBalancersOutput)
 
-	var marker = new(string)
-	var result = new(elb.DescribeLoadBalancersOutput)
+	params := &elb.DescribeLoadBalancersInput{
+		PageSize: pageSize(1, 400),
+	}
 
-	for marker != nil && len(result.LoadBalancerDescriptions) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
+	err := svc.DescribeLoadBalancersPages(params, func(page *elb.DescribeLoadBalancersOutput, lastPage bool) bool {
+		result.LoadBalancerDescriptions = append(result.LoadBalancerDescriptions, page.LoadBalancerDescriptions...)
+		return morePages(len(result.LoadBalancerDescriptions), lastPage)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		params := &elb.DescribeLoadBalancersInput{
-			Marker: marker,
-		}
+	result.LoadBalancerDescriptions = result.LoadBalancerDescriptions[:limitItems(len(result.LoadBalancerDescriptions))]
+	return result, nil
+}
 
-		resp, err := svc.DescribeLoadBalancers(params)
-		assertError(err)
+// listEc2Instances returns the reservations holding up to -maxResults instances
+// matching the filters.
+func listEc2Instances(svc ec2iface.EC2API, filters []*ec2.Filter) (*ec2.DescribeInstancesOutput, error) {
+	result := new(ec2.DescribeInstancesOutput)
+	instances := 0
 
-		result.LoadBalancerDescriptions = append(result.LoadBalancerDescriptions, resp.LoadBalancerDescriptions...)
-		marker = result.NextMarker
+	params := &ec2.DescribeInstancesInput{
+		Filters:    filters,
+		MaxResults: pageSize(5, 1000),
 	}
 
-	return result
-}
-
-func listEc2Instances() *ec2.DescribeInstancesOutput {
-	sess, cfg := getSessionAndConfig()
-	svc := ec2.New(sess, cfg)
+	err := svc.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for i := 0; i < len(page.Reservations) && !limitReached(instances); i++ {
+			reservation := page.Reservations[i]
 
-	var marker = new(string)
-	var result = new(ec2.DescribeInstancesOutput)
+			keep := limitItems(instances+len(reservation.Instances)) - instances
+			if keep < len(reservation.Instances) {
+				limited := *reservation
+				limited.Instances = reservation.Instances[:keep]
+				reservation = &limited
+			}
 
-	for marker != nil && len(result.Reservations) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
+			result.Reservations = append(result.Reservations, reservation)
+			instances += len(reservation.Instances)
 		}
 
-		params := &ec2.DescribeInstancesInput{
-			NextToken:  marker,
-			MaxResults: &maxResult,
-		}
+		return morePages(instances, lastPage)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
 
-		resp, err := svc.DescribeInstances(params)
-		assertError(err)
+// describeEc2Instances returns the instances with the IDs.
+func describeEc2Instances(instanceIds []*string, svc ec2iface.EC2API) ([]*ec2.Instance, error) {
+	var result []*ec2.Instance
+
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: instanceIds,
+	}
+
+	err := svc.DescribeInstancesPages(params, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for i := 0; i < len(page.Reservations); i++ {
+			result = append(result, page.Reservations[i].Instances...)
+		}
 
-		result.Reservations = append(result.Reservations, resp.Reservations...)
-		marker = resp.NextToken
+		return !lastPage
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result
+	return result, nil
 }
 
 func tabs(size int, output string) string {
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+)
+
+func newInstancesFake() (*fakeEc2, *fakeElb) {
+	instances := &fakeEc2{}
+	instances.addInstance("i-1", "editor-1", "running", "52.0.0.1")
+	instances.addInstance("i-2", "editor-2", "running", "")
+	instances.addInstance("i-3", "renderer-1", "stopped", "")
+	instances.addInstance("i-4", "renderer-2", "running", "52.0.0.4")
+
+	loadBalancers := &fakeElb{}
+	loadBalancers.addLoadBalancer("editor", "i-1", "i-2")
+	loadBalancers.addLoadBalancer("renderer", "i-3", "i-4")
+	loadBalancers.addLoadBalancer("unused")
+
+	return instances, loadBalancers
+}
+
+func TestListEc2Instances(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		columns string
+		format  string
+		want    string
+	}{
+		{
+			name:   "running ones",
+			format: formatText,
+			want:   "i-1\ni-2\ni-4\n",
+		},
+		{
+			name:   "by name",
+			filter: "editor-*",
+			format: formatText,
+			want:   "i-1\ni-2\n",
+		},
+		{
+			name:    "selected columns as a table",
+			columns: "id,name,state",
+			format:  formatText,
+			want: "INSTANCE ID  NAME        STATE\n" +
+				"i-1          editor-1    running\n" +
+				"i-2          editor-2    running\n" +
+				"i-4          renderer-2  running\n",
+		},
+		{
+			name:   "default columns as json",
+			filter: "renderer-2",
+			format: formatJson,
+			want: `[
+  {
+    "instanceId": "i-4",
+    "name": "renderer-2",
+    "state": "running",
+    "publicIpAddress": "52.0.0.4",
+    "privateIpAddress": "10.0.0.4"
+  }
+]
+`,
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			instances, _ := newInstancesFake()
+			withFakeClients(t, map[string]*Clients{"": {Ec2: instances}})
+			withOutputFormat(t, test.format)
+
+			previousColumns := columnNames
+			columnNames = test.columns
+			defer func() { columnNames = previousColumns }()
+
+			output, err := captureStdout(t, func() error { return ListEc2Instances(test.filter) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", output, test.want)
+			}
+			if outputFormat != test.format {
+				t.Errorf("-format changed to %s, want %s", outputFormat, test.format)
+			}
+		})
+	}
+}
+
+func TestListLoadBalancers(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		verbose int
+		want    string
+	}{
+		{
+			name:   "names",
+			format: formatText,
+			want:   "editor\nrenderer\nunused\n",
+		},
+		{
+			name:    "DNS names",
+			format:  formatText,
+			verbose: 1,
+			want:    "editor.eu-west-1.elb.amazonaws.com\nrenderer.eu-west-1.elb.amazonaws.com\nunused.eu-west-1.elb.amazonaws.com\n",
+		},
+		{
+			name:    "with their instances",
+			format:  formatText,
+			verbose: 2,
+			want: "editor (editor.eu-west-1.elb.amazonaws.com)\n" +
+				"  * i-1 (52.0.0.1): editor-1, running\n" +
+				"  * i-2 (): editor-2, running\n" +
+				"renderer (renderer.eu-west-1.elb.amazonaws.com)\n" +
+				"  * i-3 (): renderer-1, stopped\n" +
+				"  * i-4 (52.0.0.4): renderer-2, running\n" +
+				"unused (unused.eu-west-1.elb.amazonaws.com)\n",
+		},
+		{
+			name:   "as a table",
+			format: formatTable,
+			want: "NAME      DNS NAME                              INSTANCES\n" +
+				"editor    editor.eu-west-1.elb.amazonaws.com    i-1,i-2\n" +
+				"renderer  renderer.eu-west-1.elb.amazonaws.com  i-3,i-4\n" +
+				"unused    unused.eu-west-1.elb.amazonaws.com    \n",
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			instances, loadBalancers := newInstancesFake()
+			withFakeClients(t, map[string]*Clients{"": {Ec2: instances, Elb: loadBalancers}})
+			withOutputFormat(t, test.format)
+
+			previousVerbose := verboseLevel
+			verboseLevel = test.verbose
+			defer func() { verboseLevel = previousVerbose }()
+
+			output, err := captureStdout(t, ListLoadBalancers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", output, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Prefix of -endpoint values that start an in-process fake endpoint, serving
+// the responses in the file after the prefix
+const fakeEndpointPrefix = "fake:"
+
+// Set when -endpoint points to the in-process fake, which accepts any credentials
+var fakeEndpoint bool
+
+// startEndpoint starts the fake endpoint if -endpoint asks for it, and points
+// -endpoint to it.
+func startEndpoint() error {
+	if !strings.HasPrefix(endpoint, fakeEndpointPrefix) {
+		return nil
+	}
+
+	script, err := readFakeScript(strings.TrimPrefix(endpoint, fakeEndpointPrefix))
+	if err != nil {
+		return err
+	}
+
+	address := script.Listen
+	if address == "" {
+		address = "127.0.0.1:0"
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	go http.Serve(listener, newFakeServer(script))
+
+	endpoint = "http://" + listener.Addr().String()
+	fakeEndpoint = true
+
+	if verbose {
+		fmt.Println("Serving fake AWS responses on " + endpoint)
+	}
+
+	return nil
+}
+
+// withEndpoint points the config to the endpoint given by -endpoint. The fake
+// endpoint also gets static credentials and a default region, so that no AWS
+// profile is needed.
+func withEndpoint(cfg *aws.Config) *aws.Config {
+	if endpoint == "" {
+		return cfg
+	}
+
+	if cfg == nil {
+		cfg = &aws.Config{}
+	}
+
+	cfg.Endpoint = aws.String(endpoint)
+	cfg.S3ForcePathStyle = aws.Bool(true)
+
+	if fakeEndpoint {
+		cfg.Credentials = credentials.NewStaticCredentials("fake", "fake", "")
+
+		if cfg.Region == nil {
+			cfg.Region = aws.String("eu-west-1")
+		}
+	}
+
+	return cfg
+}
+
+// Responses recorded with -record, written to file when the command is done
+var recordedResponses []FakeResponse
+var recordedResponsesLock sync.Mutex
+
+// recordResponse is a send handler that records the response of each AWS
+// request in the format read by the fake endpoint.
+func recordResponse(r *request.Request) {
+	if r.HTTPResponse == nil || r.HTTPResponse.Body == nil {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.HTTPResponse.Body)
+	//noinspection GoUnhandledErrorResult
+	r.HTTPResponse.Body.Close()
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err != nil {
+		return
+	}
+
+	response := FakeResponse{
+		Service: fakeServiceName(r.ClientInfo.SigningName),
+		Status:  r.HTTPResponse.StatusCode,
+		Body:    recordedBody(body),
+	}
+
+	if response.Service == "" {
+		response.Service = fakeServiceName(r.ClientInfo.ServiceName)
+	}
+
+	// REST services are told apart by path, the others by action
+	if r.HTTPRequest.Header.Get("X-Amz-Target") != "" || strings.HasPrefix(r.HTTPRequest.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		response.Action = r.Operation.Name
+	} else {
+		response.Method = r.HTTPRequest.Method
+		response.Path = r.HTTPRequest.URL.Path
+	}
+
+	recordedResponsesLock.Lock()
+	defer recordedResponsesLock.Unlock()
+
+	recordedResponses = append(recordedResponses, response)
+}
+
+// recordedBody keeps JSON bodies as they are, anything else is stored as a
+// JSON string. HTML escaping is left out to keep recorded XML readable.
+func recordedBody(body []byte) json.RawMessage {
+	if json.Valid(body) && len(bytes.TrimSpace(body)) > 0 {
+		return body
+	}
+
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	//noinspection GoUnhandledErrorResult
+	encoder.Encode(string(body))
+
+	return bytes.TrimSpace(content.Bytes())
+}
+
+// writeRecordedResponses writes the responses recorded with -record.
+func writeRecordedResponses() error {
+	if recordFile == "" {
+		return nil
+	}
+
+	recordedResponsesLock.Lock()
+	defer recordedResponsesLock.Unlock()
+
+	var content bytes.Buffer
+	encoder := json.NewEncoder(&content)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(FakeScript{Responses: recordedResponses})
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(recordFile, content.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Recorded %d responses to %s\n", len(recordedResponses), recordFile)
+	}
+
+	return nil
+}
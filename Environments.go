@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// Environment registry, read from ~/.writer-tool/environments.json unless
+// WRITER_TOOL_ENVIRONMENTS points to another file
+type Environments struct {
+	EnvironmentItems []Environment `json:"environments"`
+}
+
+type Environment struct {
+	Name          string               `json:"name"`
+	Label         string               `json:"label"`
+	Profile       string               `json:"profile"`
+	Region        string               `json:"region"`
+	RoleArn       string               `json:"roleArn"`
+	Pemfile       string               `json:"pemfile"`
+	Bastion       string               `json:"bastion"`
+	Clusters      []string             `json:"clusters"`
+	Services      []EnvironmentService `json:"services"`
+	Lambdas       []string             `json:"lambdas"`
+	LoadBalancers []string             `json:"loadBalancers"`
+	Other         []OtherItem          `json:"other"`
+	Info          []InfoItem           `json:"info"`
+}
+
+type EnvironmentService struct {
+	Label          string `json:"label"`
+	Cluster        string `json:"cluster"`
+	Service        string `json:"service"`
+	ContainerName  string `json:"containerName"`
+	Url            string `json:"url"`
+	HealthCheckUrl string `json:"healthCheckUrl"`
+	Wave           int    `json:"wave"`
+}
+
+func ListEnvironments() error {
+	environments, err := readEnvironments()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(environments.EnvironmentItems); i++ {
+		environment := environments.EnvironmentItems[i]
+
+		if verboseLevel > 0 {
+			fmt.Printf("%s %s %s %s\n", tabs(20, environment.Name), tabs(20, environment.Profile), tabs(12, environment.Region), environment.Label)
+		} else {
+			fmt.Println(environment.Name)
+		}
+	}
+
+	return nil
+}
+
+func getEnvironmentsPath() (string, error) {
+	if os.Getenv("WRITER_TOOL_ENVIRONMENTS") != "" {
+		return os.Getenv("WRITER_TOOL_ENVIRONMENTS"), nil
+	}
+
+	currUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(currUser.HomeDir, toolpath, "environments.json"), nil
+}
+
+func readEnvironments() (Environments, error) {
+	var environments Environments
+
+	path, err := getEnvironmentsPath()
+	if err != nil {
+		return environments, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return environments, err
+	}
+
+	err = json.Unmarshal(content, &environments)
+	return environments, err
+}
+
+// getEnvironments returns the environments named by -env, which may be a comma
+// separated list of names.
+func getEnvironments() ([]Environment, error) {
+	environments, err := readEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	names := strings.Split(environmentName, ",")
+
+	var result []Environment
+
+	for i := 0; i < len(names); i++ {
+		name := strings.TrimSpace(names[i])
+		found := false
+
+		for j := 0; j < len(environments.EnvironmentItems); j++ {
+			if environments.EnvironmentItems[j].Name == name {
+				result = append(result, environments.EnvironmentItems[j])
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, usageError("No environment named \"" + name + "\"")
+		}
+	}
+
+	return result, nil
+}
+
+// resolveEnvironmentFlags fills in flags that are not given on the command line
+// from the environment given by -env. Only done for a single environment, as
+// flags can't hold values for several; the commands that don't read -env
+// themselves reject several environments.
+func resolveEnvironmentFlags() error {
+	if environmentName == "" {
+		return nil
+	}
+
+	environments, err := getEnvironments()
+	if err != nil {
+		return err
+	}
+
+	if len(environments) != 1 {
+		if command == "releaseServices" || command == "updateServices" || command == "createReport" {
+			return nil
+		}
+
+		return usageError("-env names several environments, which only releaseServices, updateServices and createReport accept")
+	}
+
+	environment := environments[0]
+
+	if profile == "" {
+		profile = environment.Profile
+	}
+
+	if region == "" {
+		region = environment.Region
+	}
+
+	if roleArn == "" {
+		roleArn = environment.RoleArn
+	}
+
+	if sshPem == "" {
+		sshPem, err = expandHomeDir(environment.Pemfile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bastion == "" {
+		bastion = environment.Bastion
+	}
+
+	if cluster == "" {
+		clusters := environment.getClusters()
+		if len(clusters) == 1 {
+			cluster = clusters[0]
+		}
+	}
+
+	if loadBalancer == "" && len(environment.LoadBalancers) == 1 {
+		loadBalancer = environment.LoadBalancers[0]
+	}
+
+	if containerName == "" && service != "" {
+		for i := 0; i < len(environment.Services); i++ {
+			item := environment.Services[i]
+			if item.Cluster == cluster && item.Service == service {
+				containerName = item.ContainerName
+			}
+		}
+	}
+
+	return nil
+}
+
+// getClusters returns the clusters of the environment, including the ones only
+// mentioned by its services.
+func (e Environment) getClusters() []string {
+	var clusters []string
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(e.Clusters); i++ {
+		if !seen[e.Clusters[i]] {
+			seen[e.Clusters[i]] = true
+			clusters = append(clusters, e.Clusters[i])
+		}
+	}
+
+	for i := 0; i < len(e.Services); i++ {
+		if !seen[e.Services[i].Cluster] {
+			seen[e.Services[i].Cluster] = true
+			clusters = append(clusters, e.Services[i].Cluster)
+		}
+	}
+
+	return clusters
+}
+
+func (e Environment) getLabel() string {
+	if e.Label != "" {
+		return e.Label
+	}
+
+	return e.Name
+}
+
+// environmentUpdates creates an updates file, as used by updateServices and
+// releaseServices, for all services in the environments given by -env.
+func environmentUpdates() ([]byte, error) {
+	environments, err := getEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []Update
+
+	for i := 0; i < len(environments); i++ {
+		environment := environments[i]
+
+		for j := 0; j < len(environment.Services); j++ {
+			item := environment.Services[j]
+
+			label := environment.getLabel()
+			if item.Label != "" {
+				label = label + " " + item.Label
+			}
+
+			updates = append(updates, Update{
+				Cluster:        item.Cluster,
+				Service:        item.Service,
+				Profile:        environment.Profile,
+				Label:          label,
+				ContainerName:  item.ContainerName,
+				Region:         environment.Region,
+				RoleArn:        environment.RoleArn,
+				Wave:           item.Wave,
+				HealthCheckUrl: item.HealthCheckUrl,
+			})
+		}
+	}
+
+	return json.Marshal(updates)
+}
+
+// environmentReportConfig creates a report config, as used by createReport,
+// with one installation for each environment given by -env.
+func environmentReportConfig() ([]byte, error) {
+	environments, err := getEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var config Installations
+
+	for i := 0; i < len(environments); i++ {
+		environment := environments[i]
+
+		installation := installationItem{
+			Label:   environment.getLabel(),
+			Profile: environment.Profile,
+			Region:  environment.Region,
+			RoleArn: environment.RoleArn,
+			Lambdas: environment.Lambdas,
+			Other:   environment.Other,
+			Info:    environment.Info,
+		}
+
+		for j := 0; j < len(environment.Services); j++ {
+			item := environment.Services[j]
+			installation.Services = append(installation.Services, ServiceItem{
+				Label:   item.Label,
+				Cluster: item.Cluster,
+				Service: item.Service,
+				Url:     item.Url,
+			})
+		}
+
+		config.InstallationItems = append(config.InstallationItems, installation)
+	}
+
+	return json.Marshal(config)
+}
+
+func expandHomeDir(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	currUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(currUser.HomeDir, path[2:]), nil
+}
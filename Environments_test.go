@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveEnvironmentFlagsSeveralEnvironments(t *testing.T) {
+	defer func(name, cmd, p, r string) {
+		environmentName, command, profile, region = name, cmd, p, r
+	}(environmentName, command, profile, region)
+
+	path := filepath.Join(t.TempDir(), "environments.json")
+	content := `{"environments": [
+		{"name": "a", "profile": "a-profile", "region": "eu-west-1"},
+		{"name": "b", "profile": "b-profile", "region": "eu-west-1"}
+	]}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Setenv("WRITER_TOOL_ENVIRONMENTS", os.Getenv("WRITER_TOOL_ENVIRONMENTS"))
+	os.Setenv("WRITER_TOOL_ENVIRONMENTS", path)
+
+	tests := []struct {
+		env      string
+		command  string
+		profile  string
+		exitCode int
+	}{
+		{env: "a", command: "listServices", profile: "a-profile"},
+		{env: "a,b", command: "releaseServices"},
+		{env: "a,b", command: "updateServices"},
+		{env: "a,b", command: "createReport"},
+		{env: "a,b", command: "listServices", exitCode: exitUsage},
+		{env: "a, b", command: "ssh", exitCode: exitUsage},
+		{env: "c", command: "listServices", exitCode: exitUsage},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		environmentName, command, profile, region = tests[i].env, tests[i].command, "", ""
+
+		err := resolveEnvironmentFlags()
+		if tests[i].exitCode == 0 && err != nil {
+			t.Errorf("-env %s %s: unexpected error: %v", tests[i].env, tests[i].command, err)
+		}
+		if tests[i].exitCode != 0 && (err == nil || exitCodeFor(err) != tests[i].exitCode) {
+			t.Errorf("-env %s %s: error = %v, want exit code %d", tests[i].env, tests[i].command, err, tests[i].exitCode)
+		}
+		if profile != tests[i].profile {
+			t.Errorf("-env %s %s: profile = %q, want %q", tests[i].env, tests[i].command, profile, tests[i].profile)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Exit codes for the writer-tool process, see README.md
+const (
+	exitUsage    = 1 // Invalid or missing flags and arguments
+	exitState    = 2 // Any other failure
+	exitAuth     = 3 // Missing or rejected AWS credentials
+	exitNotFound = 4 // Cluster, service, instance or other resource not found
+	exitTimeout  = 5 // Waited too long, e.g. for a deployment to become stable
+	exitPartial  = 6 // Some, but not all, services in a batch failed
+)
+
+// commandError is an error that knows which exit code it should result in.
+type commandError struct {
+	exitCode int
+	message  string
+}
+
+func (e *commandError) Error() string {
+	return e.message
+}
+
+func usageError(message string) error {
+	return &commandError{exitCode: exitUsage, message: message}
+}
+
+func stateError(message string) error {
+	return &commandError{exitCode: exitState, message: message}
+}
+
+func authError(message string) error {
+	return &commandError{exitCode: exitAuth, message: message}
+}
+
+func notFoundError(message string) error {
+	return &commandError{exitCode: exitNotFound, message: message}
+}
+
+func timeoutError(message string) error {
+	return &commandError{exitCode: exitTimeout, message: message}
+}
+
+func partialError(message string) error {
+	return &commandError{exitCode: exitPartial, message: message}
+}
+
+// remoteError is returned when a command run over SSH fails, the process then
+// ends with the exit status of the remote command.
+func remoteError(exitStatus int, message string) error {
+	return &commandError{exitCode: exitStatus, message: message}
+}
+
+// withMessage replaces the message of an error, keeping its exit code.
+func withMessage(err error, message string) error {
+	return &commandError{exitCode: exitCodeFor(err), message: message}
+}
+
+// AWS error codes that mean the credentials are missing, expired or lack permissions
+var authErrorCodes = map[string]bool{
+	"NoCredentialProviders":       true,
+	"ExpiredToken":                true,
+	"ExpiredTokenException":       true,
+	"InvalidClientTokenId":        true,
+	"UnrecognizedClientException": true,
+	"SignatureDoesNotMatch":       true,
+	"AuthFailure":                 true,
+	"AccessDenied":                true,
+	"AccessDeniedException":       true,
+	"UnauthorizedOperation":       true,
+}
+
+// AWS error codes that mean the requested resource does not exist
+var notFoundErrorCodes = map[string]bool{
+	"ClusterNotFoundException":   true,
+	"ServiceNotFoundException":   true,
+	"ResourceNotFoundException":  true,
+	"InvalidInstanceID.NotFound": true,
+	"LoadBalancerNotFound":       true,
+	"NoSuchBucket":               true,
+	"NoSuchKey":                  true,
+}
+
+// exitCodeFor returns the exit code the process should end with for the error.
+func exitCodeFor(err error) int {
+	if commandErr, ok := err.(*commandError); ok {
+		return commandErr.exitCode
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		if authErrorCodes[awsErr.Code()] {
+			return exitAuth
+		}
+
+		if notFoundErrorCodes[awsErr.Code()] {
+			return exitNotFound
+		}
+	}
+
+	return exitState
+}
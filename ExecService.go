@@ -0,0 +1,289 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Max number of tasks that can be described in one call
+const describeTasksLimit = 100
+
+// serviceContainer is the container of a running task of a service, and the
+// instance it runs on, which is nil for tasks on Fargate.
+type serviceContainer struct {
+	taskArn   string
+	container *ecs.Container
+	instance  *ec2.Instance
+}
+
+// ExecService runs the command inside the container of every running task of
+// the service. With -transport ssh or ssm the command is run with docker exec
+// on the instance of the task, and with -transport ecs through ECS Exec.
+func ExecService(clusterArn, serviceArn string, commands []string) error {
+	if len(commands) == 0 {
+		return usageError("A command to execute must be given, e.g. -- jstack 1")
+	}
+
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	containers, err := getServiceContainers(clusterArn, serviceArn, clients)
+	if err != nil {
+		return err
+	}
+
+	command := strings.Join(commands, " ")
+
+	// Ask for a passphrase before starting, rather than from several instances at once
+	if transport == transportSsh {
+		if _, err := sshClientConfig(sshPem); err != nil {
+			return err
+		}
+	}
+
+	var targets []remoteTarget
+	for i := 0; i < len(containers); i++ {
+		container := containers[i]
+
+		name := "fargate"
+		if container.instance != nil {
+			name = *container.instance.InstanceId
+		}
+
+		targets = append(targets, remoteTarget{
+			id:   taskId(container.taskArn),
+			name: name,
+			run: func(stdout, stderr io.Writer, cancel <-chan struct{}) error {
+				if transport == transportEcs {
+					return runEcsExec(clients, clusterArn, container, command, len(containers) == 1, stdout, stderr, cancel)
+				}
+
+				if container.instance == nil {
+					return usageError("Task runs on Fargate, use -transport ecs")
+				}
+
+				dockerCommand := "docker exec " + *container.container.RuntimeId + " sh -c " + shellQuote(command)
+				return runRemoteCommand(container.instance, sshPem, dockerCommand, stdout, stderr, cancel)
+			},
+		})
+	}
+
+	return runOnTargets(targets, "task")
+}
+
+// getServiceContainers finds the container given by -containerName in each
+// running task of the service, along with the EC2 instance it runs on.
+func getServiceContainers(clusterArn, serviceArn string, clients *Clients) ([]serviceContainer, error) {
+	tasks, err := listTasks(clusterArn, serviceArn, clients.Ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tasks.TaskArns) == 0 {
+		return nil, notFoundError("No running tasks for service " + ExtractName(&serviceArn))
+	}
+
+	described, err := describeTasks(clusterArn, tasks.TaskArns, clients.Ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []serviceContainer
+	var containerInstanceArns []*string
+
+	for i := 0; i < len(described); i++ {
+		task := described[i]
+		if aws.StringValue(task.LastStatus) != ecs.DesiredStatusRunning {
+			continue
+		}
+
+		container, err := getTaskContainer(task)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, serviceContainer{taskArn: *task.TaskArn, container: container})
+
+		if task.ContainerInstanceArn != nil {
+			containerInstanceArns = append(containerInstanceArns, task.ContainerInstanceArn)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, notFoundError("No running tasks for service " + ExtractName(&serviceArn))
+	}
+
+	if len(containerInstanceArns) == 0 {
+		return result, nil
+	}
+
+	instances, err := getTaskInstances(clusterArn, containerInstanceArns, clients)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(described); i++ {
+		for j := 0; j < len(result); j++ {
+			if *described[i].TaskArn == result[j].taskArn && described[i].ContainerInstanceArn != nil {
+				result[j].instance = instances[*described[i].ContainerInstanceArn]
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func describeTasks(clusterArn string, taskArns []*string, svc ecsiface.ECSAPI) ([]*ecs.Task, error) {
+	var result []*ecs.Task
+
+	for start := 0; start < len(taskArns); start += describeTasksLimit {
+		end := start + describeTasksLimit
+		if end > len(taskArns) {
+			end = len(taskArns)
+		}
+
+		resp, err := svc.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: aws.String(clusterArn),
+			Tasks:   taskArns[start:end],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, resp.Tasks...)
+	}
+
+	return result, nil
+}
+
+// getTaskContainer returns the container named by -containerName, or the only
+// container of the task if no name is given.
+func getTaskContainer(task *ecs.Task) (*ecs.Container, error) {
+	var names []string
+
+	for i := 0; i < len(task.Containers); i++ {
+		name := aws.StringValue(task.Containers[i].Name)
+		if name == containerName || (containerName == "" && len(task.Containers) == 1) {
+			if task.Containers[i].RuntimeId == nil {
+				return nil, stateError("Container " + name + " of task " + taskId(*task.TaskArn) + " has not started")
+			}
+
+			return task.Containers[i], nil
+		}
+
+		names = append(names, name)
+	}
+
+	if containerName == "" {
+		return nil, usageError("Task " + taskId(*task.TaskArn) + " has several containers, specify one with -containerName: " + strings.Join(names, ", "))
+	}
+
+	return nil, notFoundError("No container named " + containerName + " in task " + taskId(*task.TaskArn) + ", found: " + strings.Join(names, ", "))
+}
+
+// getTaskInstances returns the EC2 instances of the container instances, by
+// container instance ARN.
+func getTaskInstances(clusterArn string, containerInstanceArns []*string, clients *Clients) (map[string]*ec2.Instance, error) {
+	containerInstances, err := describeContainerInstanceArns(clusterArn, containerInstanceArns, clients.Ecs)
+	if err != nil {
+		return nil, err
+	}
+
+	var instanceIds []*string
+	for i := 0; i < len(containerInstances.ContainerInstances); i++ {
+		instanceIds = append(instanceIds, containerInstances.ContainerInstances[i].Ec2InstanceId)
+	}
+
+	instances, err := describeEc2Instances(instanceIds, clients.Ec2)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*ec2.Instance)
+
+	for i := 0; i < len(containerInstances.ContainerInstances); i++ {
+		containerInstance := containerInstances.ContainerInstances[i]
+		result[*containerInstance.ContainerInstanceArn] = getInstanceForId(instances, *containerInstance.Ec2InstanceId)
+	}
+
+	return result, nil
+}
+
+// runEcsExec runs the command in the container through ECS Exec, handing the
+// session over to the session-manager-plugin like the AWS CLI does. The exit
+// status of the command is not reported by ECS Exec. Only a single container
+// gets stdin, to allow for interactive commands.
+func runEcsExec(clients *Clients, clusterArn string, container serviceContainer, command string, interactive bool,
+	stdout, stderr io.Writer, cancel <-chan struct{}) error {
+
+	target := "ecs:" + ClusterName(&clusterArn) + "_" + taskId(container.taskArn) + "_" + *container.container.RuntimeId
+
+	path, args, err := sessionManagerPlugin(clients.Region, map[string]string{"Target": target}, "ecs", func() (interface{}, error) {
+		resp, err := clients.Ecs.ExecuteCommand(&ecs.ExecuteCommandInput{
+			Cluster:     aws.String(clusterArn),
+			Task:        aws.String(container.taskArn),
+			Container:   container.container.Name,
+			Command:     aws.String(command),
+			Interactive: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return resp.Session, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	plugin := exec.Command(path, args[1:]...)
+	plugin.Stdout = stdout
+	plugin.Stderr = stderr
+
+	if interactive {
+		plugin.Stdin = os.Stdin
+	}
+
+	err = plugin.Start()
+	if err != nil {
+		return err
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-cancel:
+			//noinspection GoUnhandledErrorResult
+			plugin.Process.Kill()
+		case <-finished:
+		}
+	}()
+
+	err = plugin.Wait()
+	if err != nil {
+		return stateError("ECS Exec failed: " + err.Error())
+	}
+
+	return nil
+}
+
+// taskId returns the ID of the task, which is the last part of both old and
+// new style task ARNs.
+func taskId(taskArn string) string {
+	return taskArn[strings.LastIndex(taskArn, "/")+1:]
+}
+
+// shellQuote quotes the text for use as a single argument in a shell command.
+func shellQuote(text string) string {
+	return "'" + strings.ReplaceAll(text, "'", `'\''`) + "'"
+}
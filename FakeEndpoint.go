@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeScript holds the responses served by the fake endpoint, see README.md
+type FakeScript struct {
+	Listen    string         `json:"listen,omitempty"`
+	Responses []FakeResponse `json:"responses"`
+}
+
+// FakeResponse is served for requests to the service that match the action
+// (for JSON and query services like ECS, EC2, ELB and Auto Scaling) or the
+// method and path (for REST services like S3 and Lambda). Matching responses
+// are served in order, each one the given number of times, after which the
+// last one keeps being served.
+type FakeResponse struct {
+	Service      string            `json:"service"`
+	Action       string            `json:"action,omitempty"`
+	Method       string            `json:"method,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	BodyContains string            `json:"bodyContains,omitempty"`
+	Status       int               `json:"status,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Body         json.RawMessage   `json:"body,omitempty"`
+	Error        *FakeError        `json:"error,omitempty"`
+	Delay        string            `json:"delay,omitempty"`
+	Times        int               `json:"times,omitempty"`
+
+	delay time.Duration
+}
+
+// FakeError is served in the error format of the service, e.g. to simulate
+// throttling with the code "ThrottlingException".
+type FakeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type fakeRequest struct {
+	service string
+	action  string
+	method  string
+	path    string
+	body    string
+}
+
+type fakeServer struct {
+	responses []FakeResponse
+	served    []int
+	lock      sync.Mutex
+}
+
+func readFakeScript(filename string) (FakeScript, error) {
+	var script FakeScript
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return script, err
+	}
+
+	err = json.Unmarshal(content, &script)
+	if err != nil {
+		return script, usageError("Invalid fake endpoint script " + filename + ": " + err.Error())
+	}
+
+	for i := 0; i < len(script.Responses); i++ {
+		response := &script.Responses[i]
+
+		if response.Delay != "" {
+			response.delay, err = time.ParseDuration(response.Delay)
+			if err != nil {
+				return script, usageError("Invalid delay in fake endpoint script " + filename + ": " + err.Error())
+			}
+		}
+
+		response.Service = fakeServiceName(response.Service)
+	}
+
+	return script, nil
+}
+
+func newFakeServer(script FakeScript) *fakeServer {
+	return &fakeServer{
+		responses: script.Responses,
+		served:    make([]int, len(script.Responses)),
+	}
+}
+
+// fakeServiceName returns the name used for a service in fake endpoint scripts.
+func fakeServiceName(name string) string {
+	name = strings.ToLower(name)
+
+	if name == "elasticloadbalancing" {
+		return "elb"
+	}
+
+	return name
+}
+
+// parseFakeRequest finds out which service and action a request is for. The
+// service is taken from the signature, so requests that are not signed, like
+// health checks, have no service.
+func parseFakeRequest(r *http.Request) (fakeRequest, error) {
+	request := fakeRequest{method: r.Method, path: r.URL.Path}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return request, err
+	}
+
+	request.body = string(body)
+
+	re := regexp.MustCompile("Credential=[^/]*/[^/]*/[^/]*/([^/]*)/aws4_request")
+	match := re.FindStringSubmatch(r.Header.Get("Authorization"))
+	if match != nil {
+		request.service = fakeServiceName(match[1])
+	}
+
+	target := r.Header.Get("X-Amz-Target")
+	if target != "" {
+		request.action = target[strings.LastIndex(target, ".")+1:]
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(request.body)
+		if err != nil {
+			return request, err
+		}
+
+		request.action = values.Get("Action")
+	}
+
+	return request, nil
+}
+
+func (request fakeRequest) String() string {
+	if request.action != "" {
+		return request.service + " " + request.action
+	}
+
+	return strings.TrimSpace(request.service + " " + request.method + " " + request.path)
+}
+
+func (response FakeResponse) matches(request fakeRequest) bool {
+	if response.Service != request.service {
+		return false
+	}
+
+	if response.Action != "" && response.Action != request.action {
+		return false
+	}
+
+	if response.Method != "" && !strings.EqualFold(response.Method, request.method) {
+		return false
+	}
+
+	if response.Path != "" {
+		if strings.HasSuffix(response.Path, "*") {
+			if !strings.HasPrefix(request.path, strings.TrimSuffix(response.Path, "*")) {
+				return false
+			}
+		} else if response.Path != request.path {
+			return false
+		}
+	}
+
+	return strings.Contains(request.body, response.BodyContains)
+}
+
+// next returns the response to serve for the request, or nil if the script has
+// no matching response.
+func (s *fakeServer) next(request fakeRequest) *FakeResponse {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	last := -1
+
+	for i := 0; i < len(s.responses); i++ {
+		if !s.responses[i].matches(request) {
+			continue
+		}
+
+		times := s.responses[i].Times
+		if times < 1 {
+			times = 1
+		}
+
+		if s.served[i] < times {
+			s.served[i]++
+			return &s.responses[i]
+		}
+
+		last = i
+	}
+
+	if last == -1 {
+		return nil
+	}
+
+	return &s.responses[last]
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, err := parseFakeRequest(r)
+	if err != nil {
+		writeFakeError(w, request.service, http.StatusBadRequest, FakeError{Code: "FakeEndpointInvalidRequest", Message: err.Error()})
+		return
+	}
+
+	response := s.next(request)
+	if response == nil {
+		fmt.Fprintln(os.Stderr, "Fake endpoint has no response for "+request.String())
+		writeFakeError(w, request.service, http.StatusBadRequest, FakeError{Code: "FakeEndpointNoResponse", Message: "No response for " + request.String()})
+		return
+	}
+
+	if verboseLevel > 1 {
+		fmt.Fprintln(os.Stderr, "Fake endpoint serving "+request.String())
+	}
+
+	time.Sleep(response.delay)
+
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+
+	if response.Error != nil {
+		status := response.Status
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+
+		writeFakeError(w, request.service, status, *response.Error)
+		return
+	}
+
+	body := []byte(response.Body)
+
+	// Bodies given as JSON strings are served as they are, e.g. XML or file content
+	var text string
+	if json.Unmarshal(body, &text) == nil {
+		body = []byte(text)
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("<")) {
+			w.Header().Set("Content-Type", "text/xml")
+		} else if text == "" && len(body) > 0 {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		}
+	}
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	w.WriteHeader(status)
+	//noinspection GoUnhandledErrorResult
+	w.Write(body)
+}
+
+// writeFakeError writes the error in the format the SDK expects from the service.
+func writeFakeError(w http.ResponseWriter, service string, status int, fakeError FakeError) {
+	var body string
+
+	switch service {
+	case "ec2":
+		w.Header().Set("Content-Type", "text/xml")
+		body = "<Response><Errors><Error><Code>" + xmlEscape(fakeError.Code) + "</Code><Message>" + xmlEscape(fakeError.Message) +
+			"</Message></Error></Errors><RequestID>fake</RequestID></Response>"
+	case "s3":
+		w.Header().Set("Content-Type", "application/xml")
+		body = "<Error><Code>" + xmlEscape(fakeError.Code) + "</Code><Message>" + xmlEscape(fakeError.Message) + "</Message></Error>"
+	case "elb", "sts", "autoscaling":
+		w.Header().Set("Content-Type", "text/xml")
+		body = "<ErrorResponse><Error><Type>Sender</Type><Code>" + xmlEscape(fakeError.Code) + "</Code><Message>" + xmlEscape(fakeError.Message) +
+			"</Message></Error><RequestId>fake</RequestId></ErrorResponse>"
+	default:
+		content, _ := json.Marshal(map[string]string{"__type": fakeError.Code, "message": fakeError.Message})
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Header().Set("X-Amzn-Errortype", fakeError.Code)
+		body = string(content)
+	}
+
+	w.WriteHeader(status)
+	//noinspection GoUnhandledErrorResult
+	w.Write([]byte(body))
+}
+
+func xmlEscape(text string) string {
+	var escaped bytes.Buffer
+	//noinspection GoUnhandledErrorResult
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
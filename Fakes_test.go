@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/aws/aws-sdk-go/service/elb"
+	"github.com/aws/aws-sdk-go/service/elb/elbiface"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-memory fakes of the AWS services, for the commands to run against through
+// newClients. Lists are served in pages of fakePageSize to exercise pagination.
+
+const fakePageSize = 2
+
+const fakeArnPrefix = "arn:aws:ecs:eu-west-1:123456789012:"
+
+// withFakeClients makes the commands use the clients for the profile, where
+// the empty profile is -profile's default, until the test is done. Deployments
+// are waited for briefly.
+func withFakeClients(t *testing.T, clients map[string]*Clients) {
+	previousClients := newClients
+	previousTimeout, previousInterval := deploymentTimeout, pollInterval
+
+	newClients = func(profile, region, roleArn string) (*Clients, error) {
+		if client, ok := clients[profile]; ok {
+			return client, nil
+		}
+
+		return nil, authError("No fake clients for profile " + profile)
+	}
+
+	deploymentTimeout, pollInterval = 200*time.Millisecond, 10*time.Millisecond
+
+	t.Cleanup(func() {
+		newClients = previousClients
+		deploymentTimeout, pollInterval = previousTimeout, previousInterval
+	})
+}
+
+// withOutputFormat sets -format until the test is done.
+func withOutputFormat(t *testing.T, format string) {
+	previous := outputFormat
+	outputFormat = format
+	t.Cleanup(func() { outputFormat = previous })
+}
+
+// captureStdout returns what the function printed to stdout.
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	return captureOutput(t, &os.Stdout, run)
+}
+
+// captureStderr returns what the function printed to stderr.
+func captureStderr(t *testing.T, run func() error) (string, error) {
+	return captureOutput(t, &os.Stderr, run)
+}
+
+func captureOutput(t *testing.T, file **os.File, run func() error) (string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := *file
+	*file = writer
+
+	captured := make(chan string)
+	go func() {
+		var buffer bytes.Buffer
+		//noinspection GoUnhandledErrorResult
+		io.Copy(&buffer, reader)
+		captured <- buffer.String()
+	}()
+
+	err = run()
+
+	*file = previous
+	//noinspection GoUnhandledErrorResult
+	writer.Close()
+
+	return <-captured, err
+}
+
+// fakePages calls the page function with the values in pages of fakePageSize,
+// until it returns false.
+func fakePages(values []string, page func(values []*string, lastPage bool) bool) {
+	for start := 0; start == 0 || start < len(values); start += fakePageSize {
+		end := start + fakePageSize
+		if end > len(values) {
+			end = len(values)
+		}
+
+		if !page(aws.StringSlice(values[start:end]), end == len(values)) {
+			return
+		}
+	}
+}
+
+func fakeNotFound(message string) error {
+	return awserr.New("ClientException", message, nil)
+}
+
+// fakeEcs holds clusters, services with their tasks and task definitions.
+// Updating a service deploys the task definition at once, unless it is one of
+// the stuck ones, whose tasks never start.
+type fakeEcs struct {
+	ecsiface.ECSAPI
+
+	lock        sync.Mutex
+	clusters    []string
+	services    []*ecs.Service
+	tasks       map[string][]string
+	definitions map[string]*ecs.TaskDefinition
+	stuck       map[string]bool
+
+	registered []*ecs.RegisterTaskDefinitionInput
+	updated    []string
+	stopped    []string
+}
+
+func newFakeEcs() *fakeEcs {
+	return &fakeEcs{
+		tasks:       map[string][]string{},
+		definitions: map[string]*ecs.TaskDefinition{},
+		stuck:       map[string]bool{},
+	}
+}
+
+func (f *fakeEcs) addCluster(name string) string {
+	arn := fakeArnPrefix + "cluster/" + name
+	f.clusters = append(f.clusters, arn)
+	return arn
+}
+
+// addService adds a stable service running the task definition, with as many
+// tasks as desired.
+func (f *fakeEcs) addService(clusterArn, name, taskDefinitionArn string, desired int64) string {
+	arn := fakeArnPrefix + "service/" + name
+
+	f.services = append(f.services, &ecs.Service{
+		ServiceName:    aws.String(name),
+		ServiceArn:     aws.String(arn),
+		ClusterArn:     aws.String(clusterArn),
+		Status:         aws.String("ACTIVE"),
+		DesiredCount:   aws.Int64(desired),
+		RunningCount:   aws.Int64(desired),
+		PendingCount:   aws.Int64(0),
+		TaskDefinition: aws.String(taskDefinitionArn),
+		Deployments:    []*ecs.Deployment{fakeDeployment(taskDefinitionArn, desired, desired)},
+		DeploymentConfiguration: &ecs.DeploymentConfiguration{
+			MinimumHealthyPercent: aws.Int64(50),
+			MaximumPercent:        aws.Int64(200),
+		},
+	})
+
+	for i := int64(0); i < desired; i++ {
+		f.tasks[arn] = append(f.tasks[arn], fmt.Sprintf("%stask/%s-%d", fakeArnPrefix, name, i))
+	}
+
+	return arn
+}
+
+// addTaskDefinition adds a revision of the family with a container per image,
+// named after the image.
+func (f *fakeEcs) addTaskDefinition(family string, revision int, images ...string) string {
+	arn := fmt.Sprintf("%stask-definition/%s:%d", fakeArnPrefix, family, revision)
+
+	definition := &ecs.TaskDefinition{
+		TaskDefinitionArn: aws.String(arn),
+		Family:            aws.String(family),
+		Revision:          aws.Int64(int64(revision)),
+		NetworkMode:       aws.String(ecs.NetworkModeBridge),
+	}
+
+	for i := 0; i < len(images); i++ {
+		name := path.Base(strings.Split(images[i], ":")[0])
+		definition.ContainerDefinitions = append(definition.ContainerDefinitions, &ecs.ContainerDefinition{
+			Name:   aws.String(name),
+			Image:  aws.String(images[i]),
+			Memory: aws.Int64(512),
+		})
+	}
+
+	f.definitions[arn] = definition
+	return arn
+}
+
+func fakeDeployment(taskDefinitionArn string, running, desired int64) *ecs.Deployment {
+	return &ecs.Deployment{
+		Id:             aws.String("ecs-svc/" + ExtractName(&taskDefinitionArn)),
+		Status:         aws.String("PRIMARY"),
+		TaskDefinition: aws.String(taskDefinitionArn),
+		RunningCount:   aws.Int64(running),
+		PendingCount:   aws.Int64(desired - running),
+		DesiredCount:   aws.Int64(desired),
+	}
+}
+
+func (f *fakeEcs) findService(cluster, nameOrArn string) *ecs.Service {
+	for i := 0; i < len(f.services); i++ {
+		service := f.services[i]
+		if *service.ClusterArn == cluster && (*service.ServiceArn == nameOrArn || *service.ServiceName == nameOrArn) {
+			return service
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeEcs) ListClustersPages(input *ecs.ListClustersInput, page func(*ecs.ListClustersOutput, bool) bool) error {
+	fakePages(f.clusters, func(values []*string, lastPage bool) bool {
+		return page(&ecs.ListClustersOutput{ClusterArns: values}, lastPage)
+	})
+
+	return nil
+}
+
+func (f *fakeEcs) ListServicesPages(input *ecs.ListServicesInput, page func(*ecs.ListServicesOutput, bool) bool) error {
+	var arns []string
+	for i := 0; i < len(f.services); i++ {
+		if *f.services[i].ClusterArn == *input.Cluster {
+			arns = append(arns, *f.services[i].ServiceArn)
+		}
+	}
+
+	fakePages(arns, func(values []*string, lastPage bool) bool {
+		return page(&ecs.ListServicesOutput{ServiceArns: values}, lastPage)
+	})
+
+	return nil
+}
+
+func (f *fakeEcs) ListTasksPages(input *ecs.ListTasksInput, page func(*ecs.ListTasksOutput, bool) bool) error {
+	service := f.findService(*input.Cluster, *input.ServiceName)
+	if service == nil {
+		return fakeNotFound("Service not found.")
+	}
+
+	fakePages(f.tasks[*service.ServiceArn], func(values []*string, lastPage bool) bool {
+		return page(&ecs.ListTasksOutput{TaskArns: values}, lastPage)
+	})
+
+	return nil
+}
+
+func (f *fakeEcs) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	output := &ecs.DescribeServicesOutput{}
+
+	for i := 0; i < len(input.Services); i++ {
+		service := f.findService(*input.Cluster, *input.Services[i])
+		if service == nil {
+			output.Failures = append(output.Failures, &ecs.Failure{Arn: input.Services[i], Reason: aws.String("MISSING")})
+			continue
+		}
+
+		// A copy, so that the caller doesn't see later updates
+		described := *service
+		output.Services = append(output.Services, &described)
+	}
+
+	return output, nil
+}
+
+func (f *fakeEcs) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	definition, ok := f.definitions[*input.TaskDefinition]
+	if !ok {
+		return nil, fakeNotFound("Unable to describe task definition.")
+	}
+
+	// A deep copy, as the caller changes the image in it
+	copied := *definition
+	copied.ContainerDefinitions = nil
+	for i := 0; i < len(definition.ContainerDefinitions); i++ {
+		container := *definition.ContainerDefinitions[i]
+		container.Image = aws.String(*container.Image)
+		copied.ContainerDefinitions = append(copied.ContainerDefinitions, &container)
+	}
+
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &copied}, nil
+}
+
+func (f *fakeEcs) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	revision := 1
+	for arn := range f.definitions {
+		if *f.definitions[arn].Family == *input.Family {
+			revision++
+		}
+	}
+
+	var images []string
+	for i := 0; i < len(input.ContainerDefinitions); i++ {
+		images = append(images, *input.ContainerDefinitions[i].Image)
+	}
+
+	arn := f.addTaskDefinition(*input.Family, revision, images...)
+	f.registered = append(f.registered, input)
+
+	return &ecs.RegisterTaskDefinitionOutput{TaskDefinition: f.definitions[arn]}, nil
+}
+
+func (f *fakeEcs) UpdateService(input *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	service := f.findService(*input.Cluster, *input.Service)
+	if service == nil {
+		return nil, fakeNotFound("Service not found.")
+	}
+
+	running := *service.DesiredCount
+	if f.stuck[*input.TaskDefinition] {
+		running = 0
+	}
+
+	service.TaskDefinition = input.TaskDefinition
+	service.RunningCount = aws.Int64(running)
+	service.Deployments = []*ecs.Deployment{fakeDeployment(*input.TaskDefinition, running, *service.DesiredCount)}
+	f.updated = append(f.updated, ExtractName(input.TaskDefinition))
+
+	return &ecs.UpdateServiceOutput{Service: service}, nil
+}
+
+func (f *fakeEcs) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	f.stopped = append(f.stopped, ExtractName(input.Task))
+	return &ecs.StopTaskOutput{}, nil
+}
+
+// fakeEc2 holds instances, each in a reservation of its own, and applies the
+// Name tag, instance ID and state filters.
+type fakeEc2 struct {
+	ec2iface.EC2API
+
+	instances []*ec2.Instance
+}
+
+func (f *fakeEc2) addInstance(id, name, state, publicIp string) {
+	instance := &ec2.Instance{
+		InstanceId:       aws.String(id),
+		State:            &ec2.InstanceState{Name: aws.String(state)},
+		PrivateIpAddress: aws.String("10.0.0." + id[len(id)-1:]),
+		Tags:             []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+
+	if publicIp != "" {
+		instance.PublicIpAddress = aws.String(publicIp)
+	}
+
+	f.instances = append(f.instances, instance)
+}
+
+func (f *fakeEc2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, page func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	var matching []*ec2.Instance
+
+	for i := 0; i < len(f.instances); i++ {
+		if fakeInstanceMatches(f.instances[i], input) {
+			matching = append(matching, f.instances[i])
+		}
+	}
+
+	for i := 0; i < len(matching); i++ {
+		output := &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: matching[i : i+1]}}}
+		if !page(output, i == len(matching)-1) {
+			break
+		}
+	}
+
+	if len(matching) == 0 {
+		page(&ec2.DescribeInstancesOutput{}, true)
+	}
+
+	return nil
+}
+
+func fakeInstanceMatches(instance *ec2.Instance, input *ec2.DescribeInstancesInput) bool {
+	if len(input.InstanceIds) > 0 && !fakeMatchesAny(*instance.InstanceId, input.InstanceIds) {
+		return false
+	}
+
+	for i := 0; i < len(input.Filters); i++ {
+		filter := input.Filters[i]
+
+		switch *filter.Name {
+		case "tag:Name":
+			if !fakeMatchesAny(getName(instance.Tags), filter.Values) {
+				return false
+			}
+		case "instance-id":
+			if !fakeMatchesAny(*instance.InstanceId, filter.Values) {
+				return false
+			}
+		case "instance-state-name":
+			if !fakeMatchesAny(*instance.State.Name, filter.Values) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func fakeMatchesAny(value string, patterns []*string) bool {
+	for i := 0; i < len(patterns); i++ {
+		if matched, _ := path.Match(*patterns[i], value); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fakeElb holds classic load balancers.
+type fakeElb struct {
+	elbiface.ELBAPI
+
+	loadBalancers []*elb.LoadBalancerDescription
+}
+
+func (f *fakeElb) addLoadBalancer(name string, instanceIds ...string) {
+	loadBalancer := &elb.LoadBalancerDescription{
+		LoadBalancerName: aws.String(name),
+		DNSName:          aws.String(name + ".eu-west-1.elb.amazonaws.com"),
+	}
+
+	for i := 0; i < len(instanceIds); i++ {
+		loadBalancer.Instances = append(loadBalancer.Instances, &elb.Instance{InstanceId: aws.String(instanceIds[i])})
+	}
+
+	f.loadBalancers = append(f.loadBalancers, loadBalancer)
+}
+
+func (f *fakeElb) DescribeLoadBalancersPages(input *elb.DescribeLoadBalancersInput, page func(*elb.DescribeLoadBalancersOutput, bool) bool) error {
+	for start := 0; start == 0 || start < len(f.loadBalancers); start += fakePageSize {
+		end := start + fakePageSize
+		if end > len(f.loadBalancers) {
+			end = len(f.loadBalancers)
+		}
+
+		if !page(&elb.DescribeLoadBalancersOutput{LoadBalancerDescriptions: f.loadBalancers[start:end]}, end == len(f.loadBalancers)) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// fakeLambda holds functions with the version their PRIMARY alias points to.
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+
+	versions     map[string]string
+	descriptions map[string]string
+}
+
+func (f *fakeLambda) GetAlias(input *lambda.GetAliasInput) (*lambda.AliasConfiguration, error) {
+	version, ok := f.versions[*input.FunctionName]
+	if !ok {
+		return nil, awserr.New(lambda.ErrCodeResourceNotFoundException, "Function not found: "+*input.FunctionName, nil)
+	}
+
+	return &lambda.AliasConfiguration{Name: input.Name, FunctionVersion: aws.String(version)}, nil
+}
+
+func (f *fakeLambda) GetFunctionConfiguration(input *lambda.GetFunctionConfigurationInput) (*lambda.FunctionConfiguration, error) {
+	return &lambda.FunctionConfiguration{
+		FunctionName: input.FunctionName,
+		Version:      input.Qualifier,
+		Description:  aws.String(f.descriptions[*input.FunctionName]),
+	}, nil
+}
+
+// fakeSsm finishes every command at once, with the given output.
+type fakeSsm struct {
+	ssmiface.SSMAPI
+
+	stdout string
+	stderr string
+}
+
+func (f *fakeSsm) SendCommand(input *ssm.SendCommandInput) (*ssm.SendCommandOutput, error) {
+	return &ssm.SendCommandOutput{Command: &ssm.Command{CommandId: aws.String("command-1")}}, nil
+}
+
+func (f *fakeSsm) GetCommandInvocation(input *ssm.GetCommandInvocationInput) (*ssm.GetCommandInvocationOutput, error) {
+	return &ssm.GetCommandInvocationOutput{
+		CommandId:             input.CommandId,
+		InstanceId:            input.InstanceId,
+		Status:                aws.String(ssm.CommandInvocationStatusSuccess),
+		StandardOutputContent: aws.String(f.stdout),
+		StandardErrorContent:  aws.String(f.stderr),
+	}, nil
+}
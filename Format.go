@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats for list and describe commands, selected with -format
+const (
+	formatText  = "text"
+	formatTable = "table"
+	formatJson  = "json"
+	formatYaml  = "yaml"
+)
+
+// Schemas for list and describe commands in json, yaml and table format
+
+type ClusterItem struct {
+	Name     string   `json:"name" yaml:"name"`
+	Arn      string   `json:"arn" yaml:"arn"`
+	Services []string `json:"services,omitempty" yaml:"services,omitempty"`
+}
+
+type ServiceListItem struct {
+	Name string `json:"name" yaml:"name"`
+	Arn  string `json:"arn" yaml:"arn"`
+}
+
+type TaskItem struct {
+	Id  string `json:"id" yaml:"id"`
+	Arn string `json:"arn" yaml:"arn"`
+}
+
+type Ec2InstanceItem struct {
+	InstanceId       string `json:"instanceId" yaml:"instanceId"`
+	Name             string `json:"name" yaml:"name"`
+	State            string `json:"state" yaml:"state"`
+	PublicIpAddress  string `json:"publicIpAddress,omitempty" yaml:"publicIpAddress,omitempty"`
+	PrivateIpAddress string `json:"privateIpAddress,omitempty" yaml:"privateIpAddress,omitempty"`
+	InstanceType     string `json:"instanceType,omitempty" yaml:"instanceType,omitempty"`
+	AvailabilityZone string `json:"availabilityZone,omitempty" yaml:"availabilityZone,omitempty"`
+	LaunchTime       string `json:"launchTime,omitempty" yaml:"launchTime,omitempty"`
+	ImageId          string `json:"imageId,omitempty" yaml:"imageId,omitempty"`
+	Cluster          string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+}
+
+type LoadBalancerItem struct {
+	Name      string            `json:"name" yaml:"name"`
+	DNSName   string            `json:"dnsName" yaml:"dnsName"`
+	Instances []Ec2InstanceItem `json:"instances" yaml:"instances"`
+}
+
+type LambdaFunctionItem struct {
+	Name         string `json:"name" yaml:"name"`
+	Runtime      string `json:"runtime" yaml:"runtime"`
+	Version      string `json:"version" yaml:"version"`
+	LastModified string `json:"lastModified" yaml:"lastModified"`
+}
+
+type S3BucketItem struct {
+	Name         string `json:"name" yaml:"name"`
+	CreationDate string `json:"creationDate" yaml:"creationDate"`
+}
+
+type ServiceDescriptionItem struct {
+	Name           string           `json:"name" yaml:"name"`
+	Status         string           `json:"status" yaml:"status"`
+	TaskDefinition string           `json:"taskDefinition" yaml:"taskDefinition"`
+	RunningCount   int64            `json:"runningCount" yaml:"runningCount"`
+	PendingCount   int64            `json:"pendingCount" yaml:"pendingCount"`
+	DesiredCount   int64            `json:"desiredCount" yaml:"desiredCount"`
+	Deployments    []DeploymentItem `json:"deployments" yaml:"deployments"`
+}
+
+type DeploymentItem struct {
+	TaskDefinition string `json:"taskDefinition" yaml:"taskDefinition"`
+	Status         string `json:"status" yaml:"status"`
+	RunningCount   int64  `json:"runningCount" yaml:"runningCount"`
+	PendingCount   int64  `json:"pendingCount" yaml:"pendingCount"`
+	DesiredCount   int64  `json:"desiredCount" yaml:"desiredCount"`
+}
+
+type ClusterCapacityItem struct {
+	Cluster        string                          `json:"cluster" yaml:"cluster"`
+	Service        string                          `json:"service,omitempty" yaml:"service,omitempty"`
+	TaskDefinition string                          `json:"taskDefinition,omitempty" yaml:"taskDefinition,omitempty"`
+	TaskCpu        int64                           `json:"taskCpu,omitempty" yaml:"taskCpu,omitempty"`
+	TaskMemory     int64                           `json:"taskMemory,omitempty" yaml:"taskMemory,omitempty"`
+	Instances      []ContainerInstanceCapacityItem `json:"instances" yaml:"instances"`
+	Total          CapacityTotalItem               `json:"total" yaml:"total"`
+}
+
+type ContainerInstanceCapacityItem struct {
+	InstanceId       string `json:"instanceId" yaml:"instanceId"`
+	InstanceType     string `json:"instanceType" yaml:"instanceType"`
+	AvailabilityZone string `json:"availabilityZone" yaml:"availabilityZone"`
+	Status           string `json:"status" yaml:"status"`
+	AgentVersion     string `json:"agentVersion" yaml:"agentVersion"`
+	AgentConnected   bool   `json:"agentConnected" yaml:"agentConnected"`
+	RegisteredCpu    int64  `json:"registeredCpu" yaml:"registeredCpu"`
+	RemainingCpu     int64  `json:"remainingCpu" yaml:"remainingCpu"`
+	RegisteredMemory int64  `json:"registeredMemory" yaml:"registeredMemory"`
+	RemainingMemory  int64  `json:"remainingMemory" yaml:"remainingMemory"`
+	RunningTasks     int64  `json:"runningTasks" yaml:"runningTasks"`
+	PendingTasks     int64  `json:"pendingTasks" yaml:"pendingTasks"`
+	Fits             *int64 `json:"fits,omitempty" yaml:"fits,omitempty"`
+}
+
+type CapacityTotalItem struct {
+	Instances        int    `json:"instances" yaml:"instances"`
+	RegisteredCpu    int64  `json:"registeredCpu" yaml:"registeredCpu"`
+	RemainingCpu     int64  `json:"remainingCpu" yaml:"remainingCpu"`
+	RegisteredMemory int64  `json:"registeredMemory" yaml:"registeredMemory"`
+	RemainingMemory  int64  `json:"remainingMemory" yaml:"remainingMemory"`
+	RunningTasks     int64  `json:"runningTasks" yaml:"runningTasks"`
+	PendingTasks     int64  `json:"pendingTasks" yaml:"pendingTasks"`
+	Fits             *int64 `json:"fits,omitempty" yaml:"fits,omitempty"`
+}
+
+func validateFormat() error {
+	switch outputFormat {
+	case formatText, formatTable, formatJson, formatYaml:
+		return nil
+	default:
+		return usageError("Unknown format: " + outputFormat + ", use one of text, table, json or yaml")
+	}
+}
+
+// printFormatted prints the items in the format given by -format. The header
+// and rows are used for table format, and the text function prints the
+// command's own text output.
+func printFormatted(items interface{}, header []string, rows [][]string, text func() error) error {
+	return printFormattedAs(outputFormat, items, header, rows, text)
+}
+
+// printFormattedAs is printFormatted for commands that choose the format
+// themselves, rather than always taking the one given by -format.
+func printFormattedAs(format string, items interface{}, header []string, rows [][]string, text func() error) error {
+	switch format {
+	case formatJson:
+		content, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(content))
+	case formatYaml:
+		content, err := yaml.Marshal(items)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(string(content))
+	case formatTable:
+		return printTable(header, rows)
+	default:
+		return text()
+	}
+
+	return nil
+}
+
+// printTable prints the rows in aligned columns, below the header in upper case.
+func printTable(header []string, rows [][]string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	//noinspection GoUnhandledErrorResult
+	fmt.Fprintln(writer, strings.ToUpper(strings.Join(header, "\t")))
+	for i := 0; i < len(rows); i++ {
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintln(writer, strings.Join(rows[i], "\t"))
+	}
+
+	return writer.Flush()
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
-	"os"
+	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 type CommandHelp struct {
@@ -57,12 +57,13 @@ func printCommandHelp() {
 
 	createReport := newCommandHelp("createReport", "Generates a report of running services")
 	createReport.Parameters = append(createReport.Parameters,
-		*newParameter("reportConfig", "The configuration file used to fetch issues from Jira", true),
+		*newParameter("reportConfig", "The configuration file used to fetch issues from Jira (not needed with -env)", true),
 		*newParameter("reportTemplate", "Transform jira issues into release notes file", true),
+		*newParameter("env", "Environments to report on instead of -reportConfig, comma separated", false),
 	)
 	commands = append(commands, *createReport)
 
-	listS3Buckets := newCommandHelp("listS3Buckets", "List available S3 buckets")
+	listS3Buckets := newCommandHelp("listS3Buckets", "List available S3 buckets. Supports -format")
 	commands = append(commands, *listS3Buckets)
 
 	listFilesInS3Bucket := newCommandHelp("listFilesInS3Bucket", "List available objects in an S3 bucket")
@@ -72,16 +73,16 @@ func printCommandHelp() {
 	)
 	commands = append(commands, *listFilesInS3Bucket)
 
-	listClusters := newCommandHelp("listClusters", "List available clusters. -v will also list services for all clusters")
+	listClusters := newCommandHelp("listClusters", "List available clusters. -v will also list services for all clusters. Supports -format")
 	commands = append(commands, *listClusters)
 
-	listServices := newCommandHelp("listServices", "List available services")
+	listServices := newCommandHelp("listServices", "List available services. Supports -format")
 	listServices.Parameters = append(listServices.Parameters,
 		*newParameter("cluster", "Cluster for which to list services", true),
 	)
 	commands = append(commands, *listServices)
 
-	listTasks := newCommandHelp("listTasks", "List tasks for a service")
+	listTasks := newCommandHelp("listTasks", "List tasks for a service. Supports -format")
 	listTasks.Parameters = append(listTasks.Parameters,
 		*newParameter("cluster", "Cluster for which to list tasks", true),
 		*newParameter("service", "Service for which to list tasks", true),
@@ -100,49 +101,120 @@ func printCommandHelp() {
 	)
 	commands = append(commands, *deployLambdaFunction)
 
-	describeService := newCommandHelp("describeService", "Describes the service. Optionally -v and -vv may be used")
+	describeService := newCommandHelp("describeService", "Describes the service. Optionally -v and -vv may be used. Supports -format")
 	describeService.Parameters = append(describeService.Parameters,
 		*newParameter("cluster", "Cluster for which the service belongs", true),
 		*newParameter("service", "Service to describe", true),
 	)
 	commands = append(commands, *describeService)
 
+	describeContainerInstances := newCommandHelp("describeContainerInstances", "Lists the attributes of the container instances of a cluster. -v also shows their status, agent, free CPU and memory and tasks")
+	describeContainerInstances.Parameters = append(describeContainerInstances.Parameters,
+		*newParameter("cluster", "The cluster whose container instances to describe", true),
+	)
+	commands = append(commands, *describeContainerInstances)
+
+	clusterCapacity := newCommandHelp("clusterCapacity", "Shows the free and total CPU and memory, tasks and agent of each container instance of a cluster, with totals. Supports -format")
+	clusterCapacity.Parameters = append(clusterCapacity.Parameters,
+		*newParameter("cluster", "The cluster to show the capacity of", true),
+		*newParameter("service", "Also shows how many more tasks of the service would fit", false),
+	)
+	commands = append(commands, *clusterCapacity)
+
+	drainInstance := newCommandHelp("drainInstance", "Sets a container instance to DRAINING and waits until its tasks run on other instances")
+	drainInstance.Parameters = append(drainInstance.Parameters,
+		*newParameter("cluster", "The cluster of the container instance", true),
+		*newParameter("instanceId", "The EC2 instance ID of the container instance", true),
+		*newParameter("timeout", "Max time to wait for the tasks to stop, and for each service to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls, default 2s", false),
+	)
+	commands = append(commands, *drainInstance)
+
+	rollInstances := newCommandHelp("rollInstances", "Drains and terminates the container instances of a cluster one at a time, waiting for their auto scaling groups to replace them and for the services to become stable in between")
+	rollInstances.Parameters = append(rollInstances.Parameters,
+		*newParameter("cluster", "The cluster whose container instances to replace", true),
+		*newParameter("timeout", "Max time to wait for each drain, replacement and service to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls, default 2s", false),
+		*newParameter("dryRun", "Print the instances that would be replaced and their auto scaling groups", false),
+	)
+	commands = append(commands, *rollInstances)
+
 	updateService := newCommandHelp("updateService", "Stop/start all running tasks for the specified service")
 	updateService.Parameters = append(updateService.Parameters,
 		*newParameter("cluster", "Cluster for which the service to update belongs", true),
 		*newParameter("service", "Service to update", true),
+		*newParameter("timeout", "Max time to wait for the deployment to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls for deployment status, default 2s", false),
 	)
 	commands = append(commands, *updateService)
 
 	updateServices := newCommandHelp("updateServices", "Stop/start all running tasks for specified services")
 	updateServices.Parameters = append(updateServices.Parameters,
-		*newParameter("updatesFile", "[{\"profile\": \"(profile in credential file)\", \"region\": \"(region to use (if not specified, writer-tool will use region specified in credential file))\", \"cluster\": \"(cluster as reported using -listClusters)\", \"service\": \"(service as reported using -listServices)\", \"containerName\": \"(name of container to update (if multiple containers in same service))\", \"label\": \"(Label that should be used in output for service)\"}]", true),
+		*newParameter("updatesFile", "[{\"profile\": \"(profile in credential file)\", \"region\": \"(region to use (if not specified, writer-tool will use region specified in credential file))\", \"roleArn\": \"(role to assume in the account of the service, default from -roleArn)\", \"cluster\": \"(cluster as reported using -listClusters)\", \"service\": \"(service as reported using -listServices)\", \"containerName\": \"(name of container to update (if multiple containers in same service))\", \"label\": \"(Label that should be used in output for service)\"}]", true),
+		*newParameter("timeout", "Max time to wait for the deployment to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls for deployment status, default 2s", false),
+		*newParameter("env", "Environments whose services to use instead of -updatesFile, comma separated", false),
 	)
 	commands = append(commands, *updateServices)
 
-	releaseService := newCommandHelp("releaseService", "Creates a new release for the service")
+	releaseService := newCommandHelp("releaseService", "Creates a new release for the service. Rolls back to the running task definition if the release does not reach a steady state")
 	releaseService.Parameters = append(releaseService.Parameters,
 		*newParameter("cluster", "Cluster for which the service to release belongs", true),
 		*newParameter("service", "Service to release", true),
 		*newParameter("version", "Version to release", true),
+		*newParameter("dryRun", "Print the release plan without registering a task definition or updating the service", false),
+		*newParameter("healthCheckUrl", "URL probed after the release is steady. A failing probe rolls back the release", false),
+		*newParameter("healthCheckStatus", "HTTP status expected from the health check URL, default 200", false),
+		*newParameter("healthCheckBody", "Text expected in the body from the health check URL", false),
+		*newParameter("healthCheckCount", "Number of consecutive probes that must pass, default 3", false),
+		*newParameter("healthCheckInterval", "Time between probes, default 5s", false),
+		*newParameter("timeout", "Max time to wait for the deployment to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls for deployment status, default 2s", false),
 	)
 	commands = append(commands, *releaseService)
 
 	releaseServices := newCommandHelp("releaseServices", "Release all services specified")
 	releaseServices.Parameters = append(releaseServices.Parameters,
-		*newParameter("updatesFile", "[{\"profile\": \"(profile in credential file)\", \"region\": \"(region to use (if not specified, writer-tool will use region specified in credential file))\", \"cluster\": \"(cluster as reported using -listClusters)\", \"service\": \"(service as reported using -listServices)\", \"containerName\": \"(name of container to update (if multiple containers in same service))\", \"label\": \"(Label that should be used in output for service)\"}]", true),
+		*newParameter("updatesFile", "[{\"profile\": \"(profile in credential file)\", \"region\": \"(region to use (if not specified, writer-tool will use region specified in credential file))\", \"roleArn\": \"(role to assume in the account of the service, default from -roleArn)\", \"cluster\": \"(cluster as reported using -listClusters)\", \"service\": \"(service as reported using -listServices)\", \"containerName\": \"(name of container to update (if multiple containers in same service))\", \"label\": \"(Label that should be used in output for service)\", \"wave\": \"(services are released one wave at a time in ascending order, default 0)\", \"healthCheckUrl\": \"(URL probed after release, a failing probe rolls back the service and stops later waves)\", \"healthCheckStatus\": \"(expected HTTP status, default from -healthCheckStatus)\", \"healthCheckBody\": \"(expected text in body, default from -healthCheckBody)\", \"healthCheckCount\": \"(consecutive probes that must pass, default from -healthCheckCount)\"}]", true),
+		*newParameter("version", "Version to release", true),
+		*newParameter("dryRun", "Print the release plan for every service without registering task definitions or updating services", false),
+		*newParameter("healthCheckStatus", "HTTP status expected from health check URLs, default 200", false),
+		*newParameter("healthCheckBody", "Text expected in the body from health check URLs", false),
+		*newParameter("healthCheckCount", "Number of consecutive probes that must pass, default 3", false),
+		*newParameter("healthCheckInterval", "Time between probes, default 5s", false),
+		*newParameter("timeout", "Max time to wait for the deployment to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls for deployment status, default 2s", false),
+		*newParameter("env", "Environments whose services to use instead of -updatesFile, comma separated", false),
 	)
 	commands = append(commands, *releaseServices)
 
-	listEc2Instances := newCommandHelp("listEc2Instances", "List available EC2 instances")
+	rollbackService := newCommandHelp("rollbackService", "Rolls back the service to the previous revision of its task definition")
+	rollbackService.Parameters = append(rollbackService.Parameters,
+		*newParameter("cluster", "Cluster for which the service to roll back belongs", true),
+		*newParameter("service", "Service to roll back", true),
+		*newParameter("containerName", "Name of the container to report image version for (if multiple containers in same service)", false),
+		*newParameter("timeout", "Max time to wait for the deployment to become stable, default 8m", false),
+		*newParameter("pollInterval", "Initial time between polls for deployment status, default 2s", false),
+	)
+	commands = append(commands, *rollbackService)
+
+	listEc2Instances := newCommandHelp("listEc2Instances", "List running EC2 instances, or those selected by -filter. Supports -format")
+	listEc2Instances.Parameters = append(listEc2Instances.Parameters,
+		*newParameter("instanceName", "Only list instances with the name, which may contain the wildcards * and ?", false),
+		*newParameter("filter", "EC2 filters like tag:Team=editor,instance-state-name=stopped", false),
+		*newParameter("columns", "Columns of the table, from id, name, state, public-ip, private-ip, type, az, launch-time, ami and cluster", false),
+	)
 	commands = append(commands, *listEc2Instances)
 
-	listLoadBalancers := newCommandHelp("listLoadBalancers", "List available Load Balancers and their contained EC2 instances")
+	listLoadBalancers := newCommandHelp("listLoadBalancers", "List available Load Balancers and their contained EC2 instances. Supports -format")
 	commands = append(commands, *listLoadBalancers)
 
-	listLambdaFunctions := newCommandHelp("listLambdaFunctions", "List available lambda functions")
+	listLambdaFunctions := newCommandHelp("listLambdaFunctions", "List available lambda functions. Supports -format")
 	commands = append(commands, *listLambdaFunctions)
 
+	listEnvironments := newCommandHelp("listEnvironments", "List environments in ~/.writer-tool/environments.json. -v will also list profile, region and label")
+	commands = append(commands, *listEnvironments)
+
 	getLambdaFunctionInfo := newCommandHelp("getLambdaFunctionInfo", "Get lambda function information")
 	getLambdaFunctionInfo.Parameters = append(getLambdaFunctionInfo.Parameters,
 		*newParameter("functionName", "Name of lambda for which to fetch info", true),
@@ -167,26 +239,105 @@ func printCommandHelp() {
 	ssh.Parameters = append(ssh.Parameters,
 		*newParameter("instanceName", "The aws instance(s) to use as source(s). Operation will occur on all instances with the specific name (required if instanceId is not specified)", false),
 		*newParameter("instanceId", "The specific aws instance to use as source. (required if instanceName is not specified)", false),
-		*newParameter("pemfile", "The SSH pem file used for authentication", true),
+		*newParameter("filter", "EC2 filters selecting running instances, like tag:Team=editor, combined with instanceName if given", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("sshUser", "The user to log in as, default ec2-user", false),
+		*newParameter("bastion", "Jump host to reach the private IP of the instance through, as [user@]host[:port] where host may be an instance name", false),
+		*newParameter("transport", "ssh to the public IP of the instance, or ssm through SSM without PEM file or public IP, default ssh", false),
+		*newParameter("parallel", "Max number of instances to run the command on at the same time, default 10", false),
+		*newParameter("failFast", "Stop the command on all instances when it fails on one", false),
 		*newParameter("{command}", "The command to execute (e.g. 'ls -l')", true),
 	)
 	commands = append(commands, *ssh)
 
+	execService := newCommandHelp("execService", "Executes a command inside the container of every running task of a service")
+	execService.Parameters = append(execService.Parameters,
+		*newParameter("cluster", "The cluster of the service", true),
+		*newParameter("service", "The service whose tasks to execute the command in", true),
+		*newParameter("containerName", "The container to execute the command in, required if the tasks have several containers", false),
+		*newParameter("transport", "docker exec over ssh or ssm on the instance of each task, or ecs for ECS Exec, default ssh", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("parallel", "Max number of tasks to execute the command in at the same time, default 10", false),
+		*newParameter("failFast", "Stop the command in all tasks when it fails in one", false),
+		*newParameter("{command}", "The command to execute, after -- (e.g. -- jstack 1)", true),
+	)
+	commands = append(commands, *execService)
+
+	collectDiagnostics := newCommandHelp("collectDiagnostics", "Downloads thread dumps, a heap histogram, container logs and disk and memory usage from every running task of a service")
+	collectDiagnostics.Parameters = append(collectDiagnostics.Parameters,
+		*newParameter("cluster", "The cluster of the service", true),
+		*newParameter("service", "The service whose tasks to collect diagnostics from", true),
+		*newParameter("containerName", "The container to collect diagnostics from, required if the tasks have several containers", false),
+		*newParameter("threadDumps", "Number of thread dumps to take of each task, default 3", false),
+		*newParameter("threadDumpInterval", "Time between thread dumps, default 5s", false),
+		*newParameter("logLines", "Number of the latest container log lines to download, default 1000", false),
+		*newParameter("output", "The target directory, default a timestamped directory below ~/.writer-tool", false),
+		*newParameter("zip", "Zips the collected diagnostics", false),
+		*newParameter("s3bucket", "The bucket to upload the zipped diagnostics to", false),
+		*newParameter("s3filename", "The key to upload the zipped diagnostics as, default diagnostics/{service}-{timestamp}.zip", false),
+		*newParameter("transport", "ssh or ssm to reach the instance of each task, default ssh", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("parallel", "Max number of tasks to collect diagnostics from at the same time, default 10", false),
+	)
+	commands = append(commands, *collectDiagnostics)
+
 	scp := newCommandHelp("scp", "Copies files from the specified instance(s)")
 	scp.Parameters = append(scp.Parameters,
 		*newParameter("instanceName", "The aws instance(s) to use as source(s). Operation will occur on all instances with the specific name (required if instanceId is not specified)", false),
 		*newParameter("instanceId", "The specific aws instance to use as source. (required if instanceName is not specified)", false),
-		*newParameter("pemfile", "The SSH pem file used for authentication", false),
+		*newParameter("filter", "EC2 filters selecting running instances, like tag:Team=editor, combined with instanceName if given", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("sshUser", "The user to log in as, default ec2-user", false),
+		*newParameter("bastion", "Jump host to reach the private IP of the instance through, as [user@]host[:port] where host may be an instance name", false),
+		*newParameter("transport", "ssh to the public IP of the instance, or ssm through SSM without PEM file or public IP, default ssh", false),
 		*newParameter("output", "The target directory", true),
 		*newParameter("recursive", "Copies from source recursively", false),
+		*newParameter("parallel", "Max number of instances to copy from at the same time, default 10", false),
+		*newParameter("failFast", "Stop copying from all instances when copying from one fails", false),
+		*newParameter("{paths}", "The remote files to copy, which may be patterns like /var/log/*.log", true),
 	)
 	commands = append(commands, *scp)
 
+	scpTo := newCommandHelp("scpTo", "Copies files to the specified instance(s)")
+	scpTo.Parameters = append(scpTo.Parameters,
+		*newParameter("instanceName", "The aws instance(s) to use as target(s). Operation will occur on all instances with the specific name (required if instanceId is not specified)", false),
+		*newParameter("instanceId", "The specific aws instance to use as target. (required if instanceName is not specified)", false),
+		*newParameter("filter", "EC2 filters selecting running instances, like tag:Team=editor, combined with instanceName if given", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("sshUser", "The user to log in as, default ec2-user", false),
+		*newParameter("bastion", "Jump host to reach the private IP of the instance through, as [user@]host[:port] where host may be an instance name", false),
+		*newParameter("transport", "ssh to the public IP of the instance, or ssm through SSM without PEM file or public IP, default ssh", false),
+		*newParameter("target", "The remote directory to copy to, which must exist", true),
+		*newParameter("recursive", "Copies directories recursively", false),
+		*newParameter("parallel", "Max number of instances to copy to at the same time, default 10", false),
+		*newParameter("failFast", "Stop copying to all instances when copying to one fails", false),
+		*newParameter("{paths}", "The local files to copy, which may be patterns like conf/*.properties", true),
+	)
+	commands = append(commands, *scpTo)
+
+	tunnel := newCommandHelp("tunnel", "Forwards a local port through an instance to a host and port reachable from it, until Ctrl-C")
+	tunnel.Parameters = append(tunnel.Parameters,
+		*newParameter("instanceName", "The aws instance to forward through, the first running one with the name is used (required if instanceId is not specified)", false),
+		*newParameter("instanceId", "The specific aws instance to forward through. (required if instanceName is not specified)", false),
+		*newParameter("filter", "EC2 filters selecting running instances, like tag:Team=editor, combined with instanceName if given", false),
+		*newParameter("remote", "The host and port to forward to as seen from the instance, e.g. localhost:8080, or only a port on the instance", true),
+		*newParameter("localPort", "The local port to forward from, default the remote port", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("sshUser", "The user to log in as, default ec2-user", false),
+		*newParameter("bastion", "Jump host to reach the private IP of the instance through, as [user@]host[:port] where host may be an instance name", false),
+		*newParameter("transport", "ssh to the public IP of the instance, or ssm for an SSM port forwarding session, default ssh", false),
+	)
+	commands = append(commands, *tunnel)
+
 	login := newCommandHelp("login", "Log in to instance using SSH")
 	login.Parameters = append(login.Parameters,
 		*newParameter("instanceName", "The aws instance(s) to use as source(s). Operation will occur on all instances with the specific name (required if instanceId is not specified)", false),
 		*newParameter("instanceId", "The specific aws instance to use as source. (required if instanceName is not specified)", false),
-		*newParameter("pemfile", "The SSH pem file used for authentication", false),
+		*newParameter("filter", "EC2 filters selecting running instances, like tag:Team=editor, combined with instanceName if given", false),
+		*newParameter("pemfile", "The SSH pem file used for authentication, keys in ssh-agent are also used", false),
+		*newParameter("sshUser", "The user to log in as, default ec2-user", false),
+		*newParameter("bastion", "Jump host to reach the private IP of the instance through, as [user@]host[:port] where host may be an instance name", false),
+		*newParameter("transport", "ssh to the public IP of the instance, or ssm through SSM without PEM file or public IP, default ssh", false),
 	)
 	commands = append(commands, *login)
 
@@ -254,197 +405,350 @@ func printCommandHelp() {
 	}
 }
 
-func validateListFilesInS3Bucket() {
+func validateListFilesInS3Bucket() error {
 	if bucket == "" {
-		errUsage("s3bucket must be specified")
+		return usageError("s3bucket must be specified")
 	}
+
+	return nil
 }
 
-func validateCopyFileFromS3Bucket() {
+func validateCopyFileFromS3Bucket() error {
 	if bucket == "" {
-		errUsage("s3bucket must be specified")
+		return usageError("s3bucket must be specified")
 	}
 
 	if filename == "" {
-		errUsage("s3filename must be specified")
+		return usageError("s3filename must be specified")
 	}
 
 	if output == "" {
-		errUsage("output must be specified")
+		return usageError("output must be specified")
 	}
+
+	return nil
 }
 
-func validateDeployLambdaFunction() {
+func validateDeployLambdaFunction() error {
 	if bucket == "" {
-		errUsage("s3bucket must be speficied")
+		return usageError("s3bucket must be speficied")
 	}
 
 	if filename == "" {
-		errUsage("s3filename must be specified")
+		return usageError("s3filename must be specified")
 	}
 
 	if functionName == "" {
-		errUsage("functionName must be specified")
+		return usageError("functionName must be specified")
 	}
 
 	if publish == "true" && alias == "" {
-		errUsage("alias must be specified when publishing")
+		return usageError("alias must be specified when publishing")
 	}
 
 	if publish == "true" && version == "" {
-		errUsage("version must be specified when publishing")
+		return usageError("version must be specified when publishing")
 	}
+
+	return nil
+}
+
+// getInstances returns the instance given by -instanceId, or all instances
+// named by -instanceName.
+func getInstances() ([]*ec2.Instance, error) {
+	if instanceId != "" {
+		instance, err := GetInstanceForId(instanceId)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*ec2.Instance{instance}, nil
+	}
+
+	if instanceName != "" || filter != "" {
+		return GetInstancesForFilter(instanceName)
+	}
+
+	return nil, usageError("Either instanceId, instanceName or filter parameter has to be specified")
 }
 
-func executeCommand() {
+func executeCommand() error {
 	switch command {
 	case "copyFileFromS3Bucket":
-		validateCopyFileFromS3Bucket()
-		CopyFileFromS3Bucket(bucket, filename, output)
+		if err := validateCopyFileFromS3Bucket(); err != nil {
+			return err
+		}
+		return CopyFileFromS3Bucket(bucket, filename, output)
 	case "createReleaseNotes":
-		bytes := readConfigFromFile()
-		template := readTemplateFromFile()
-		version := getVersion()
-		dependencies := readDependenciesFromFile()
-		GenerateReleaseNotes(bytes, template, version, releaseDate, dependencies)
+		bytes, err := readConfigFromFile()
+		if err != nil {
+			return err
+		}
+		template, err := readTemplateFromFile()
+		if err != nil {
+			return err
+		}
+		version, err := getVersion()
+		if err != nil {
+			return err
+		}
+		dependencies, err := readDependenciesFromFile()
+		if err != nil {
+			return err
+		}
+		return GenerateReleaseNotes(bytes, template, version, releaseDate, dependencies)
 	case "createReport":
-		bytes := readConfigFromFile()
-		template := readTemplateFromFile()
-		GenerateReport(bytes, template)
+		bytes, err := readReportConfig()
+		if err != nil {
+			return err
+		}
+		template, err := readTemplateFromFile()
+		if err != nil {
+			return err
+		}
+		return GenerateReport(bytes, template)
 	case "deployLambdaFunction":
-		validateDeployLambdaFunction()
-		DeployLambdaFunction(functionName, bucket, filename, alias, version, runtime, publish)
+		if err := validateDeployLambdaFunction(); err != nil {
+			return err
+		}
+		return DeployLambdaFunction(functionName, bucket, filename, alias, version, runtime, publish)
 	case "listS3Buckets":
-		ListS3Buckets()
+		return ListS3Buckets()
 	case "listFilesInS3Bucket":
-		validateListFilesInS3Bucket()
-		ListFilesInS3Bucket(bucket, filename)
+		if err := validateListFilesInS3Bucket(); err != nil {
+			return err
+		}
+		return ListFilesInS3Bucket(bucket, filename)
 	case "listClusters":
-		ListClusters()
+		return ListClusters()
 	case "listServices":
-		clusterArn := getClusterArn()
-		ListServices(clusterArn)
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		return ListServices(clusterArn)
 	case "listTasks":
-		clusterArn := getClusterArn()
-		serviceArn := getServiceArn()
-		ListTasks(clusterArn, serviceArn)
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		return ListTasks(clusterArn, serviceArn)
 	case "describeService":
-		clusterArn := getClusterArn()
-		serviceArn := getServiceArn()
-		DescribeService(clusterArn, serviceArn)
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		return DescribeService(clusterArn, serviceArn)
 	case "describeContainerInstances":
-		clusterArn := getClusterArn()
-		DescribeContainerInstances(clusterArn)
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		return DescribeContainerInstances(clusterArn)
+	case "clusterCapacity":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn := ""
+		if service != "" {
+			serviceArn, err = getServiceArn()
+			if err != nil {
+				return err
+			}
+		}
+		return ClusterCapacity(clusterArn, serviceArn)
+	case "drainInstance":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		if instanceId == "" {
+			return usageError("You must specify the instance to drain with: -instanceId")
+		}
+		return DrainInstance(clusterArn, instanceId)
+	case "rollInstances":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		return RollInstances(clusterArn)
 	case "updateService":
-		clusterArn := getClusterArn()
-		serviceArn := getServiceArn()
-		UpdateService(clusterArn, serviceArn)
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		return UpdateService(clusterArn, serviceArn)
 	case "updateServices":
-		updatesFile := getUpdatesFile()
-		UpdateServices(updatesFile)
+		updatesFile, err := getUpdatesFile()
+		if err != nil {
+			return err
+		}
+		return UpdateServices(updatesFile)
 	case "releaseService":
-		clusterArn := getClusterArn()
-		serviceArn := getServiceArn()
-		version := getVersion()
-		ReleaseService(clusterArn, serviceArn, version)
+		if err := validateHealthCheck(); err != nil {
+			return err
+		}
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		version, err := getVersion()
+		if err != nil {
+			return err
+		}
+		return ReleaseService(clusterArn, serviceArn, version)
 	case "releaseServices":
-		updatesFile := getUpdatesFile()
-		version := getVersion()
-		ReleaseServices(version, updatesFile)
+		if err := validateHealthCheck(); err != nil {
+			return err
+		}
+		updatesFile, err := getUpdatesFile()
+		if err != nil {
+			return err
+		}
+		version, err := getVersion()
+		if err != nil {
+			return err
+		}
+		return ReleaseServices(version, updatesFile)
+	case "rollbackService":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		return RollbackService(clusterArn, serviceArn)
 	case "listEc2Instances":
-		ListEc2Instances(instanceName)
+		return ListEc2Instances(instanceName)
 	case "listLoadBalancers":
-		ListLoadBalancers()
+		return ListLoadBalancers()
 	case "listLambdaFunctions":
-		ListLambdaFunctions()
+		return ListLambdaFunctions()
+	case "listEnvironments":
+		return ListEnvironments()
 	case "ssh":
-		if sshPem == "" {
-			errUsage("A SSH PEM file must be specified")
-		}
-		if instanceId != "" {
-			instance := GetInstanceForId(instanceId)
-			Ssh(instance, sshPem, flag.Args())
-		} else if instanceName != "" {
-			instances := GetInstancesForName(instanceName)
-			if len(instances) == 1 {
-				Ssh(instances[0], sshPem, flag.Args())
-			} else {
-				for i := 0; i < len(instances); i++ {
-					fmt.Printf("[%s]\n", *instances[i].InstanceId)
-					Ssh(instances[i], sshPem, flag.Args())
-				}
-			}
-		} else {
-			errUsage("Either instanceId or instanceName parameter has to be specified")
+		if err := validateInstanceTransport(); err != nil {
+			return err
+		}
+		instances, err := getInstances()
+		if err != nil {
+			return err
 		}
+		if len(instances) == 1 {
+			return Ssh(instances[0], sshPem, flag.Args())
+		}
+		return SshInstances(instances, sshPem, flag.Args())
 	case "login":
-		if instanceId != "" {
-			instance := GetInstanceForId(instanceId)
-			SshLogin(instance, sshPem)
-		} else if instanceName != "" {
-			instances := GetInstancesForName(instanceName)
-			if len(instances) == 1 {
-				SshLogin(instances[0], sshPem)
-			} else {
-				fmt.Printf("Found %d instances with name %s\n", len(instances), instanceName)
-				fmt.Println("Please specify instance ID with -instanceId flag for:")
-				for i := 0; i < len(instances); i++ {
-					fmt.Printf("   %s\n", *instances[i].InstanceId)
-				}
-				os.Exit(1)
+		if err := validateInstanceTransport(); err != nil {
+			return err
+		}
+		instances, err := getInstances()
+		if err != nil {
+			return err
+		}
+		if len(instances) > 1 {
+			fmt.Printf("Found %d instances with name %s\n", len(instances), instanceName)
+			fmt.Println("Please specify instance ID with -instanceId flag for:")
+			for i := 0; i < len(instances); i++ {
+				fmt.Printf("   %s\n", *instances[i].InstanceId)
 			}
-		} else {
-			errUsage("Either instanceId or instanceName parameter has to be specified")
+			return usageError("More than one instance named " + instanceName)
+		}
+		return SshLogin(instances[0], sshPem)
+	case "execService":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
 		}
+		return ExecService(clusterArn, serviceArn, flag.Args())
+	case "collectDiagnostics":
+		clusterArn, err := getClusterArn()
+		if err != nil {
+			return err
+		}
+		serviceArn, err := getServiceArn()
+		if err != nil {
+			return err
+		}
+		return CollectDiagnostics(clusterArn, serviceArn)
 	case "scp":
-		if sshPem == "" {
-			errUsage("A SSH PEM file must be specified")
-		}
-		if instanceId != "" {
-			instance := GetInstanceForId(instanceId)
-			Scp(instance, sshPem, flag.Args())
-		} else if instanceName != "" {
-			ips := GetInstancesForName(instanceName)
-			if len(ips) == 1 {
-				fmt.Printf("[%s] ... ", *ips[0].InstanceId)
-				Scp(ips[0], sshPem, flag.Args())
-				fmt.Println("done")
-			} else {
-				for i := 0; i < len(ips); i++ {
-					fmt.Printf("[%s] ... ", *ips[i].InstanceId)
-					Scp(ips[i], sshPem, flag.Args())
-					fmt.Println("done")
-				}
-			}
-		} else {
-			errUsage("Either instanceId or instanceName parameter has to be specified")
+		if err := validateInstanceTransport(); err != nil {
+			return err
+		}
+		instances, err := getInstances()
+		if err != nil {
+			return err
+		}
+		return ScpInstances(instances, sshPem, flag.Args())
+	case "tunnel":
+		if err := validateInstanceTransport(); err != nil {
+			return err
 		}
+		instances, err := getInstances()
+		if err != nil {
+			return err
+		}
+		return Tunnel(instances, sshPem)
+	case "scpTo":
+		if err := validateInstanceTransport(); err != nil {
+			return err
+		}
+		instances, err := getInstances()
+		if err != nil {
+			return err
+		}
+		return ScpToInstances(instances, sshPem, flag.Args())
 	case "getEntity":
 		if loadBalancer == "" {
-			errUsage("loadBalancer must be specified")
+			return usageError("loadBalancer must be specified")
 		}
 		if len(flag.Args()) != 1 {
-			errUsage("Entity ID must be provided")
+			return usageError("Entity ID must be provided")
 		}
-		GetEntity(loadBalancer, flag.Args()[0])
+		return GetEntity(loadBalancer, flag.Args()[0])
 	case "getLambdaFunctionInfo":
 		if functionName == "" {
-			errUsage("functionName needs to be specified")
+			return usageError("functionName needs to be specified")
 		}
-		GetLambdaFunctionInfo(functionName)
+		return GetLambdaFunctionInfo(functionName)
 	case "getLambdaFunctionAliasInfo":
 		if functionName == "" {
-			errUsage("functionName needs to be specified")
+			return usageError("functionName needs to be specified")
 		}
 		if alias == "" {
-			errUsage("alias needs to be specified")
+			return usageError("alias needs to be specified")
 		}
-		GetLambdaFunctionAliasInfo(functionName, alias)
+		return GetLambdaFunctionAliasInfo(functionName, alias)
 	case "version":
 		fmt.Println(appVersion)
 	case "help":
 		printCommandHelp()
 	default:
-		errUsage("Unknown command: " + command)
+		return usageError("Unknown command: " + command)
 	}
+
+	return nil
 }
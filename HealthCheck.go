@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HealthCheck describes the HTTP probe that must pass before a release is
+// considered successful.
+type HealthCheck struct {
+	Url            string
+	ExpectedStatus int
+	ExpectedBody   string
+	Count          int
+	Interval       time.Duration
+}
+
+// getHealthCheck creates a health check for the url using the -healthCheck*
+// flags, or nil if no url is given.
+func getHealthCheck(url string) *HealthCheck {
+	if url == "" {
+		return nil
+	}
+
+	return &HealthCheck{
+		Url:            url,
+		ExpectedStatus: healthCheckStatus,
+		ExpectedBody:   healthCheckBody,
+		Count:          healthCheckCount,
+		Interval:       healthCheckInterval,
+	}
+}
+
+// validateHealthCheck checks the -healthCheck* flags.
+func validateHealthCheck() error {
+	if healthCheckCount < 1 {
+		return usageError("-healthCheckCount must be at least 1")
+	}
+
+	return nil
+}
+
+func (h *HealthCheck) String() string {
+	description := h.Url + " expecting status " + strconv.Itoa(h.ExpectedStatus)
+
+	if h.ExpectedBody != "" {
+		description += " and body containing \"" + h.ExpectedBody + "\""
+	}
+
+	return description + ", " + strconv.Itoa(h.Count) + " times"
+}
+
+// probe requests the url once and verifies status and body.
+func (h *HealthCheck) probe() error {
+	client := http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(h.Url)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != h.ExpectedStatus {
+		return errors.New(h.Url + " responded with status " + strconv.Itoa(resp.StatusCode) + ", expected " + strconv.Itoa(h.ExpectedStatus))
+	}
+
+	if h.ExpectedBody != "" {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		if !strings.Contains(string(body), h.ExpectedBody) {
+			return errors.New(h.Url + " responded without \"" + h.ExpectedBody + "\" in body")
+		}
+	}
+
+	return nil
+}
+
+// waitForHealthy probes the health check the configured number of times in a
+// row. The first failing probe fails the health check.
+func waitForHealthy(label string, healthCheck *HealthCheck) error {
+	for i := 0; i < healthCheck.Count; i++ {
+		if i > 0 {
+			time.Sleep(healthCheck.Interval)
+		}
+
+		err := healthCheck.probe()
+		if err != nil {
+			return errors.New("Health check failed on probe " + strconv.Itoa(i+1) + " of " + strconv.Itoa(healthCheck.Count) + ": " + err.Error())
+		}
+
+		if verboseLevel > 0 {
+			fmt.Printf("%s: Health check %d of %d passed\n", label, i+1, healthCheck.Count)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitForHealthy(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int
+		count     int
+		fails     bool
+		probes    int
+	}{
+		{
+			name:      "passes the given number of times in a row",
+			responses: []int{200, 200, 200},
+			count:     3,
+			probes:    3,
+		},
+		{
+			name:      "fails on the first failing probe",
+			responses: []int{200, 503, 200},
+			count:     3,
+			fails:     true,
+			probes:    2,
+		},
+		{
+			name:      "fails on an unavailable service at once",
+			responses: []int{503},
+			count:     3,
+			fails:     true,
+			probes:    1,
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			var lock sync.Mutex
+			probes := 0
+
+			// Responds with the statuses in turn, repeating them once done
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				status := test.responses[probes%len(test.responses)]
+				probes++
+				lock.Unlock()
+
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			healthCheck := &HealthCheck{
+				Url:            server.URL,
+				ExpectedStatus: 200,
+				Count:          test.count,
+				Interval:       time.Millisecond,
+			}
+
+			_, err := captureStdout(t, func() error { return waitForHealthy("editor", healthCheck) })
+
+			if test.fails != (err != nil) {
+				t.Errorf("error = %v, want failure %v", err, test.fails)
+			}
+			if probes != test.probes {
+				t.Errorf("probed %d times, want %d", probes, test.probes)
+			}
+		})
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	defer func(count int) { healthCheckCount = count }(healthCheckCount)
+
+	tests := []struct {
+		count    int
+		exitCode int
+	}{
+		{count: 1},
+		{count: 5},
+		{count: 0, exitCode: exitUsage},
+		{count: -1, exitCode: exitUsage},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		healthCheckCount = tests[i].count
+
+		err := validateHealthCheck()
+		if tests[i].exitCode == 0 && err != nil {
+			t.Errorf("-healthCheckCount %d: unexpected error: %v", tests[i].count, err)
+		}
+		if tests[i].exitCode != 0 && (err == nil || exitCodeFor(err) != tests[i].exitCode) {
+			t.Errorf("-healthCheckCount %d: error = %v, want exit code %d", tests[i].count, err, tests[i].exitCode)
+		}
+	}
+}
@@ -4,42 +4,97 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
 	"strconv"
 )
 
-func DeployLambdaFunction(functionName, bucket, filename, alias, version, runtime, publish string) {
+func DeployLambdaFunction(functionName, bucket, filename, alias, version, runtime, publish string) error {
 	doPublish, err := strconv.ParseBool(publish)
 
 	if err != nil {
 		doPublish = false
 	}
 
-	deployLambdaFunction(functionName, bucket, filename, alias, version, runtime, doPublish)
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	return deployLambdaFunction(functionName, bucket, filename, alias, version, runtime, doPublish, clients.Lambda)
 }
 
-func GetLambdaFunctionAliasInfo(functionName, alias string) {
-	aliasInfo := getLambdaFunctionAliasInfo(functionName, alias)
-	functionInfo := getLambdaFunctionInfo(functionName, *aliasInfo.FunctionVersion)
+func GetLambdaFunctionAliasInfo(functionName, alias string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	aliasInfo, err := getLambdaFunctionAliasInfo(functionName, alias, clients.Lambda)
+	if err != nil {
+		return err
+	}
+
+	functionInfo, err := getLambdaFunctionInfo(functionName, *aliasInfo.FunctionVersion, clients.Lambda)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println(*functionInfo.Version, ": ", *functionInfo.Description)
+	return nil
 }
 
-func GetLambdaFunctionInfo(functionName string) {
-	fmt.Println(getLambdaFunctionInfo(functionName, "$LATEST"))
+func GetLambdaFunctionInfo(functionName string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	functionInfo, err := getLambdaFunctionInfo(functionName, "$LATEST", clients.Lambda)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(functionInfo)
+	return nil
 }
 
-func ListLambdaFunctions() {
-	result := listLambdaFunctions()
+func ListLambdaFunctions() error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	result, err := listLambdaFunctions(clients.Lambda)
+	if err != nil {
+		return err
+	}
+
+	items := []LambdaFunctionItem{}
+	var rows [][]string
 
 	for i := 0; i < len(result.Functions); i++ {
-		fmt.Println(*result.Functions[i].FunctionName)
+		function := result.Functions[i]
+		item := LambdaFunctionItem{
+			Name:         aws.StringValue(function.FunctionName),
+			Runtime:      aws.StringValue(function.Runtime),
+			Version:      aws.StringValue(function.Version),
+			LastModified: aws.StringValue(function.LastModified),
+		}
+
+		items = append(items, item)
+		rows = append(rows, []string{item.Name, item.Runtime, item.Version, item.LastModified})
 	}
-}
 
-func deployLambdaFunction(functionName, bucket, filename, alias, version, runtime string, publish bool) {
-	sess, cfg := getSessionAndConfig()
-	svc := lambda.New(sess, cfg)
+	return printFormatted(items, []string{"name", "runtime", "version", "last modified"}, rows, func() error {
+		for i := 0; i < len(items); i++ {
+			fmt.Println(items[i].Name)
+		}
 
+		return nil
+	})
+}
+
+func deployLambdaFunction(functionName, bucket, filename, alias, version, runtime string, publish bool, svc lambdaiface.LambdaAPI) error {
 	if runtime != "" {
 		params := &lambda.UpdateFunctionConfigurationInput{
 			FunctionName: aws.String(functionName),
@@ -47,7 +102,9 @@ func deployLambdaFunction(functionName, bucket, filename, alias, version, runtim
 		}
 
 		result, err := svc.UpdateFunctionConfiguration(params)
-		assertError(err)
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf("Updated function %s with configuration %s\n", *result.FunctionName, *result.Runtime)
 	}
@@ -59,7 +116,9 @@ func deployLambdaFunction(functionName, bucket, filename, alias, version, runtim
 	}
 
 	result, err := svc.UpdateFunctionCode(params)
-	assertError(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Updated %s with shasum %s\n", *result.FunctionName, *result.CodeSha256)
 
@@ -73,7 +132,7 @@ func deployLambdaFunction(functionName, bucket, filename, alias, version, runtim
 		published, errP := svc.PublishVersion(params)
 
 		if errP != nil {
-			errState(errP.Error())
+			return errP
 		}
 
 		paramsU := &lambda.UpdateAliasInput{
@@ -85,66 +144,48 @@ func deployLambdaFunction(functionName, bucket, filename, alias, version, runtim
 		_, errU := svc.UpdateAlias(paramsU)
 
 		if errU != nil {
-			errState(errU.Error())
+			return errU
 		}
 
 		fmt.Printf("Alias %s updated to point to version %s (%s)\n", alias, *published.Version, *published.Description)
 	}
-}
 
-func getLambdaFunctionInfo(functionName, qualifier string) *lambda.FunctionConfiguration {
-	sess, cfg := getSessionAndConfig()
-	svc := lambda.New(sess, cfg)
+	return nil
+}
 
+func getLambdaFunctionInfo(functionName, qualifier string, svc lambdaiface.LambdaAPI) (*lambda.FunctionConfiguration, error) {
 	params := &lambda.GetFunctionConfigurationInput{
 		FunctionName: aws.String(functionName),
 		Qualifier:    aws.String(qualifier),
 	}
 
-	resp, err := svc.GetFunctionConfiguration(params)
-	assertError(err)
-
-	return resp
+	return svc.GetFunctionConfiguration(params)
 }
 
-func listLambdaFunctions() *lambda.ListFunctionsOutput {
-	sess, cfg := getSessionAndConfig()
-	svc := lambda.New(sess, cfg)
-
-	var marker = new(string)
-	var result = new(lambda.ListFunctionsOutput)
+func listLambdaFunctions(svc lambdaiface.LambdaAPI) (*lambda.ListFunctionsOutput, error) {
+	result := new(lambda.ListFunctionsOutput)
 
-	for marker != nil && len(result.Functions) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
-
-		params := &lambda.ListFunctionsInput{
-			Marker:   marker,
-			MaxItems: &maxResult,
-		}
-
-		resp, err := svc.ListFunctions(params)
-		assertError(err)
+	params := &lambda.ListFunctionsInput{
+		MaxItems: pageSize(1, 50),
+	}
 
-		result.Functions = append(result.Functions, resp.Functions...)
-		marker = resp.NextMarker
+	err := svc.ListFunctionsPages(params, func(page *lambda.ListFunctionsOutput, lastPage bool) bool {
+		result.Functions = append(result.Functions, page.Functions...)
+		return morePages(len(result.Functions), lastPage)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result
+	result.Functions = result.Functions[:limitItems(len(result.Functions))]
+	return result, nil
 }
 
-func getLambdaFunctionAliasInfo(functionName, alias string) *lambda.AliasConfiguration {
-	sess, cfg := getSessionAndConfig()
-	svc := lambda.New(sess, cfg)
-
+func getLambdaFunctionAliasInfo(functionName, alias string, svc lambdaiface.LambdaAPI) (*lambda.AliasConfiguration, error) {
 	params := &lambda.GetAliasInput{
 		FunctionName: aws.String(functionName),
 		Name:         aws.String(alias),
 	}
 
-	resp, err := svc.GetAlias(params)
-	assertError(err)
-
-	return resp
+	return svc.GetAlias(params)
 }
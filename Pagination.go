@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// The list helpers collect items through the SDK's ...Pages functions, with
+// the page callbacks built from the functions below so that -maxResults is
+// applied the same way everywhere. A -maxResults of 0 or less means no limit.
+
+// pageSize returns the page size to ask for: -maxResults, kept within the
+// page sizes the API accepts.
+func pageSize(apiMin, apiMax int64) *int64 {
+	size := maxResult
+	if size <= 0 || size > apiMax {
+		size = apiMax
+	}
+
+	if size < apiMin {
+		size = apiMin
+	}
+
+	return aws.Int64(size)
+}
+
+// morePages tells the SDK whether to fetch another page, given the number of
+// items collected so far.
+func morePages(collected int, lastPage bool) bool {
+	return !lastPage && !limitReached(collected)
+}
+
+func limitReached(collected int) bool {
+	return maxResult > 0 && collected >= int(maxResult)
+}
+
+// limitItems returns how many of the collected items to keep, as the last page
+// may take the total past -maxResults.
+func limitItems(collected int) int {
+	if limitReached(collected) {
+		return int(maxResult)
+	}
+
+	return collected
+}
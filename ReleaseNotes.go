@@ -57,12 +57,15 @@ type Dependencies struct {
 	Versions   []string `json:"versions"`
 }
 
-func GenerateReleaseNotes(configData []byte, templateFile, version, releaseDate, dependenciesData string) {
+func GenerateReleaseNotes(configData []byte, templateFile, version, releaseDate, dependenciesData string) error {
 	var dependencies []Dependencies
 	var config ConfigContainer
 
-	configInfo, err2 := template.New("hello").Parse(string(configData))
-	assertError(err2)
+	configInfo, err := template.New("hello").Parse(string(configData))
+	if err != nil {
+		return err
+	}
+
 	processedConfig := new(bytes.Buffer)
 
 	type ConfigData struct {
@@ -71,16 +74,26 @@ func GenerateReleaseNotes(configData []byte, templateFile, version, releaseDate,
 		Password string
 	}
 
-	err3 := configInfo.Execute(processedConfig, ConfigData{Version: version, Login: login, Password: password})
-	assertError(err3)
+	err = configInfo.Execute(processedConfig, ConfigData{Version: version, Login: login, Password: password})
+	if err != nil {
+		return err
+	}
 
-	err := json.Unmarshal(processedConfig.Bytes(), &config)
-	assertError(err)
-	issues := getIssuesFromUrl(config)
+	err = json.Unmarshal(processedConfig.Bytes(), &config)
+	if err != nil {
+		return err
+	}
+
+	issues, err := getIssuesFromUrl(config)
+	if err != nil {
+		return err
+	}
 
 	if dependenciesData != "" {
 		err = json.Unmarshal([]byte(dependenciesData), &dependencies)
-		assertError(err)
+		if err != nil {
+			return err
+		}
 	}
 
 	var output = OutputData{
@@ -131,19 +144,21 @@ func GenerateReleaseNotes(configData []byte, templateFile, version, releaseDate,
 
 	output.IssueTypesSortOrder = config.IssueTypesSortOrder
 	reportTemplate, err := template.New("report").Parse(templateFile)
-	assertError(err)
+	if err != nil {
+		return err
+	}
 
 	var out bytes.Buffer
 	err = reportTemplate.Execute(&out, output)
 	fmt.Println(html.UnescapeString(out.String()))
-	assertError(err)
+	return err
 }
 
 func getDefaultSortOrder() []string {
 	return []string{"New Feature", "Task", "Bug", "Epic"}
 }
 
-func getIssuesFromUrl(config ConfigContainer) []Issues {
+func getIssuesFromUrl(config ConfigContainer) ([]Issues, error) {
 	type JsonData struct {
 		Jql        string   `json:"jql"`
 		Fields     []string `json:"fields"`
@@ -157,23 +172,32 @@ func getIssuesFromUrl(config ConfigContainer) []Issues {
 	}
 
 	body, err := json.Marshal(data)
-	assertError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	req, err := http.NewRequest("POST", config.IssuesUrl, bytes.NewBuffer(body))
-	assertError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	req.SetBasicAuth(config.Username, config.Password)
 	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := http.DefaultClient.Do(req)
-	assertError(err)
+	if err != nil {
+		return nil, err
+	}
+
 	defer resp.Body.Close()
 
 	responseBody, err := ioutil.ReadAll(resp.Body)
-	assertError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	var issues IssuesJson
 	err = json.Unmarshal(responseBody, &issues)
 
-	return issues.Issues
+	return issues.Issues, err
 }
@@ -12,6 +12,9 @@ type Installations struct {
 
 type installationItem struct {
 	Label    string        `json:"label"`
+	Profile  string        `json:"profile,omitempty"`
+	Region   string        `json:"region,omitempty"`
+	RoleArn  string        `json:"roleArn,omitempty"`
 	Services []ServiceItem `json:"services"`
 	Lambdas  []string      `json:"lambdas"`
 	Other    []OtherItem   `json:"other"`
@@ -73,11 +76,18 @@ type InfoOutputItem struct {
 	Value string
 }
 
-func GenerateReport(jsonData []byte, templateFile string) {
+func GenerateReport(jsonData []byte, templateFile string) error {
 	var config Installations
 
 	err := json.Unmarshal(jsonData, &config)
-	assertError(err)
+	if err != nil {
+		return err
+	}
+
+	defaultClients, err := getClients()
+	if err != nil {
+		return err
+	}
 
 	output := Output{}
 
@@ -87,15 +97,42 @@ func GenerateReport(jsonData []byte, templateFile string) {
 			Label: installation.Label,
 		}
 
+		// Installations in other accounts specify their own profile, the others use -profile
+		clients := defaultClients
+
+		if installation.Profile != "" {
+			clients, err = newClients(installation.Profile, installation.Region, installation.RoleArn)
+			if err != nil {
+				return err
+			}
+		}
+
+		ecsSvc := clients.Ecs
+		lambdaSvc := clients.Lambda
+
 		for j := 0; j < len(installation.Services); j++ {
 			service := installation.Services[j]
-			clusterArn := GetClusterArn(service.Cluster, nil)
-			serviceArn := GetServiceArn(clusterArn, service.Service, nil)
-			serviceDescription := describeService(clusterArn, serviceArn, nil)
+			clusterArn, err := GetClusterArn(service.Cluster, ecsSvc)
+			if err != nil {
+				return err
+			}
+
+			serviceArn, err := GetServiceArn(clusterArn, service.Service, ecsSvc)
+			if err != nil {
+				return err
+			}
+
+			serviceDescription, err := describeService(clusterArn, serviceArn, ecsSvc)
+			if err != nil {
+				return err
+			}
 
 			for k := 0; k < len(serviceDescription.Services); k++ {
 				realService := serviceDescription.Services[k]
-				taskDefinition := describeTaskDefinition(*realService.TaskDefinition, nil)
+				taskDefinition, err := describeTaskDefinition(*realService.TaskDefinition, ecsSvc)
+				if err != nil {
+					return err
+				}
 
 				for l := 0; l < len(taskDefinition.TaskDefinition.ContainerDefinitions); l++ {
 					version, image := ExtractVersion(*taskDefinition.TaskDefinition.ContainerDefinitions[l].Image)
@@ -121,8 +158,15 @@ func GenerateReport(jsonData []byte, templateFile string) {
 
 		for k := 0; k < len(installation.Lambdas); k++ {
 			lambdaFunction := installation.Lambdas[k]
-			aliasInfo := getLambdaFunctionAliasInfo(lambdaFunction, "PRIMARY")
-			functionInfo := getLambdaFunctionInfo(lambdaFunction, *aliasInfo.FunctionVersion)
+			aliasInfo, err := getLambdaFunctionAliasInfo(lambdaFunction, "PRIMARY", lambdaSvc)
+			if err != nil {
+				return err
+			}
+
+			functionInfo, err := getLambdaFunctionInfo(lambdaFunction, *aliasInfo.FunctionVersion, lambdaSvc)
+			if err != nil {
+				return err
+			}
 
 			outputItem := LambdaOutputItem{
 				Description: *functionInfo.Description,
@@ -154,9 +198,9 @@ func GenerateReport(jsonData []byte, templateFile string) {
 	}
 
 	reportTemplate, err := template.New("report").Parse(templateFile)
+	if err != nil {
+		return err
+	}
 
-	assertError(err)
-	err = reportTemplate.Execute(os.Stdout, output)
-
-	assertError(err)
+	return reportTemplate.Execute(os.Stdout, output)
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+)
+
+const testReportTemplate = `{{range .Installations}}# {{.Label}}
+{{range .Services}}{{.Label}} {{.TaskDefName}} {{.Image}} {{.Version}} {{.RunningCount}}/{{.DesiredCount}} {{.Url}}
+{{end}}{{range .Lambdas}}{{.Label}} {{.Version}} {{.Description}}
+{{end}}{{range .Others}}{{.Label}} {{.Url}}
+{{end}}{{range .Info}}{{.Name}}={{.Value}}
+{{end}}{{end}}`
+
+func TestGenerateReport(t *testing.T) {
+	production := newFakeEcs()
+	productionArn := production.addCluster("production")
+	production.addService(productionArn, "editor", production.addTaskDefinition("editor", 7, "registry/editorservice:1.4.2"), 3)
+	production.addService(productionArn, "search", production.addTaskDefinition("search", 2, "registry/searchservice:2.0.1"), 1)
+
+	staging := newFakeEcs()
+	stagingArn := staging.addCluster("staging")
+	staging.addService(stagingArn, "editor", staging.addTaskDefinition("editor", 9, "registry/editorservice:1.5.0"), 1)
+
+	functions := &fakeLambda{
+		versions:     map[string]string{"thumbnails": "12"},
+		descriptions: map[string]string{"thumbnails": "Thumbnails 3.1"},
+	}
+
+	clients := map[string]*Clients{
+		"":        {Ecs: production, Lambda: functions},
+		"staging": {Ecs: staging},
+	}
+
+	tests := []struct {
+		name     string
+		config   string
+		want     string
+		exitCode int
+	}{
+		{
+			name: "installations with their own profile",
+			config: `{"installations": [
+				{"label": "Production",
+				 "services": [
+					{"label": "Editor", "cluster": "production", "service": "editor", "url": "https://editor.example.com"},
+					{"label": "Search", "cluster": "production", "service": "search"}],
+				 "lambdas": ["thumbnails"],
+				 "other": [{"name": "Wiki", "url": "https://wiki.example.com"}],
+				 "info": [{"name": "owner", "value": "writer team"}]},
+				{"label": "Staging", "profile": "staging",
+				 "services": [{"label": "Editor", "cluster": "staging", "service": "editor"}]}]}`,
+			want: "# Production\n" +
+				"Editor editor:7 editorservice 1.4.2 3/3 https://editor.example.com\n" +
+				"Search search:2 searchservice 2.0.1 1/1 \n" +
+				"thumbnails 12 Thumbnails 3.1\n" +
+				"Wiki https://wiki.example.com\n" +
+				"owner=writer team\n" +
+				"# Staging\n" +
+				"Editor editor:9 editorservice 1.5.0 1/1 \n",
+		},
+		{
+			name:     "a service that doesn't exist",
+			config:   `{"installations": [{"label": "Production", "services": [{"cluster": "production", "service": "missing"}]}]}`,
+			exitCode: exitNotFound,
+		},
+		{
+			name:     "a lambda that doesn't exist",
+			config:   `{"installations": [{"label": "Production", "lambdas": ["missing"]}]}`,
+			exitCode: exitNotFound,
+		},
+		{
+			name:     "a profile without credentials",
+			config:   `{"installations": [{"label": "Test", "profile": "test"}]}`,
+			exitCode: exitAuth,
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			withFakeClients(t, clients)
+
+			output, err := captureStdout(t, func() error { return GenerateReport([]byte(test.config), testReportTemplate) })
+			if test.exitCode != 0 {
+				if err == nil || exitCodeFor(err) != test.exitCode {
+					t.Errorf("error = %v, want exit code %d", err, test.exitCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", output, test.want)
+			}
+		})
+	}
+}
@@ -4,28 +4,61 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"io"
 	"os"
 	"path"
 	"strconv"
+	"time"
 )
 
-func ListS3Buckets() {
-	buckets := listS3Buckets()
+func ListS3Buckets() error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	buckets, err := listS3Buckets(clients.S3)
+	if err != nil {
+		return err
+	}
+
+	items := []S3BucketItem{}
+	var rows [][]string
 
 	for i := 0; i < len(buckets.Buckets); i++ {
 		bucket := buckets.Buckets[i]
+		item := S3BucketItem{Name: *bucket.Name, CreationDate: bucket.CreationDate.Format(time.RFC3339)}
 
-		if verboseLevel > 0 {
-			fmt.Printf("%s   %s\n", bucket.CreationDate.Format("2006-01-02 15:04:05 -0700 MST"), *bucket.Name)
-		} else {
-			fmt.Println(*bucket.Name)
-		}
+		items = append(items, item)
+		rows = append(rows, []string{item.Name, item.CreationDate})
 	}
+
+	return printFormatted(items, []string{"name", "creation date"}, rows, func() error {
+		for i := 0; i < len(buckets.Buckets); i++ {
+			bucket := buckets.Buckets[i]
+
+			if verboseLevel > 0 {
+				fmt.Printf("%s   %s\n", bucket.CreationDate.Format("2006-01-02 15:04:05 -0700 MST"), *bucket.Name)
+			} else {
+				fmt.Println(*bucket.Name)
+			}
+		}
+
+		return nil
+	})
 }
 
-func ListFilesInS3Bucket(bucketName, prefix string) {
-	files := listFilesInS3Bucket(bucketName, prefix)
+func ListFilesInS3Bucket(bucketName, prefix string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	files, err := listFilesInS3Bucket(bucketName, prefix, clients.S3)
+	if err != nil {
+		return err
+	}
 
 	for i := 0; i < len(files.Contents); i++ {
 		file := files.Contents[i]
@@ -40,90 +73,93 @@ func ListFilesInS3Bucket(bucketName, prefix string) {
 			fmt.Println(*file.Key)
 		}
 	}
+
+	return nil
 }
 
-func CopyFileFromS3Bucket(bucketName, filename, output string) {
-	mode := GetFileMode(output)
+func CopyFileFromS3Bucket(bucketName, filename, output string) error {
+	mode, err := GetFileMode(output)
+	if err != nil {
+		return err
+	}
 
 	if !mode.IsDir() {
-		errUsage("Output '" + output + "' must be directory")
+		return usageError("Output '" + output + "' must be directory")
+	}
+
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	result, err := copyFileFromS3Bucket(bucketName, filename, clients.S3)
+	if err != nil {
+		return err
 	}
 
-	result := copyFileFromS3Bucket(bucketName, filename)
+	//noinspection GoUnhandledErrorResult
+	defer result.Body.Close()
+
 	outFile := path.Join(output, filename)
 
 	out, err := os.Create(outFile)
-	assertError(err)
+	if err != nil {
+		return err
+	}
 
 	//noinspection GoUnhandledErrorResult
-	defer result.Body.Close()
+	defer out.Close()
+
 	fmt.Printf("Copying %s/%s to %s... ", bucketName, filename, output)
 
 	written, err := io.Copy(out, result.Body)
-	assertError(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Done writing " + strconv.FormatInt(written, 10) + " bytes")
+	return nil
 }
 
-func listFilesInS3Bucket(bucketName, prefix string) *s3.ListObjectsOutput {
-	sess, cfg := getSessionAndConfig()
-	svc := s3.New(sess, cfg)
-
-	var marker = new(string)
-	var result = new(s3.ListObjectsOutput)
-
-	for marker != nil && len(result.Contents) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
+func listFilesInS3Bucket(bucketName, prefix string, svc s3iface.S3API) (*s3.ListObjectsOutput, error) {
+	result := new(s3.ListObjectsOutput)
 
-		params := &s3.ListObjectsInput{
-			Bucket:  aws.String(bucketName),
-			MaxKeys: &maxResult,
-			Marker:  marker,
-		}
-
-		if prefix != "" {
-			params.Prefix = aws.String(prefix)
-		}
+	params := &s3.ListObjectsInput{
+		Bucket:  aws.String(bucketName),
+		MaxKeys: pageSize(1, 1000),
+	}
 
-		resp, err := svc.ListObjects(params)
-		assertError(err)
+	if prefix != "" {
+		params.Prefix = aws.String(prefix)
+	}
 
-		result.Contents = append(resp.Contents)
+	err := svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+		result.Contents = append(result.Contents, page.Contents...)
 		if verbose {
 			fmt.Println("Fetched", len(result.Contents), "items.")
 		}
 
-		marker = resp.NextMarker
+		return morePages(len(result.Contents), lastPage)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result
+	result.Contents = result.Contents[:limitItems(len(result.Contents))]
+	return result, nil
 }
 
-func listS3Buckets() *s3.ListBucketsOutput {
-	sess, cfg := getSessionAndConfig()
-
-	svc := s3.New(sess, cfg)
+func listS3Buckets(svc s3iface.S3API) (*s3.ListBucketsOutput, error) {
 	params := &s3.ListBucketsInput{}
 
-	resp, err := svc.ListBuckets(params)
-	assertError(err)
-
-	return resp
+	return svc.ListBuckets(params)
 }
 
-func copyFileFromS3Bucket(bucket, filename string) *s3.GetObjectOutput {
-	sess, cfg := getSessionAndConfig()
-	svc := s3.New(sess, cfg)
-
+func copyFileFromS3Bucket(bucket, filename string, svc s3iface.S3API) (*s3.GetObjectOutput, error) {
 	params := &s3.GetObjectInput{
 		Key:    aws.String(filename),
 		Bucket: aws.String(bucket),
 	}
 
-	resp, err := svc.GetObject(params)
-	assertError(err)
-
-	return resp
+	return svc.GetObject(params)
 }
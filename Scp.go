@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ScpInstances copies the remote paths from all instances, see Scp. Several
+// instances are copied from in parallel like with SshInstances.
+func ScpInstances(instances []*ec2.Instance, pemFile string, paths []string) error {
+	if len(paths) == 0 {
+		return usageError("At least one remote path to copy must be given")
+	}
+
+	return transferInstances(instances, pemFile, func(instance *ec2.Instance, progress io.Writer, cancel <-chan struct{}) error {
+		return Scp(instance, pemFile, paths, progress, cancel)
+	})
+}
+
+// ScpToInstances copies the local paths, which may be patterns, to the directory
+// given by -target on all instances, see ScpTo.
+func ScpToInstances(instances []*ec2.Instance, pemFile string, paths []string) error {
+	if target == "" {
+		return usageError("The remote directory to copy to must be given with -target")
+	}
+
+	files, err := expandLocalPaths(paths)
+	if err != nil {
+		return err
+	}
+
+	return transferInstances(instances, pemFile, func(instance *ec2.Instance, progress io.Writer, cancel <-chan struct{}) error {
+		return ScpTo(instance, pemFile, files, target, progress, cancel)
+	})
+}
+
+// transferInstances runs the transfer on all instances. A single instance
+// reports its progress as is, while several are run with runOnTargets.
+func transferInstances(instances []*ec2.Instance, pemFile string,
+	transfer func(instance *ec2.Instance, progress io.Writer, cancel <-chan struct{}) error) error {
+
+	// Ask for a passphrase before starting, rather than from several instances at once
+	if transport == transportSsh {
+		if _, err := sshClientConfig(pemFile); err != nil {
+			return err
+		}
+	}
+
+	if len(instances) == 1 {
+		return transfer(instances[0], os.Stdout, nil)
+	}
+
+	var targets []remoteTarget
+	for i := 0; i < len(instances); i++ {
+		instance := instances[i]
+
+		targets = append(targets, remoteTarget{
+			id:   *instance.InstanceId,
+			name: getName(instance.Tags),
+			run: func(stdout, stderr io.Writer, cancel <-chan struct{}) error {
+				return transfer(instance, stdout, cancel)
+			},
+		})
+	}
+
+	return runOnTargets(targets, "instance")
+}
+
+// expandLocalPaths expands the patterns among the local paths, and checks that
+// the paths exist and are files, or directories with -recursive.
+func expandLocalPaths(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, usageError("At least one local path to copy must be given")
+	}
+
+	var result []string
+
+	for i := 0; i < len(paths); i++ {
+		matches, err := filepath.Glob(paths[i])
+		if err != nil {
+			return nil, usageError("Invalid pattern " + paths[i] + ": " + err.Error())
+		}
+
+		if len(matches) == 0 {
+			return nil, notFoundError(paths[i] + ": No such file or directory")
+		}
+
+		for j := 0; j < len(matches); j++ {
+			info, err := os.Stat(matches[j])
+			if err != nil {
+				return nil, err
+			}
+
+			if info.IsDir() && !recursive {
+				return nil, usageError(matches[j] + " is a directory, use -recursive to copy directories")
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil, usageError(matches[j] + ": not a regular file")
+			}
+
+			result = append(result, matches[j])
+		}
+	}
+
+	return result, nil
+}
+
+// ScpTo copies the local files, and directories with -recursive, to the
+// remote directory on the instance, keeping modes and modification times.
+// Each file copied is reported to progress.
+func ScpTo(instance *ec2.Instance, pemFile string, files []string, remoteDir string, progress io.Writer, cancel <-chan struct{}) error {
+	if transport == transportSsm {
+		clients, err := getClients()
+		if err != nil {
+			return err
+		}
+
+		return ssmScpTo(clients.Ssm, instance, files, remoteDir, progress, cancel)
+	}
+
+	// The remote scp is run in sink mode, receiving the files into a directory
+	remoteCommand := "scp -t -p -d "
+	if recursive {
+		remoteCommand += "-r "
+	}
+
+	return runScp(instance, pemFile, remoteCommand+remoteDir, cancel,
+		func(in *bufio.Reader, out io.Writer) error {
+			return sendFiles(in, out, files, progress)
+		})
+}
+
+// sendFiles is the source side of the scp protocol, sending the files to the
+// remote scp. Each message sent must be acknowledged by the remote.
+func sendFiles(in *bufio.Reader, out io.Writer, files []string, progress io.Writer) error {
+	err := readScpAck(in)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(files); i++ {
+		err = sendEntry(in, out, files[i], filepath.Base(files[i]), progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendEntry sends the file, or the directory and everything below it, under
+// the name. The name reported to progress is the local path.
+func sendEntry(in *bufio.Reader, out io.Writer, path, name string, progress io.Writer) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	err = sendScpMessage(in, out, fmt.Sprintf("T%d 0 %d 0\n", info.ModTime().Unix(), info.ModTime().Unix()))
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return sendFile(in, out, path, name, info, progress)
+	}
+
+	err = sendScpMessage(in, out, fmt.Sprintf("D%04o 0 %s\n", info.Mode()&os.ModePerm, name))
+	if err != nil {
+		return err
+	}
+
+	entries, err := readDirNames(path)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(entries); i++ {
+		err = sendEntry(in, out, filepath.Join(path, entries[i]), entries[i], progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sendScpMessage(in, out, "E\n")
+}
+
+func sendFile(in *bufio.Reader, out io.Writer, path, name string, info os.FileInfo, progress io.Writer) error {
+	err := sendScpMessage(in, out, fmt.Sprintf("C%04o %d %s\n", info.Mode()&os.ModePerm, info.Size(), name))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	_, err = io.CopyN(out, file, info.Size())
+	if err != nil {
+		return stateError("scp: " + path + ": " + err.Error())
+	}
+
+	// The file content is followed by a status byte
+	err = scpAck(out)
+	if err != nil {
+		return err
+	}
+
+	err = readScpAck(in)
+	if err != nil {
+		return err
+	}
+
+	printTransferred(progress, path, info.Size())
+
+	return nil
+}
+
+func sendScpMessage(in *bufio.Reader, out io.Writer, message string) error {
+	_, err := io.WriteString(out, message)
+	if err != nil {
+		return stateError("scp: " + err.Error())
+	}
+
+	return readScpAck(in)
+}
+
+// readScpAck reads the response of the remote to a message, which is a zero
+// byte, or a warning or error followed by a message.
+func readScpAck(in *bufio.Reader) error {
+	status, err := in.ReadByte()
+	if err != nil {
+		return stateError("scp: " + err.Error())
+	}
+
+	if status == 0 {
+		return nil
+	}
+
+	message, _ := in.ReadString('\n')
+	return stateError(strings.TrimSpace(message))
+}
+
+func readDirNames(path string) ([]string, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func printTransferred(progress io.Writer, path string, size int64) {
+	//noinspection GoUnhandledErrorResult
+	fmt.Fprintf(progress, "%s (%s)\n", path, formatSize(size))
+}
+
+// formatSize formats a number of bytes like 512 B, 16 kB or 1.5 MB.
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / 1024
+	units := []string{"kB", "MB", "GB", "TB"}
+
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if value < 10 {
+		return fmt.Sprintf("%.1f %s", value, units[unit])
+	}
+
+	return fmt.Sprintf("%.0f %s", value, units[unit])
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -47,36 +50,101 @@ func ExtractVersion(a string) (string, string) {
 	return res[0][2], res[0][1]
 }
 
-func ListServices(clusterArn string) {
-	resp := listServices(clusterArn, nil)
+// ExtractRevision returns the family and revision of a task definition ARN
+// such as "arn:aws:ecs:eu-west-1:123456789012:task-definition/writer:12".
+func ExtractRevision(taskDefinitionArn string) (string, int64) {
+	re := regexp.MustCompile("task-definition/(.+):(\\d+)$")
+	res := re.FindStringSubmatch(taskDefinitionArn)
+
+	if res == nil {
+		return "", -1
+	}
+
+	revision, err := strconv.ParseInt(res[2], 10, 64)
+	if err != nil {
+		return "", -1
+	}
+
+	return res[1], revision
+}
+
+func ListServices(clusterArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := listServices(clusterArn, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	items := []ServiceListItem{}
+	var rows [][]string
 
 	for i := 0; i < len(resp.ServiceArns); i++ {
-		name := ExtractName(resp.ServiceArns[i])
-		fmt.Println(name)
+		item := ServiceListItem{Name: ExtractName(resp.ServiceArns[i]), Arn: *resp.ServiceArns[i]}
+		items = append(items, item)
+		rows = append(rows, []string{item.Name, item.Arn})
 	}
+
+	return printFormatted(items, []string{"name", "arn"}, rows, func() error {
+		for i := 0; i < len(items); i++ {
+			fmt.Println(items[i].Name)
+		}
+
+		return nil
+	})
 }
 
-func ListTasks(clusterArn, serviceArn string) {
-	resp, err := listTasks(clusterArn, serviceArn, nil)
+func ListTasks(clusterArn, serviceArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
 
+	resp, err := listTasks(clusterArn, serviceArn, clients.Ecs)
 	if err != nil {
-		errState(err.Error())
+		return err
 	}
 
+	items := []TaskItem{}
+	var rows [][]string
+
 	for i := 0; i < len(resp.TaskArns); i++ {
-		name := ExtractName(resp.TaskArns[i])
-		fmt.Println(name)
+		item := TaskItem{Id: ExtractName(resp.TaskArns[i]), Arn: *resp.TaskArns[i]}
+		items = append(items, item)
+		rows = append(rows, []string{item.Id, item.Arn})
 	}
+
+	return printFormatted(items, []string{"id", "arn"}, rows, func() error {
+		for i := 0; i < len(items); i++ {
+			fmt.Println(items[i].Id)
+		}
+
+		return nil
+	})
 }
 
+// Max number of container instances that can be described in one call
+const describeContainerInstancesLimit = 100
+
 type ByName []*ecs.Attribute
 
 func (a ByName) Len() int           { return len(a) }
 func (a ByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByName) Less(i, j int) bool { return *a[i].Name < *a[j].Name }
 
-func DescribeContainerInstances(clusterArn string) {
-	resp := describeContainerInstances(clusterArn, nil)
+func DescribeContainerInstances(clusterArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	resp, err := describeContainerInstances(clusterArn, clients.Ecs)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Number of container instances for cluster: %d\n", len(resp.ContainerInstances))
 
@@ -84,35 +152,66 @@ func DescribeContainerInstances(clusterArn string) {
 		instance := resp.ContainerInstances[i]
 		fmt.Printf("\nEC2 Instance ID: %s\n", *instance.Ec2InstanceId)
 
+		if verboseLevel > 0 {
+			item := newContainerInstanceCapacityItem(instance)
+			fmt.Printf("   Status: %s, agent %s, connected: %t\n", item.Status, item.AgentVersion, item.AgentConnected)
+			fmt.Printf("   CPU: %d of %d free, memory: %d of %d MiB free\n", item.RemainingCpu, item.RegisteredCpu,
+				item.RemainingMemory, item.RegisteredMemory)
+			fmt.Printf("   Tasks: %d running, %d pending\n", item.RunningTasks, item.PendingTasks)
+		}
+
 		sort.Sort(ByName(instance.Attributes))
 
 		for j := 0; j < len(instance.Attributes); j++ {
 			attribute := instance.Attributes[j]
+			fmt.Printf("   %s\n", *attribute.Name)
 			if attribute.Value != nil {
-				if verboseLevel < 1 {
-					fmt.Printf("   %s\n", *attribute.Name)
-					fmt.Printf("      %s\n", *attribute.Value)
-				}
-			} else {
-				fmt.Printf("   %s\n", *attribute.Name)
+				fmt.Printf("      %s\n", *attribute.Value)
 			}
 		}
 	}
+
+	return nil
 }
 
-func UpdateService(clusterArn, serviceArn string) {
-	message, err := updateService(clusterArn, serviceArn, nil, nil)
-	assertError(err)
+func UpdateService(clusterArn, serviceArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	message, err := updateService(clusterArn, serviceArn, "", nil, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
 	fmt.Println(message)
+	return nil
 }
 
 type Update struct {
-	Cluster       string `json:"cluster"`
-	Service       string `json:"service"`
-	Profile       string `json:"profile"`
-	Label         string `json:"label"`
-	ContainerName string `json:"containerName"`
-	Region        string `json:"region"`
+	Cluster           string `json:"cluster"`
+	Service           string `json:"service"`
+	Profile           string `json:"profile"`
+	Label             string `json:"label"`
+	ContainerName     string `json:"containerName"`
+	Region            string `json:"region"`
+	RoleArn           string `json:"roleArn"`
+	Wave              int    `json:"wave"`
+	HealthCheckUrl    string `json:"healthCheckUrl"`
+	HealthCheckStatus int    `json:"healthCheckStatus"`
+	HealthCheckBody   string `json:"healthCheckBody"`
+	HealthCheckCount  *int   `json:"healthCheckCount"`
+}
+
+// getRoleArn returns the role to assume for the update, which defaults to the one
+// given with -roleArn.
+func (u Update) getRoleArn() string {
+	if u.RoleArn != "" {
+		return u.RoleArn
+	}
+
+	return roleArn
 }
 
 type Report struct {
@@ -120,11 +219,13 @@ type Report struct {
 	Success bool
 }
 
-func UpdateServices(data []byte) {
+func UpdateServices(data []byte) error {
 	var updateConfig []Update
 
 	err := json.Unmarshal(data, &updateConfig)
-	assertError(err)
+	if err != nil {
+		return usageError("Invalid updates file: " + err.Error())
+	}
 
 	messages := make(chan Report, len(updateConfig))
 	fmt.Printf("Performing update on %d services.\n", len(updateConfig))
@@ -135,20 +236,20 @@ func UpdateServices(data []byte) {
 		if config.Profile == "" {
 			messages <- Report{Message: config.Label + ": No Profile specified for cluster: " + config.Cluster + ", service: " + config.Service, Success: false}
 		} else {
-			sess, cfg := getSessionAndConfigForParams(config.Profile, config.Region)
-			svc := ecs.New(sess, cfg)
-
-			clusterArn := GetClusterArn(config.Cluster, svc)
-			serviceArn := GetServiceArn(clusterArn, config.Service, svc)
+			svc, clusterArn, serviceArn, err := resolveUpdate(config)
+			if err != nil {
+				messages <- Report{Message: config.Label + ": " + err.Error(), Success: false}
+				continue
+			}
 
 			fmt.Println(config.Label + ": Updating service " + config.Service)
 			//noinspection GoUnhandledErrorResult
-			go updateService(clusterArn, serviceArn, messages, svc)
+			go updateService(clusterArn, serviceArn, config.Label, messages, svc)
 		}
 	}
 
 	result := len(updateConfig)
-	success := true
+	failed := 0
 
 	for {
 		message, more := <-messages
@@ -156,7 +257,7 @@ func UpdateServices(data []byte) {
 			result--
 			fmt.Printf("%s, %d to go\n", message.Message, result)
 			if !message.Success {
-				success = false
+				failed++
 			}
 		}
 
@@ -165,49 +266,160 @@ func UpdateServices(data []byte) {
 		}
 	}
 
-	if !success {
-		errState("Update failed for one or more services")
+	if failed > 0 {
+		return batchError("Update", failed, len(updateConfig))
 	}
+
+	return nil
 }
 
-func DescribeService(clusterArn, serviceArn string) {
-	service := describeService(clusterArn, serviceArn, nil)
+// resolveUpdate creates an ECS client for the profile, region and role of the
+// update, and looks up the ARNs of its cluster and service.
+func resolveUpdate(config Update) (ecsiface.ECSAPI, string, string, error) {
+	clients, err := newClients(config.Profile, config.Region, config.getRoleArn())
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	svc := clients.Ecs
+
+	clusterArn, err := GetClusterArn(config.Cluster, svc)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	serviceArn, err := GetServiceArn(clusterArn, config.Service, svc)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return svc, clusterArn, serviceArn, nil
+}
+
+// batchError returns the error for a batch of services of which some failed,
+// which is a partial failure unless all of them failed.
+func batchError(operation string, failed, total int) error {
+	message := fmt.Sprintf("%s failed for %d of %d services", operation, failed, total)
+	if failed < total {
+		return partialError(message)
+	}
+
+	return stateError(message)
+}
+
+func DescribeService(clusterArn, serviceArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	service, err := describeService(clusterArn, serviceArn, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	items := []ServiceDescriptionItem{}
+	var rows [][]string
 
 	for n := 0; n < len(service.Services); n++ {
 		item := service.Services[n]
 
-		if verboseLevel == 0 {
-			fmt.Printf("Service name [%s], Running: %d, Pending: %d, Desired: %d\n", *item.ServiceName, *item.RunningCount, *item.PendingCount, *item.DesiredCount)
+		description := ServiceDescriptionItem{
+			Name:           *item.ServiceName,
+			Status:         *item.Status,
+			TaskDefinition: ExtractName(item.TaskDefinition),
+			RunningCount:   *item.RunningCount,
+			PendingCount:   *item.PendingCount,
+			DesiredCount:   *item.DesiredCount,
 		}
 
-		if verboseLevel == 1 {
-			fmt.Printf("Service name [%s], Running: %d, Pending: %d, Desired: %d\n", *item.ServiceName, *item.RunningCount, *item.PendingCount, *item.DesiredCount)
+		for i := 0; i < len(item.Deployments); i++ {
+			deployment := item.Deployments[i]
+			description.Deployments = append(description.Deployments, DeploymentItem{
+				TaskDefinition: ExtractName(deployment.TaskDefinition),
+				Status:         *deployment.Status,
+				RunningCount:   *deployment.RunningCount,
+				PendingCount:   *deployment.PendingCount,
+				DesiredCount:   *deployment.DesiredCount,
+			})
+
+			rows = append(rows, []string{
+				description.Name,
+				ExtractName(deployment.TaskDefinition),
+				*deployment.Status,
+				strconv.FormatInt(*deployment.RunningCount, 10),
+				strconv.FormatInt(*deployment.PendingCount, 10),
+				strconv.FormatInt(*deployment.DesiredCount, 10),
+			})
+		}
 
-			for i := 0; i < len(item.Deployments); i++ {
-				deployment := item.Deployments[i]
-				fmt.Printf("   %s (%s), running: %d, Pending: %d: Desired: %d\n", ExtractName(deployment.TaskDefinition), *deployment.Status, *deployment.RunningCount, *deployment.PendingCount, *deployment.DesiredCount)
+		items = append(items, description)
+	}
+
+	return printFormatted(items, []string{"service", "task definition", "status", "running", "pending", "desired"}, rows, func() error {
+		for n := 0; n < len(service.Services); n++ {
+			item := service.Services[n]
+
+			if verboseLevel == 0 {
+				fmt.Printf("Service name [%s], Running: %d, Pending: %d, Desired: %d\n", *item.ServiceName, *item.RunningCount, *item.PendingCount, *item.DesiredCount)
 			}
-		}
 
-		if verboseLevel == 2 {
-			definition := describeTaskDefinition(*item.TaskDefinition, nil)
+			if verboseLevel == 1 {
+				fmt.Printf("Service name [%s], Running: %d, Pending: %d, Desired: %d\n", *item.ServiceName, *item.RunningCount, *item.PendingCount, *item.DesiredCount)
 
-			jsonBytes, err := json.MarshalIndent(definition, "", " ")
-			assertError(err)
+				for i := 0; i < len(item.Deployments); i++ {
+					deployment := item.Deployments[i]
+					fmt.Printf("   %s (%s), running: %d, Pending: %d: Desired: %d\n", ExtractName(deployment.TaskDefinition), *deployment.Status, *deployment.RunningCount, *deployment.PendingCount, *deployment.DesiredCount)
+				}
+			}
+
+			if verboseLevel == 2 {
+				definition, err := describeTaskDefinition(*item.TaskDefinition, clients.Ecs)
+				if err != nil {
+					return err
+				}
 
-			fmt.Println(string(jsonBytes))
+				jsonBytes, err := json.MarshalIndent(definition, "", " ")
+				if err != nil {
+					return err
+				}
+
+				fmt.Println(string(jsonBytes))
+			}
 		}
+
+		return nil
+	})
+}
+
+func ReleaseService(clusterArn, serviceArn, version string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
 	}
+
+	message, err := releaseService(clusterArn, serviceArn, "", containerName, version, getHealthCheck(healthCheckUrl), nil, clients.Ecs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(message)
+	return nil
 }
 
-func ReleaseService(clusterArn, serviceArn, version string) {
-	message, err := releaseService(clusterArn, serviceArn, containerName, version, nil, nil)
+func RollbackService(clusterArn, serviceArn string) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
 
+	message, err := rollbackService(clusterArn, serviceArn, "", containerName, nil, clients.Ecs)
 	if err != nil {
-		errState(err.Error())
+		return err
 	}
 
 	fmt.Println(message)
+	return nil
 }
 
 func getContainerIndexForName(definitions []*ecs.ContainerDefinition, name string) int {
@@ -221,40 +433,137 @@ func getContainerIndexForName(definitions []*ecs.ContainerDefinition, name strin
 	return -1
 }
 
-func ReleaseServices(version string, data []byte) {
+// getContainerIndex returns the index of the container to release in a task
+// definition. The container name is only required when there are several
+// container definitions to choose from.
+func getContainerIndex(definitions []*ecs.ContainerDefinition, containerName string) (int, error) {
+	if len(definitions) <= 1 {
+		return 0, nil
+	}
+
+	if containerName == "" {
+		return -1, usageError("Please specify containerName for service with multiple container definitions")
+	}
+
+	containerIndex := getContainerIndexForName(definitions, containerName)
+	if containerIndex == -1 {
+		return -1, notFoundError("No container named " + containerName + " found in task definition")
+	}
+
+	return containerIndex, nil
+}
+
+func ReleaseServices(version string, data []byte) error {
 	var updateConfig []Update
 
 	err := json.Unmarshal(data, &updateConfig)
-	assertError(err)
+	if err != nil {
+		return usageError("Invalid updates file: " + err.Error())
+	}
 
-	messages := make(chan Report, len(updateConfig))
+	for i := 0; i < len(updateConfig); i++ {
+		if updateConfig[i].HealthCheckCount != nil && *updateConfig[i].HealthCheckCount < 1 {
+			return usageError("Invalid updates file: healthCheckCount of " + updateConfig[i].Service + " must be at least 1")
+		}
+	}
+
+	waves := groupByWave(updateConfig)
 	fmt.Printf("Performing release to %s on %d services\n", version, len(updateConfig))
 
+	if dryRun {
+		fmt.Println("Dry run, no task definitions will be registered and no services will be updated")
+	}
+
+	released := 0
+
+	for i := 0; i < len(waves); i++ {
+		if len(waves) > 1 {
+			fmt.Printf("Releasing wave %d of %d (wave %d) with %d services\n", i+1, len(waves), waves[i][0].Wave, len(waves[i]))
+		}
+
+		failed := releaseWave(version, waves[i])
+		if failed > 0 {
+			if i < len(waves)-1 {
+				fmt.Printf("Wave %d failed, skipping remaining %d waves\n", waves[i][0].Wave, len(waves)-i-1)
+			}
+
+			return batchError("Release", len(updateConfig)-released-len(waves[i])+failed, len(updateConfig))
+		}
+
+		released += len(waves[i])
+	}
+
+	return nil
+}
+
+// groupByWave splits the updates into waves, ordered by their wave number.
+// Updates without a wave belong to wave 0, which is released first.
+func groupByWave(updateConfig []Update) [][]Update {
+	byWave := make(map[int][]Update)
+	var numbers []int
+
+	for i := 0; i < len(updateConfig); i++ {
+		wave := updateConfig[i].Wave
+		if _, exists := byWave[wave]; !exists {
+			numbers = append(numbers, wave)
+		}
+
+		byWave[wave] = append(byWave[wave], updateConfig[i])
+	}
+
+	sort.Ints(numbers)
+
+	var waves [][]Update
+	for i := 0; i < len(numbers); i++ {
+		waves = append(waves, byWave[numbers[i]])
+	}
+
+	return waves
+}
+
+// releaseWave releases all services in a wave in parallel and waits for them to
+// finish, including their health checks. Returns the number of failed releases.
+func releaseWave(version string, updateConfig []Update) int {
+	messages := make(chan Report, len(updateConfig))
+
 	for i := 0; i < len(updateConfig); i++ {
 		config := updateConfig[i]
 
 		if config.Profile == "" {
 			messages <- Report{Message: config.Label + ": No Profile specified for cluster: " + config.Cluster + ", service: " + config.Service, Success: false}
 		} else {
-			sess, cfg := getSessionAndConfigForParams(config.Profile, config.Region)
-			svc := ecs.New(sess, cfg)
-
-			clusterArn := GetClusterArn(config.Cluster, svc)
-			serviceArn := GetServiceArn(clusterArn, config.Service, svc)
+			svc, clusterArn, serviceArn, err := resolveUpdate(config)
+			if err != nil {
+				messages <- Report{Message: config.Label + ": " + err.Error(), Success: false}
+				continue
+			}
 
 			localContainerName := containerName
 			if config.ContainerName != "" {
 				localContainerName = config.ContainerName
 			}
 
+			healthCheck := getHealthCheck(config.HealthCheckUrl)
+			if healthCheck != nil {
+				if config.HealthCheckStatus != 0 {
+					healthCheck.ExpectedStatus = config.HealthCheckStatus
+				}
+				if config.HealthCheckBody != "" {
+					healthCheck.ExpectedBody = config.HealthCheckBody
+				}
+				if config.HealthCheckCount != nil {
+					healthCheck.Count = *config.HealthCheckCount
+				}
+			}
+
 			fmt.Println(config.Label + ": Releasing service " + config.Service + ", containerName: " + localContainerName)
 			//noinspection GoUnhandledErrorResult
-			go releaseService(clusterArn, serviceArn, localContainerName, version, messages, svc)
+			go releaseService(clusterArn, serviceArn, config.Label, localContainerName, version, healthCheck, messages, svc)
 		}
 	}
 
 	result := len(updateConfig)
-	success := true
+	failed := 0
 
 	for {
 		message, more := <-messages
@@ -263,7 +572,7 @@ func ReleaseServices(version string, data []byte) {
 			fmt.Printf("%s, %d to go\n", message.Message, result)
 
 			if !message.Success {
-				success = false
+				failed++
 			}
 		}
 
@@ -272,33 +581,61 @@ func ReleaseServices(version string, data []byte) {
 		}
 	}
 
-	if !success {
-		errState("Release failed for one or more services")
+	return failed
+}
+
+func describeTaskDefinition(taskDefinitionName string, svc ecsiface.ECSAPI) (*ecs.DescribeTaskDefinitionOutput, error) {
+	params := &ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinitionName),
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
 	}
+
+	return svc.DescribeTaskDefinition(params)
 }
 
-func describeTaskDefinition(taskDefinitionName string, svc *ecs.ECS) *ecs.DescribeTaskDefinitionOutput {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
+// previousTaskDefinition returns the ARN of the latest active revision in the
+// same family that is older than the given task definition.
+func previousTaskDefinition(taskDefinitionArn string, svc ecsiface.ECSAPI) (string, error) {
+	family, revision := ExtractRevision(taskDefinitionArn)
+	if family == "" {
+		return "", errors.New("Could not extract family and revision from task definition " + taskDefinitionArn)
 	}
 
-	params := &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: aws.String(taskDefinitionName),
+	params := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Status:       aws.String(ecs.TaskDefinitionStatusActive),
+		Sort:         aws.String(ecs.SortOrderDesc),
 	}
 
-	result, err := svc.DescribeTaskDefinition(params)
-	assertError(err)
+	previous := ""
 
-	return result
-}
+	// Not limited by -maxResults, the search goes on until the previous revision is found
+	err := svc.ListTaskDefinitionsPages(params, func(page *ecs.ListTaskDefinitionsOutput, lastPage bool) bool {
+		for i := 0; i < len(page.TaskDefinitionArns); i++ {
+			arn := *page.TaskDefinitionArns[i]
+			candidateFamily, candidateRevision := ExtractRevision(arn)
+
+			// The family prefix also matches families like "writer-beta" when looking for "writer"
+			if candidateFamily == family && candidateRevision < revision {
+				previous = arn
+				return false
+			}
+		}
+
+		return !lastPage
+	})
+	if err != nil {
+		return "", err
+	}
 
-func _stopTask(cluster, taskArn string, svc *ecs.ECS) error {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
+	if previous == "" {
+		return "", notFoundError("No previous revision found for task definition " + taskDefinitionArn)
 	}
 
+	return previous, nil
+}
+
+func _stopTask(cluster, taskArn string, svc ecsiface.ECSAPI) error {
 	params := &ecs.StopTaskInput{
 		Cluster: aws.String(cluster),
 		Reason:  aws.String("Stopped by WriterTool"),
@@ -313,161 +650,196 @@ func _stopTask(cluster, taskArn string, svc *ecs.ECS) error {
 	return nil
 }
 
-func GetServiceArn(clusterArn, name string, svc *ecs.ECS) string {
-	clusterArns := listServices(clusterArn, svc)
+func GetServiceArn(clusterArn, name string, svc ecsiface.ECSAPI) (string, error) {
+	clusterArns, err := listServices(clusterArn, svc)
+	if err != nil {
+		return "", err
+	}
 
 	for i := 0; i < len(clusterArns.ServiceArns); i++ {
 		arn := clusterArns.ServiceArns[i]
 		if ExtractName(arn) == name {
-			return *arn
+			return *arn, nil
 		}
 	}
 
-	return ""
+	return "", notFoundError("No service named " + name + " in cluster " + ExtractName(&clusterArn))
 }
 
-func listServices(cluster string, svc *ecs.ECS) *ecs.ListServicesOutput {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
-	}
+func listServices(cluster string, svc ecsiface.ECSAPI) (*ecs.ListServicesOutput, error) {
+	result := new(ecs.ListServicesOutput)
 
-	var marker = new(string)
-	var result = new(ecs.ListServicesOutput)
-
-	for marker != nil && len(result.ServiceArns) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
-
-		params := &ecs.ListServicesInput{
-			Cluster:    aws.String(cluster),
-			NextToken:  marker,
-			MaxResults: &maxResult,
-		}
-
-		resp, err := svc.ListServices(params)
-		assertError(err)
+	params := &ecs.ListServicesInput{
+		Cluster:    aws.String(cluster),
+		MaxResults: pageSize(1, 100),
+	}
 
-		result.ServiceArns = append(result.ServiceArns, resp.ServiceArns...)
-		marker = resp.NextToken
+	err := svc.ListServicesPages(params, func(page *ecs.ListServicesOutput, lastPage bool) bool {
+		result.ServiceArns = append(result.ServiceArns, page.ServiceArns...)
+		return morePages(len(result.ServiceArns), lastPage)
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return result
+	result.ServiceArns = result.ServiceArns[:limitItems(len(result.ServiceArns))]
+	return result, nil
 }
 
-func listTasks(cluster, service string, svc *ecs.ECS) (*ecs.ListTasksOutput, error) {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
+// listServiceArns returns the ARNs of all services of the cluster, regardless
+// of -maxResults.
+func listServiceArns(clusterArn string, svc ecsiface.ECSAPI) ([]*string, error) {
+	var arns []*string
+
+	params := &ecs.ListServicesInput{
+		Cluster:    aws.String(clusterArn),
+		MaxResults: aws.Int64(100),
 	}
 
-	var marker = new(string)
-	var result = new(ecs.ListTasksOutput)
+	err := svc.ListServicesPages(params, func(page *ecs.ListServicesOutput, lastPage bool) bool {
+		arns = append(arns, page.ServiceArns...)
+		return !lastPage
+	})
 
-	for marker != nil && len(result.TaskArns) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
-		}
+	return arns, err
+}
 
-		params := &ecs.ListTasksInput{
-			Cluster:     aws.String(cluster),
-			ServiceName: aws.String(service),
-			MaxResults:  &maxResult,
-		}
+func listTasks(cluster, service string, svc ecsiface.ECSAPI) (*ecs.ListTasksOutput, error) {
+	result := new(ecs.ListTasksOutput)
 
-		resp, err := svc.ListTasks(params)
-		if err != nil {
-			return nil, err
-		}
+	params := &ecs.ListTasksInput{
+		Cluster:     aws.String(cluster),
+		ServiceName: aws.String(service),
+		MaxResults:  pageSize(1, 100),
+	}
 
-		result.TaskArns = append(result.TaskArns, resp.TaskArns...)
-		marker = result.NextToken
+	err := svc.ListTasksPages(params, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		result.TaskArns = append(result.TaskArns, page.TaskArns...)
+		return morePages(len(result.TaskArns), lastPage)
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	result.TaskArns = result.TaskArns[:limitItems(len(result.TaskArns))]
 	return result, nil
 }
 
-func describeService(clusterArn, serviceArn string, svc *ecs.ECS) *ecs.DescribeServicesOutput {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
-	}
-
+func describeService(clusterArn, serviceArn string, svc ecsiface.ECSAPI) (*ecs.DescribeServicesOutput, error) {
 	params := &ecs.DescribeServicesInput{
 		Cluster:  aws.String(clusterArn),
 		Services: []*string{aws.String(serviceArn)},
 	}
 
 	result, err := svc.DescribeServices(params)
-	assertError(err)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Services) == 0 {
+		return nil, notFoundError("Service " + ExtractName(&serviceArn) + " not found in cluster " + ExtractName(&clusterArn))
+	}
 
-	return result
+	return result, nil
 }
 
-func describeContainerInstances(clusterArn string, svc *ecs.ECS) *ecs.DescribeContainerInstancesOutput {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
+// describeContainerInstances describes up to -maxResults container instances of
+// the cluster.
+func describeContainerInstances(clusterArn string, svc ecsiface.ECSAPI) (*ecs.DescribeContainerInstancesOutput, error) {
+	var containerInstanceArns []*string
+
+	listParams := &ecs.ListContainerInstancesInput{
+		Cluster:    aws.String(clusterArn),
+		MaxResults: pageSize(1, 100),
 	}
 
-	var marker = new(string)
-	var containerInstanceResult = new(ecs.ListContainerInstancesOutput)
+	err := svc.ListContainerInstancesPages(listParams, func(page *ecs.ListContainerInstancesOutput, lastPage bool) bool {
+		containerInstanceArns = append(containerInstanceArns, page.ContainerInstanceArns...)
+		return morePages(len(containerInstanceArns), lastPage)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for marker != nil && len(containerInstanceResult.ContainerInstanceArns) < int(maxResult) {
-		if marker != nil && *marker == "" {
-			marker = nil
+	containerInstanceArns = containerInstanceArns[:limitItems(len(containerInstanceArns))]
+
+	return describeContainerInstanceArns(clusterArn, containerInstanceArns, svc)
+}
+
+// describeContainerInstanceArns describes the container instances, in chunks of
+// the 100 the API accepts per call.
+func describeContainerInstanceArns(clusterArn string, containerInstanceArns []*string, svc ecsiface.ECSAPI) (*ecs.DescribeContainerInstancesOutput, error) {
+	result := new(ecs.DescribeContainerInstancesOutput)
+
+	for start := 0; start < len(containerInstanceArns); start += describeContainerInstancesLimit {
+		end := start + describeContainerInstancesLimit
+		if end > len(containerInstanceArns) {
+			end = len(containerInstanceArns)
 		}
 
-		params := &ecs.ListContainerInstancesInput{
-			Cluster:    aws.String(clusterArn),
-			NextToken:  marker,
-			MaxResults: &maxResult,
+		params := &ecs.DescribeContainerInstancesInput{
+			Cluster:            aws.String(clusterArn),
+			ContainerInstances: containerInstanceArns[start:end],
 		}
 
-		resp, err := svc.ListContainerInstances(params)
-		assertError(err)
+		resp, err := svc.DescribeContainerInstances(params)
+		if err != nil {
+			return nil, err
+		}
 
-		containerInstanceResult.ContainerInstanceArns = append(containerInstanceResult.ContainerInstanceArns, resp.ContainerInstanceArns...)
-		marker = resp.NextToken
+		result.ContainerInstances = append(result.ContainerInstances, resp.ContainerInstances...)
+		result.Failures = append(result.Failures, resp.Failures...)
 	}
 
-	params := &ecs.DescribeContainerInstancesInput{
-		Cluster:            aws.String(clusterArn),
-		ContainerInstances: containerInstanceResult.ContainerInstanceArns,
-	}
+	return result, nil
+}
 
-	result, err := svc.DescribeContainerInstances(params)
-	assertError(err)
+func createTaskDefinition(taskDefinition *ecs.DescribeTaskDefinitionOutput, svc ecsiface.ECSAPI) (string, error) {
+	params := registerTaskDefinitionInput(taskDefinition)
+
+	registrationResult, err := svc.RegisterTaskDefinition(params)
+	if err != nil {
+		return "", err
+	}
 
-	return result
+	taskDefinitionArn := registrationResult.TaskDefinition.TaskDefinitionArn
+	return *taskDefinitionArn, nil
 }
 
-func createTaskDefinition(taskDefinition *ecs.DescribeTaskDefinitionOutput, svc *ecs.ECS) string {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
-	}
+// registerTaskDefinitionInput carries over every registrable field of a
+// described task definition, so that a new revision only differs in what the
+// caller has changed.
+func registerTaskDefinitionInput(taskDefinition *ecs.DescribeTaskDefinitionOutput) *ecs.RegisterTaskDefinitionInput {
+	definition := taskDefinition.TaskDefinition
 
 	params := &ecs.RegisterTaskDefinitionInput{
-		ContainerDefinitions: taskDefinition.TaskDefinition.ContainerDefinitions,
-		Family:               taskDefinition.TaskDefinition.Family,
-		Volumes:              taskDefinition.TaskDefinition.Volumes,
+		ContainerDefinitions:    definition.ContainerDefinitions,
+		Cpu:                     definition.Cpu,
+		EphemeralStorage:        definition.EphemeralStorage,
+		ExecutionRoleArn:        definition.ExecutionRoleArn,
+		Family:                  definition.Family,
+		InferenceAccelerators:   definition.InferenceAccelerators,
+		IpcMode:                 definition.IpcMode,
+		Memory:                  definition.Memory,
+		NetworkMode:             definition.NetworkMode,
+		PidMode:                 definition.PidMode,
+		PlacementConstraints:    definition.PlacementConstraints,
+		ProxyConfiguration:      definition.ProxyConfiguration,
+		RequiresCompatibilities: definition.RequiresCompatibilities,
+		RuntimePlatform:         definition.RuntimePlatform,
+		TaskRoleArn:             definition.TaskRoleArn,
+		Volumes:                 definition.Volumes,
 	}
 
-	registrationResult, err := svc.RegisterTaskDefinition(params)
-	assertError(err)
+	// Tags are only returned when asked for, and an empty list is not accepted on registration
+	if len(taskDefinition.Tags) > 0 {
+		params.Tags = taskDefinition.Tags
+	}
 
-	taskDefinitionArn := registrationResult.TaskDefinition.TaskDefinitionArn
-	return *taskDefinitionArn
+	return params
 }
 
-func updateTaskDefinitionForService(newTaskDefinitionArn string, service *ecs.DescribeServicesOutput, svc *ecs.ECS) {
-	if svc == nil {
-		sess, cfg := getSessionAndConfig()
-		svc = ecs.New(sess, cfg)
-	}
-
+func updateTaskDefinitionForService(newTaskDefinitionArn, label string, service *ecs.DescribeServicesOutput, svc ecsiface.ECSAPI) error {
 	clusterArn := service.Services[0].ClusterArn
 	serviceArn := service.Services[0].ServiceArn
 
@@ -479,40 +851,181 @@ func updateTaskDefinitionForService(newTaskDefinitionArn string, service *ecs.De
 	}
 
 	_, err := svc.UpdateService(params)
-	assertError(err)
+	if err != nil {
+		return err
+	}
 
-	//noinspection GoUnhandledErrorResult
-	waitForUpdatedTaskDefinition(*clusterArn, *serviceArn, svc)
+	return waitForUpdatedTaskDefinition(*clusterArn, *serviceArn, label, svc)
 }
 
-func waitForUpdatedTaskDefinition(cluster string, service string, svc *ecs.ECS) error {
-	newTask := ""
-	attempts := 240
-	sleepTime := 2
+// validateWaiting checks -timeout and -pollInterval, which must be positive for
+// waiting to end and to poll with backoff.
+func validateWaiting() error {
+	if deploymentTimeout <= 0 {
+		return usageError("-timeout must be positive, e.g. 8m")
+	}
 
-	for i := 0; i < attempts; i++ {
-		currentService := describeService(cluster, service, svc)
+	if pollInterval <= 0 {
+		return usageError("-pollInterval must be positive, e.g. 2s")
+	}
 
-		for j := 0; j < len(currentService.Services); j++ {
-			item := currentService.Services[j]
+	return nil
+}
 
-			for k := 0; k < len(item.Deployments); k++ {
-				deployment := item.Deployments[k]
+// waitForUpdatedTaskDefinition waits until the service is fully stable, that
+// is when a single deployment remains and it runs the desired number of tasks.
+// New service events and changed deployment counts are printed while waiting,
+// prefixed with the label (or the service name if no label is given).
+func waitForUpdatedTaskDefinition(cluster, service, label string, svc ecsiface.ECSAPI) error {
+	started := time.Now()
+	seenEvents := make(map[string]bool)
+	deploymentCounts := make(map[string]string)
+
+	return waitFor("service "+ExtractName(&service)+" to become stable", func() (string, error) {
+		currentService, err := describeService(cluster, service, svc)
+		if err != nil {
+			return "", err
+		}
 
-				if *deployment.Status == "PRIMARY" && *deployment.RunningCount == *deployment.DesiredCount {
-					return nil
-				}
+		item := currentService.Services[0]
+
+		prefix := label
+		if prefix == "" {
+			prefix = *item.ServiceName
+		}
+
+		printServiceEvents(prefix, item.Events, started, seenEvents)
+		printDeploymentCounts(prefix, item.Deployments, deploymentCounts)
+
+		return unstableReason(item), nil
+	})
+}
+
+// waitFor polls the condition with exponential backoff, starting at
+// -pollInterval, until it returns no reason to wait or -timeout has passed.
+func waitFor(what string, condition func() (string, error)) error {
+	deadline := time.Now().Add(deploymentTimeout)
+	interval := pollInterval
+
+	for {
+		reason, err := condition()
+		if err != nil {
+			return err
+		}
+
+		if reason == "" {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return timeoutError("Timed out after " + deploymentTimeout.String() + " waiting for " + what + ": " + reason)
+		}
+
+		if interval > remaining {
+			interval = remaining
+		}
+
+		time.Sleep(interval)
+
+		interval *= 2
+		if interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+}
+
+// printReasons wraps the condition of waitFor to print each new reason to
+// wait, prefixed with the label.
+func printReasons(label string, condition func() (string, error)) func() (string, error) {
+	printed := ""
+
+	return func() (string, error) {
+		reason, err := condition()
+
+		if err == nil && reason != "" && reason != printed {
+			printed = reason
+			fmt.Printf("[%s] %s\n", label, reason)
+		}
+
+		return reason, err
+	}
+}
+
+// unstableReason returns why the service is not fully stable yet, or an empty
+// string if exactly one deployment remains and all of its tasks are running.
+func unstableReason(item *ecs.Service) string {
+	if len(item.Deployments) != 1 {
+		var draining []string
+		for i := 0; i < len(item.Deployments); i++ {
+			deployment := item.Deployments[i]
+			if *deployment.Status != "PRIMARY" {
+				draining = append(draining, fmt.Sprintf("%s with %d running", ExtractName(deployment.TaskDefinition), *deployment.RunningCount))
 			}
 		}
 
-		time.Sleep(time.Duration(sleepTime) * time.Second)
+		return fmt.Sprintf("%d deployments remain, old deployments still draining: %s", len(item.Deployments), strings.Join(draining, ", "))
+	}
+
+	deployment := item.Deployments[0]
+	if *deployment.Status != "PRIMARY" {
+		return "the only deployment " + ExtractName(deployment.TaskDefinition) + " is " + *deployment.Status + ", not PRIMARY"
+	}
+
+	if *deployment.RunningCount != *deployment.DesiredCount {
+		return fmt.Sprintf("deployment %s is running %d of %d desired tasks (%d pending)",
+			ExtractName(deployment.TaskDefinition), *deployment.RunningCount, *deployment.DesiredCount, *deployment.PendingCount)
+	}
+
+	if *item.RunningCount != *item.DesiredCount {
+		return fmt.Sprintf("service is running %d of %d desired tasks", *item.RunningCount, *item.DesiredCount)
 	}
 
-	return errors.New("Task " + newTask + " did not start in " + strconv.Itoa(attempts*sleepTime) + " seconds")
+	return ""
 }
 
-func releaseService(clusterArn, serviceArn, containerName, version string, done chan Report, svc *ecs.ECS) (string, error) {
-	service := describeService(clusterArn, serviceArn, svc)
+// printServiceEvents prints events created after the given time that have not
+// been printed before, oldest first.
+func printServiceEvents(prefix string, events []*ecs.ServiceEvent, after time.Time, seen map[string]bool) {
+	// Events are returned newest first
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+
+		if seen[*event.Id] || event.CreatedAt.Before(after) {
+			continue
+		}
+
+		seen[*event.Id] = true
+		fmt.Printf("[%s] %s %s\n", prefix, event.CreatedAt.Local().Format("15:04:05"), *event.Message)
+	}
+}
+
+// printDeploymentCounts prints the running, pending and desired counts for each
+// deployment whose counts have changed since they were last printed.
+func printDeploymentCounts(prefix string, deployments []*ecs.Deployment, printed map[string]string) {
+	for i := 0; i < len(deployments); i++ {
+		deployment := deployments[i]
+
+		counts := fmt.Sprintf("%s (%s), running: %d, pending: %d, desired: %d",
+			ExtractName(deployment.TaskDefinition), *deployment.Status,
+			*deployment.RunningCount, *deployment.PendingCount, *deployment.DesiredCount,
+		)
+
+		if printed[*deployment.Id] != counts {
+			printed[*deployment.Id] = counts
+			fmt.Printf("[%s] %s\n", prefix, counts)
+		}
+	}
+}
+
+func releaseService(clusterArn, serviceArn, label, containerName, version string, healthCheck *HealthCheck, done chan Report, svc ecsiface.ECSAPI) (string, error) {
+	service, err := describeService(clusterArn, serviceArn, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
 
 	if len(service.Services) > 1 {
 		errorMessage := *service.Services[0].ServiceName + " No support for multiple services"
@@ -523,26 +1036,20 @@ func releaseService(clusterArn, serviceArn, containerName, version string, done
 	}
 
 	taskDefinitionName := *service.Services[0].TaskDefinition
-	taskDefinition := describeTaskDefinition(taskDefinitionName, svc)
-	containerIndex := 0
-
-	if len(taskDefinition.TaskDefinition.ContainerDefinitions) > 1 {
-		if containerName == "" {
-			errorMessage := "Please specify containerName for service with multiple container definitions"
-			if done != nil {
-				done <- Report{Message: errorMessage, Success: false}
-			}
-			return "", errors.New(errorMessage)
+	taskDefinition, err := describeTaskDefinition(taskDefinitionName, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
 		}
+		return "", err
+	}
 
-		containerIndex = getContainerIndexForName(taskDefinition.TaskDefinition.ContainerDefinitions, containerName)
-		if containerIndex == -1 {
-			errorMessage := "No container named " + containerName + " found in task definition"
-			if done != nil {
-				done <- Report{Message: errorMessage, Success: false}
-			}
-			return "", errors.New(errorMessage)
+	containerIndex, err := getContainerIndex(taskDefinition.TaskDefinition.ContainerDefinitions, containerName)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
 		}
+		return "", err
 	}
 
 	dockerImage := *taskDefinition.TaskDefinition.ContainerDefinitions[containerIndex].Image
@@ -560,7 +1067,7 @@ func releaseService(clusterArn, serviceArn, containerName, version string, done
 		if done != nil {
 			done <- Report{Message: errMessage, Success: false}
 		}
-		return "", errors.New(errMessage)
+		return "", stateError(errMessage)
 	}
 
 	minimumHealthyPercentage := *service.Services[0].DeploymentConfiguration.MinimumHealthyPercent
@@ -577,13 +1084,91 @@ func releaseService(clusterArn, serviceArn, containerName, version string, done
 		if done != nil {
 			done <- Report{Message: errMessage, Success: false}
 		}
-		return "", errors.New(errMessage)
+		return "", stateError(errMessage)
+	}
+
+	currentInput, err := json.MarshalIndent(registerTaskDefinitionInput(taskDefinition), "", "  ")
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
 	}
 
 	*taskDefinition.TaskDefinition.ContainerDefinitions[containerIndex].Image = imagePart + ":" + version
-	newTaskDefinitionArn := createTaskDefinition(taskDefinition, svc)
 
-	updateTaskDefinitionForService(newTaskDefinitionArn, service, svc)
+	if dryRun {
+		targetInput, err := json.MarshalIndent(registerTaskDefinitionInput(taskDefinition), "", "  ")
+		if err != nil {
+			if done != nil {
+				done <- Report{Message: err.Error(), Success: false}
+			}
+			return "", err
+		}
+
+		var plan bytes.Buffer
+		fmt.Fprintf(&plan, "Plan for service   [%s]\n", *service.Services[0].ServiceName)
+		fmt.Fprintf(&plan, "   Task definition [%s]\n", taskDefinitionName)
+		fmt.Fprintf(&plan, "   Container name  [%s]\n", *taskDefinition.TaskDefinition.ContainerDefinitions[containerIndex].Name)
+		fmt.Fprintf(&plan, "   Docker image    [%s]\n", imagePart)
+		fmt.Fprintf(&plan, "   Version         [%s] -> [%s]\n", currentVersion, version)
+		fmt.Fprintf(&plan, "   HealthyPercentage [%d], DesiredCount [%d] -> Number of running instances during deployment [%d]\n", minimumHealthyPercentage, desiredCount, minimumHealthyCount)
+		if healthCheck != nil {
+			fmt.Fprintf(&plan, "   Health check    [%s]\n", healthCheck.String())
+		}
+		fmt.Fprintf(&plan, "   New task definition for family %s:\n", *taskDefinition.TaskDefinition.Family)
+
+		diff := diffLines(string(currentInput), string(targetInput))
+		for i := 0; i < len(diff); i++ {
+			fmt.Fprintf(&plan, "      %s\n", diff[i])
+		}
+
+		fmt.Print(plan.String())
+
+		message := "Service " + *service.Services[0].ServiceName + " would be released with version " + version + " (dry run)"
+		if done != nil {
+			done <- Report{Message: message, Success: true}
+		}
+
+		return message, nil
+	}
+
+	newTaskDefinitionArn, err := createTaskDefinition(taskDefinition, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	err = updateTaskDefinitionForService(newTaskDefinitionArn, label, service, svc)
+	if err == nil && healthCheck != nil {
+		prefix := label
+		if prefix == "" {
+			prefix = *service.Services[0].ServiceName
+		}
+
+		err = waitForHealthy(prefix, healthCheck)
+	}
+
+	if err != nil {
+		// The new task definition never became steady or healthy, put back the one that was running before
+		errMessage := *service.Services[0].ServiceName + " Release of version " + version + " failed: " + err.Error()
+		fmt.Printf("%s. Rolling back to %s\n", errMessage, ExtractName(&taskDefinitionName))
+
+		rollbackErr := updateTaskDefinitionForService(taskDefinitionName, label, service, svc)
+		if rollbackErr != nil {
+			errMessage = errMessage + ". Rollback to " + ExtractName(&taskDefinitionName) + " failed: " + rollbackErr.Error()
+		} else {
+			errMessage = errMessage + ". Rolled back to version " + currentVersion
+		}
+
+		if done != nil {
+			done <- Report{Message: errMessage, Success: false}
+		}
+		return "", withMessage(err, errMessage)
+	}
+
 	message := "Service " + *service.Services[0].ServiceName + " is released with version " + version
 
 	if done != nil {
@@ -593,7 +1178,92 @@ func releaseService(clusterArn, serviceArn, containerName, version string, done
 	return message, nil
 }
 
-func updateService(clusterArn, serviceArn string, done chan Report, svc *ecs.ECS) (string, error) {
+func rollbackService(clusterArn, serviceArn, label, containerName string, done chan Report, svc ecsiface.ECSAPI) (string, error) {
+	service, err := describeService(clusterArn, serviceArn, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	if len(service.Services) > 1 {
+		errorMessage := *service.Services[0].ServiceName + " No support for multiple services"
+		if done != nil {
+			done <- Report{Message: errorMessage, Success: false}
+		}
+		return "", errors.New(errorMessage)
+	}
+
+	currentTaskDefinitionName := *service.Services[0].TaskDefinition
+	previousTaskDefinitionName, err := previousTaskDefinition(currentTaskDefinitionName, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	currentDefinition, err := describeTaskDefinition(currentTaskDefinitionName, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	previousDefinition, err := describeTaskDefinition(previousTaskDefinitionName, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	currentIndex, err := getContainerIndex(currentDefinition.TaskDefinition.ContainerDefinitions, containerName)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	previousIndex, err := getContainerIndex(previousDefinition.TaskDefinition.ContainerDefinitions, containerName)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+		return "", err
+	}
+
+	currentVersion, _ := ExtractVersion(*currentDefinition.TaskDefinition.ContainerDefinitions[currentIndex].Image)
+	previousVersion, imagePart := ExtractVersion(*previousDefinition.TaskDefinition.ContainerDefinitions[previousIndex].Image)
+
+	fmt.Printf("%s: Rolling back from %s (%s) to %s (%s), image %s\n",
+		*service.Services[0].ServiceName,
+		ExtractName(&currentTaskDefinitionName), currentVersion,
+		ExtractName(&previousTaskDefinitionName), previousVersion,
+		imagePart,
+	)
+
+	err = updateTaskDefinitionForService(previousTaskDefinitionName, label, service, svc)
+	if err != nil {
+		errMessage := *service.Services[0].ServiceName + " Rollback to version " + previousVersion + " failed: " + err.Error()
+		if done != nil {
+			done <- Report{Message: errMessage, Success: false}
+		}
+		return "", withMessage(err, errMessage)
+	}
+
+	message := "Service " + *service.Services[0].ServiceName + " is rolled back to version " + previousVersion
+	if done != nil {
+		done <- Report{Message: message, Success: true}
+	}
+
+	return message, nil
+}
+
+func updateService(clusterArn, serviceArn, label string, done chan Report, svc ecsiface.ECSAPI) (string, error) {
 	tasks, err := listTasks(clusterArn, serviceArn, svc)
 	if err != nil {
 		if done != nil {
@@ -603,7 +1273,15 @@ func updateService(clusterArn, serviceArn string, done chan Report, svc *ecs.ECS
 		return "", err
 	}
 
-	service := describeService(clusterArn, serviceArn, svc)
+	service, err := describeService(clusterArn, serviceArn, svc)
+	if err != nil {
+		if done != nil {
+			done <- Report{Message: err.Error(), Success: false}
+		}
+
+		return "", err
+	}
+
 	if len(service.Services) > 1 {
 		errMessage := "No support for multiple services"
 		if done != nil {
@@ -619,7 +1297,7 @@ func updateService(clusterArn, serviceArn string, done chan Report, svc *ecs.ECS
 			done <- Report{Message: errorMessage, Success: false}
 		}
 
-		return "", errors.New(errorMessage)
+		return "", stateError(errorMessage)
 	}
 
 	for i := 0; i < len(tasks.TaskArns); i++ {
@@ -632,7 +1310,7 @@ func updateService(clusterArn, serviceArn string, done chan Report, svc *ecs.ECS
 			return "", err
 		}
 
-		err = waitForUpdatedTaskDefinition(clusterArn, serviceArn, svc)
+		err = waitForUpdatedTaskDefinition(clusterArn, serviceArn, label, svc)
 		if err != nil {
 			if done != nil {
 				done <- Report{Message: err.Error(), Success: false}
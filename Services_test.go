@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fields of a described task definition that are set by ECS, not registered
+var readOnlyTaskDefinitionFields = map[string]bool{
+	"Compatibilities":    true,
+	"DeregisteredAt":     true,
+	"RegisteredAt":       true,
+	"RegisteredBy":       true,
+	"RequiresAttributes": true,
+	"Revision":           true,
+	"Status":             true,
+	"TaskDefinitionArn":  true,
+}
+
+func TestRegisterTaskDefinitionInputOnlyChangesImage(t *testing.T) {
+	described := &ecs.DescribeTaskDefinitionOutput{TaskDefinition: &ecs.TaskDefinition{}}
+	fillValue(reflect.ValueOf(described.TaskDefinition).Elem(), "definition", 0)
+	described.Tags = []*ecs.Tag{{Key: aws.String("team"), Value: aws.String("writer")}}
+	described.TaskDefinition.ContainerDefinitions[0].Image = aws.String("registry/editorservice:1.0.0")
+
+	// The expected definition is a deep copy taken before the image is swapped
+	snapshot, err := json.Marshal(described.TaskDefinition)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &ecs.TaskDefinition{}
+	err = json.Unmarshal(snapshot, expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected.ContainerDefinitions[0].Image = aws.String("registry/editorservice:1.1.0")
+	*described.TaskDefinition.ContainerDefinitions[0].Image = "registry/editorservice:1.1.0"
+
+	input := reflect.ValueOf(registerTaskDefinitionInput(described)).Elem()
+	definition := reflect.ValueOf(expected).Elem()
+
+	for i := 0; i < input.NumField(); i++ {
+		name := input.Type().Field(i).Name
+		if name == "_" {
+			continue
+		}
+
+		if name == "Tags" {
+			if !reflect.DeepEqual(input.Field(i).Interface(), described.Tags) {
+				t.Errorf("Tags differ: %v", input.Field(i).Interface())
+			}
+			continue
+		}
+
+		field := definition.FieldByName(name)
+		if !field.IsValid() {
+			t.Errorf("%s is registered but not described, so it can't be copied", name)
+			continue
+		}
+
+		if !reflect.DeepEqual(input.Field(i).Interface(), field.Interface()) {
+			t.Errorf("%s differs after registration:\n%v\n%v", name, input.Field(i).Interface(), field.Interface())
+		}
+	}
+
+	for i := 0; i < definition.NumField(); i++ {
+		name := definition.Type().Field(i).Name
+		if name != "_" && !readOnlyTaskDefinitionFields[name] && !input.FieldByName(name).IsValid() {
+			t.Errorf("%s is described but not a registration field, add it to the read-only fields if ECS sets it", name)
+		}
+	}
+}
+
+// fillValue sets every field of the value, recursively, to a non-zero value.
+func fillValue(value reflect.Value, text string, depth int) {
+	if depth > 10 {
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		value.Set(reflect.New(value.Type().Elem()))
+		fillValue(value.Elem(), text, depth+1)
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Int, reflect.Int64:
+		value.SetInt(int64(len(text)))
+	case reflect.Bool:
+		value.SetBool(true)
+	case reflect.Float64:
+		value.SetFloat(1.5)
+	case reflect.Slice:
+		value.Set(reflect.MakeSlice(value.Type(), 1, 1))
+		fillValue(value.Index(0), text, depth+1)
+	case reflect.Map:
+		value.Set(reflect.MakeMap(value.Type()))
+		element := reflect.New(value.Type().Elem()).Elem()
+		fillValue(element, text, depth+1)
+		value.SetMapIndex(reflect.ValueOf(text+"-key"), element)
+	case reflect.Struct:
+		if value.Type() == reflect.TypeOf(time.Time{}) {
+			value.Set(reflect.ValueOf(time.Date(2024, 1, 17, 10, 15, 20, 0, time.UTC)))
+			return
+		}
+
+		for i := 0; i < value.NumField(); i++ {
+			if value.Type().Field(i).PkgPath == "" {
+				fillValue(value.Field(i), text+"-"+value.Type().Field(i).Name, depth+1)
+			}
+		}
+	}
+}
+
+// newReleaseFake returns a cluster with the editor service running two tasks
+// of the first revision of its task definition, and a later revision of it.
+func newReleaseFake(images ...string) (*fakeEcs, string, string) {
+	fake := newFakeEcs()
+	clusterArn := fake.addCluster("writer")
+	definitionArn := fake.addTaskDefinition("editor", 1, images...)
+	serviceArn := fake.addService(clusterArn, "editor", definitionArn, 2)
+
+	return fake, clusterArn, serviceArn
+}
+
+func TestReleaseService(t *testing.T) {
+	tests := []struct {
+		name          string
+		images        []string
+		containerName string
+		version       string
+		dryRun        bool
+		healthy       int64
+		stuck         bool
+		exitCode      int
+		message       string
+		registered    []string
+		updated       []string
+	}{
+		{
+			name:       "releases the new version",
+			images:     []string{"registry/editorservice:1.0.0"},
+			version:    "1.1.0",
+			message:    "Service editor is released with version 1.1.0",
+			registered: []string{"registry/editorservice:1.1.0"},
+			updated:    []string{"editor:2"},
+		},
+		{
+			name:          "releases the named container",
+			images:        []string{"registry/nginx:1.25", "registry/editorservice:1.0.0"},
+			containerName: "editorservice",
+			version:       "1.1.0",
+			message:       "Service editor is released with version 1.1.0",
+			registered:    []string{"registry/nginx:1.25", "registry/editorservice:1.1.0"},
+			updated:       []string{"editor:2"},
+		},
+		{
+			name:     "requires the container name for several containers",
+			images:   []string{"registry/nginx:1.25", "registry/editorservice:1.0.0"},
+			version:  "1.1.0",
+			exitCode: exitUsage,
+		},
+		{
+			name:     "refuses the version that is deployed",
+			images:   []string{"registry/editorservice:1.0.0"},
+			version:  "1.0.0",
+			exitCode: exitState,
+		},
+		{
+			name:     "refuses when no task may stop during the deployment",
+			images:   []string{"registry/editorservice:1.0.0"},
+			version:  "1.1.0",
+			healthy:  100,
+			exitCode: exitState,
+		},
+		{
+			name:    "only plans with -dryRun",
+			images:  []string{"registry/editorservice:1.0.0"},
+			version: "1.1.0",
+			dryRun:  true,
+			message: "Service editor would be released with version 1.1.0 (dry run)",
+		},
+		{
+			name:       "rolls back a deployment that never becomes stable",
+			images:     []string{"registry/editorservice:1.0.0"},
+			version:    "1.1.0",
+			stuck:      true,
+			exitCode:   exitTimeout,
+			registered: []string{"registry/editorservice:1.1.0"},
+			updated:    []string{"editor:2", "editor:1"},
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			fake, clusterArn, serviceArn := newReleaseFake(test.images...)
+			withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+
+			if test.healthy > 0 {
+				fake.services[0].DeploymentConfiguration.MinimumHealthyPercent = aws.Int64(test.healthy)
+			}
+			if test.stuck {
+				fake.stuck[fakeArnPrefix+"task-definition/editor:2"] = true
+			}
+
+			previousDryRun := dryRun
+			dryRun = test.dryRun
+			defer func() { dryRun = previousDryRun }()
+
+			done := make(chan Report, 1)
+			var message string
+			_, err := captureStdout(t, func() error {
+				var err error
+				message, err = releaseService(clusterArn, serviceArn, "", test.containerName, test.version, nil, done, fake)
+				return err
+			})
+
+			report := <-done
+			if test.exitCode == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if message != test.message || report.Message != test.message || !report.Success {
+					t.Errorf("message = %q, report = %+v, want %q", message, report, test.message)
+				}
+			} else {
+				if err == nil {
+					t.Fatalf("expected an error, got message %q", message)
+				}
+				if exitCodeFor(err) != test.exitCode {
+					t.Errorf("exit code = %d, want %d for %v", exitCodeFor(err), test.exitCode, err)
+				}
+				if report.Success || report.Message != err.Error() {
+					t.Errorf("report = %+v, want the failure %q", report, err.Error())
+				}
+			}
+
+			var registered []string
+			for j := 0; j < len(fake.registered); j++ {
+				containers := fake.registered[j].ContainerDefinitions
+				for k := 0; k < len(containers); k++ {
+					registered = append(registered, *containers[k].Image)
+				}
+			}
+
+			if !reflect.DeepEqual(registered, test.registered) {
+				t.Errorf("registered images = %v, want %v", registered, test.registered)
+			}
+			if !reflect.DeepEqual(fake.updated, test.updated) {
+				t.Errorf("service updated to %v, want %v", fake.updated, test.updated)
+			}
+		})
+	}
+}
+
+func TestUpdateService(t *testing.T) {
+	tests := []struct {
+		name     string
+		tasks    int
+		exitCode int
+		stopped  []string
+	}{
+		{
+			name:    "stops every task for the service to start new ones",
+			tasks:   2,
+			stopped: []string{"editor-0", "editor-1"},
+		},
+		{
+			name:     "refuses while tasks are missing",
+			tasks:    1,
+			exitCode: exitState,
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			fake, clusterArn, serviceArn := newReleaseFake("registry/editorservice:1.0.0")
+			fake.tasks[serviceArn] = fake.tasks[serviceArn][:test.tasks]
+			withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+
+			done := make(chan Report, 1)
+			_, err := captureStdout(t, func() error {
+				_, err := updateService(clusterArn, serviceArn, "", done, fake)
+				return err
+			})
+
+			report := <-done
+			if test.exitCode == 0 && (err != nil || report.Message != "Service editor is updated") {
+				t.Errorf("error = %v, report = %+v", err, report)
+			}
+			if test.exitCode != 0 && (err == nil || exitCodeFor(err) != test.exitCode) {
+				t.Errorf("error = %v, want exit code %d", err, test.exitCode)
+			}
+			if !reflect.DeepEqual(fake.stopped, test.stopped) {
+				t.Errorf("stopped tasks %v, want %v", fake.stopped, test.stopped)
+			}
+		})
+	}
+}
+
+func TestListServicesAndTasks(t *testing.T) {
+	fake := newFakeEcs()
+	clusterArn := fake.addCluster("writer")
+	definitionArn := fake.addTaskDefinition("editor", 1, "registry/editorservice:1.0.0")
+	editorArn := fake.addService(clusterArn, "editor", definitionArn, 3)
+	fake.addService(clusterArn, "renderer", definitionArn, 1)
+	fake.addService(clusterArn, "search", definitionArn, 1)
+	fake.addService(fake.addCluster("reader"), "viewer", definitionArn, 1)
+
+	tests := []struct {
+		name   string
+		format string
+		run    func() error
+		want   string
+	}{
+		{
+			name:   "services as text",
+			format: formatText,
+			run:    func() error { return ListServices(clusterArn) },
+			want:   "editor\nrenderer\nsearch\n",
+		},
+		{
+			name:   "services as a table",
+			format: formatTable,
+			run:    func() error { return ListServices(clusterArn) },
+			want: "NAME      ARN\n" +
+				"editor    " + fakeArnPrefix + "service/editor\n" +
+				"renderer  " + fakeArnPrefix + "service/renderer\n" +
+				"search    " + fakeArnPrefix + "service/search\n",
+		},
+		{
+			name:   "service as a table",
+			format: formatTable,
+			run:    func() error { return DescribeService(clusterArn, editorArn) },
+			want: "SERVICE  TASK DEFINITION  STATUS   RUNNING  PENDING  DESIRED\n" +
+				"editor   editor:1         PRIMARY  3        0        3\n",
+		},
+		{
+			name:   "tasks as text",
+			format: formatText,
+			run:    func() error { return ListTasks(clusterArn, editorArn) },
+			want:   "editor-0\neditor-1\neditor-2\n",
+		},
+		{
+			name:   "tasks as json",
+			format: formatJson,
+			run:    func() error { return ListTasks(clusterArn, editorArn) },
+			want: `[
+  {
+    "id": "editor-0",
+    "arn": "` + fakeArnPrefix + `task/editor-0"
+  },
+  {
+    "id": "editor-1",
+    "arn": "` + fakeArnPrefix + `task/editor-1"
+  },
+  {
+    "id": "editor-2",
+    "arn": "` + fakeArnPrefix + `task/editor-2"
+  }
+]
+`,
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+			withOutputFormat(t, test.format)
+
+			output, err := captureStdout(t, test.run)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if output != test.want {
+				t.Errorf("output:\n%s\nwant:\n%s", output, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateWaiting(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		deploymentTimeout, pollInterval = timeout, interval
+	}(deploymentTimeout, pollInterval)
+
+	tests := []struct {
+		timeout  time.Duration
+		interval time.Duration
+		exitCode int
+	}{
+		{timeout: 8 * time.Minute, interval: 2 * time.Second},
+		{timeout: time.Second, interval: time.Millisecond},
+		{timeout: 0, interval: 2 * time.Second, exitCode: exitUsage},
+		{timeout: -time.Minute, interval: 2 * time.Second, exitCode: exitUsage},
+		{timeout: 8 * time.Minute, interval: 0, exitCode: exitUsage},
+		{timeout: 8 * time.Minute, interval: -time.Second, exitCode: exitUsage},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		deploymentTimeout, pollInterval = tests[i].timeout, tests[i].interval
+
+		err := validateWaiting()
+		if tests[i].exitCode == 0 && err != nil {
+			t.Errorf("-timeout %s -pollInterval %s: unexpected error: %v", tests[i].timeout, tests[i].interval, err)
+		}
+		if tests[i].exitCode != 0 && (err == nil || exitCodeFor(err) != tests[i].exitCode) {
+			t.Errorf("-timeout %s -pollInterval %s: error = %v, want exit code %d", tests[i].timeout, tests[i].interval, err, tests[i].exitCode)
+		}
+	}
+}
+
+func TestReleaseServiceHealthCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		exitCode int
+		output   string
+		updated  []string
+	}{
+		{
+			name:    "keeps a release whose probes pass",
+			status:  http.StatusOK,
+			output:  "Customer A: Health check 2 of 2 passed",
+			updated: []string{"editor:2"},
+		},
+		{
+			name:     "rolls back a release on a failing probe",
+			status:   http.StatusServiceUnavailable,
+			exitCode: exitState,
+			output:   "Rolling back to editor:1",
+			updated:  []string{"editor:2", "editor:1"},
+		},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+
+		t.Run(test.name, func(t *testing.T) {
+			fake, clusterArn, serviceArn := newReleaseFake("registry/editorservice:1.0.0")
+			withFakeClients(t, map[string]*Clients{"": {Ecs: fake}})
+
+			previousVerbose := verboseLevel
+			verboseLevel = 1
+			defer func() { verboseLevel = previousVerbose }()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			healthCheck := &HealthCheck{Url: server.URL, ExpectedStatus: http.StatusOK, Count: 2, Interval: time.Millisecond}
+
+			output, err := captureStdout(t, func() error {
+				_, err := releaseService(clusterArn, serviceArn, "Customer A", "", "1.1.0", healthCheck, nil, fake)
+				return err
+			})
+
+			if test.exitCode == 0 && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.exitCode != 0 && (err == nil || exitCodeFor(err) != test.exitCode) {
+				t.Errorf("error = %v, want exit code %d", err, test.exitCode)
+			}
+			if !strings.Contains(output, test.output) {
+				t.Errorf("output:\n%s\nwant it to contain %q", output, test.output)
+			}
+			if !reflect.DeepEqual(fake.updated, test.updated) {
+				t.Errorf("service updated to %v, want %v", fake.updated, test.updated)
+			}
+		})
+	}
+}
+
+func TestReleaseServicesHealthCheckCount(t *testing.T) {
+	tests := []struct {
+		count    string
+		exitCode int
+	}{
+		{count: "0", exitCode: exitUsage},
+		{count: "-1", exitCode: exitUsage},
+	}
+
+	for i := 0; i < len(tests); i++ {
+		updates := `[{"profile": "im", "cluster": "writer", "service": "editor", "healthCheckUrl": "http://localhost/health", "healthCheckCount": ` + tests[i].count + `}]`
+
+		_, err := captureStdout(t, func() error { return ReleaseServices("1.1.0", []byte(updates)) })
+		if err == nil || exitCodeFor(err) != tests[i].exitCode {
+			t.Errorf("healthCheckCount %s: error = %v, want exit code %d", tests[i].count, err, tests[i].exitCode)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host key checking modes, selected with -hostKeyCheck
+const (
+	hostKeyStrict    = "strict"     // Only hosts already in known_hosts are accepted
+	hostKeyAcceptNew = "accept-new" // Unknown hosts are trusted on first use and added to known_hosts
+)
+
+const sshPort = "22"
+
+// Serializes additions to known_hosts when connecting to several hosts at once,
+// and holds the keys added by this run, which the known hosts callback won't
+// see in the file
+var knownHostsLock sync.Mutex
+var addedHostKeys = map[string][]byte{}
+
+// The keys in known_hosts when it was read, checked without adding unknown
+// hosts, and a key that is in no known_hosts to look the known keys up with
+var knownHostKeys ssh.HostKeyCallback
+var probeHostKey ssh.PublicKey
+
+// Client configs by PEM file, so that a passphrase is only asked for once when
+// connecting to several instances
+var sshConfigs = map[string]*ssh.ClientConfig{}
+var sshConfigsLock sync.Mutex
+
+// Connection to the -bastion, shared by all instances reached through it
+var bastionClient *ssh.Client
+var bastionLock sync.Mutex
+
+// dialInstance opens an SSH connection to the public IP of the instance, or
+// to its private IP through the bastion given by -bastion.
+func dialInstance(instance *ec2.Instance, pemFile string) (*ssh.Client, error) {
+	config, err := sshClientConfig(pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if bastion != "" {
+		return dialThroughBastion(instance, config)
+	}
+
+	if instance.PublicIpAddress == nil {
+		return nil, usageError("No public IP number on instance: " + getName(instance.Tags) +
+			", use -bastion to reach it through a jump host, or -transport ssm to reach it through SSM")
+	}
+
+	address := net.JoinHostPort(*instance.PublicIpAddress, sshPort)
+
+	client, err := ssh.Dial("tcp", address, withHostKeyAlgorithms(config, address))
+	if err != nil {
+		return nil, sshDialError(config.User, address, err)
+	}
+
+	return client, nil
+}
+
+func dialThroughBastion(instance *ec2.Instance, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if instance.PrivateIpAddress == nil {
+		return nil, usageError("No private IP number on instance: " + getName(instance.Tags))
+	}
+
+	jumpHost, err := dialBastion(config)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(*instance.PrivateIpAddress, sshPort)
+
+	connection, err := jumpHost.Dial("tcp", address)
+
+	// Unless the bastion itself refused, the connection to it is broken, so it is dialed once more
+	if _, refused := err.(*ssh.OpenChannelError); err != nil && !refused {
+		forgetBastion(jumpHost)
+
+		jumpHost, err = dialBastion(config)
+		if err != nil {
+			return nil, err
+		}
+
+		connection, err = jumpHost.Dial("tcp", address)
+	}
+
+	if err != nil {
+		return nil, stateError("Could not connect to " + address + " through bastion " + bastion + ": " + err.Error())
+	}
+
+	clientConnection, channels, requests, err := ssh.NewClientConn(connection, address, withHostKeyAlgorithms(config, address))
+	if err != nil {
+		//noinspection GoUnhandledErrorResult
+		connection.Close()
+		return nil, sshDialError(config.User, address, err)
+	}
+
+	return ssh.NewClient(clientConnection, channels, requests), nil
+}
+
+// dialBastion connects to the bastion given by -bastion as [user@]host[:port],
+// where host is the name of an instance or a host name or IP. The connection
+// is opened once and shared until it is lost.
+func dialBastion(config *ssh.ClientConfig) (*ssh.Client, error) {
+	bastionLock.Lock()
+	defer bastionLock.Unlock()
+
+	if bastionClient != nil {
+		return bastionClient, nil
+	}
+
+	host := bastion
+	bastionConfig := *config
+
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		bastionConfig.User = host[:at]
+		host = host[at+1:]
+	}
+
+	port := sshPort
+	if splitHost, splitPort, err := net.SplitHostPort(host); err == nil {
+		host, port = splitHost, splitPort
+	}
+
+	host, err := resolveBastionHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(host, port)
+
+	client, err := ssh.Dial("tcp", address, withHostKeyAlgorithms(&bastionConfig, address))
+	if err != nil {
+		return nil, sshDialError(bastionConfig.User, address, err)
+	}
+
+	bastionClient = client
+
+	go func() {
+		//noinspection GoUnhandledErrorResult
+		client.Wait()
+		forgetBastion(client)
+	}()
+
+	return client, nil
+}
+
+// forgetBastion closes the connection to the bastion, so that the next
+// dialBastion connects again.
+func forgetBastion(client *ssh.Client) {
+	//noinspection GoUnhandledErrorResult
+	client.Close()
+
+	bastionLock.Lock()
+	defer bastionLock.Unlock()
+
+	if bastionClient == client {
+		bastionClient = nil
+	}
+}
+
+// resolveBastionHost returns the public IP of the running instance with the
+// name, or the name itself if it is an IP, a domain name or not the name of
+// any instance.
+func resolveBastionHost(name string) (string, error) {
+	if net.ParseIP(name) != nil || strings.Contains(name, ".") {
+		return name, nil
+	}
+
+	instances, err := GetInstancesForName(name)
+	if exitCodeFor(err) == exitNotFound {
+		return name, nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	for i := 0; i < len(instances); i++ {
+		running := instances[i].State != nil && aws.StringValue(instances[i].State.Name) == ec2.InstanceStateNameRunning
+
+		if running && instances[i].PublicIpAddress != nil {
+			return *instances[i].PublicIpAddress, nil
+		}
+	}
+
+	return "", usageError("No running instance named " + name + " with a public IP to use as bastion")
+}
+
+func sshDialError(user, address string, err error) error {
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return authError("Could not authenticate as " + user + "@" + address + ": " + err.Error())
+	}
+
+	return stateError("Could not connect to " + user + "@" + address + ": " + err.Error())
+}
+
+func sshClientConfig(pemFile string) (*ssh.ClientConfig, error) {
+	sshConfigsLock.Lock()
+	defer sshConfigsLock.Unlock()
+
+	if config, ok := sshConfigs[pemFile]; ok {
+		return config, nil
+	}
+
+	signers, err := sshSigners(pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         15 * time.Second,
+	}
+
+	sshConfigs[pemFile] = config
+
+	return config, nil
+}
+
+// sshSigners returns the keys to authenticate with: the PEM file given with
+// -pemfile or found in the profile, followed by the keys in ssh-agent.
+func sshSigners(pemFile string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	if pemFile == "" && profile != "" {
+		// The profile doesn't need a pemfile when ssh-agent holds the key
+		pemFile, _ = getPemFile()
+	}
+
+	if pemFile != "" {
+		signer, err := readPrivateKey(pemFile)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		connection, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, stateError("Could not connect to ssh-agent: " + err.Error())
+		}
+
+		agentSigners, err := agent.NewClient(connection).Signers()
+		if err != nil {
+			return nil, stateError("Could not get keys from ssh-agent: " + err.Error())
+		}
+
+		signers = append(signers, agentSigners...)
+	}
+
+	if len(signers) == 0 {
+		return nil, usageError("A SSH PEM file must be specified with -pemfile, or a key added to ssh-agent")
+	}
+
+	return signers, nil
+}
+
+// readPrivateKey reads a private key, asking for the passphrase if the key is
+// encrypted.
+func readPrivateKey(pemFile string) (ssh.Signer, error) {
+	content, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(content)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		fmt.Fprintf(os.Stderr, "Enter passphrase for %s: ", pemFile)
+		passphrase, readErr := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+
+		if readErr != nil {
+			return nil, readErr
+		}
+
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(content, passphrase)
+	}
+
+	if err != nil {
+		return nil, usageError("Could not read private key " + pemFile + ": " + err.Error())
+	}
+
+	return signer, nil
+}
+
+func getKnownHostsPath() (string, error) {
+	if knownHostsFile != "" {
+		return expandHomeDir(knownHostsFile)
+	}
+
+	currUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(currUser.HomeDir, ".ssh", "known_hosts"), nil
+}
+
+// sshHostKeyCallback verifies host keys against known_hosts. Unknown hosts are
+// added on first use unless -hostKeyCheck is strict, while a host presenting a
+// different key than the known one is always rejected.
+func sshHostKeyCallback() (ssh.HostKeyCallback, error) {
+	if hostKeyCheck != hostKeyStrict && hostKeyCheck != hostKeyAcceptNew {
+		return nil, usageError("Unknown host key check: " + hostKeyCheck + ", use one of strict or accept-new")
+	}
+
+	path, err := getKnownHostsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if hostKeyCheck == hostKeyStrict {
+			return nil, stateError("No known hosts file " + path + " for strict host key checking")
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ioutil.WriteFile(path, nil, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	known, err := knownhosts.New(path)
+	if err != nil {
+		return nil, err
+	}
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	probeHostKey, err = ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	knownHostKeys = known
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := known(hostname, remote, key)
+
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			return stateError("Host key for " + hostname + " has changed, it does not match the one in " + path + ". Someone could be intercepting the connection, or the host was replaced")
+		}
+
+		if hostKeyCheck == hostKeyStrict {
+			return stateError("Host " + hostname + " is not in " + path + " (strict host key checking)")
+		}
+
+		return addKnownHost(path, hostname, remote, key)
+	}, nil
+}
+
+// withHostKeyAlgorithms returns the config with the algorithms of the host keys
+// known for the address put first, like OpenSSH does. Otherwise a host with
+// several keys may present a type that known_hosts has no line for, e.g. ECDSA
+// where OpenSSH added Ed25519, which would be rejected as a changed key.
+func withHostKeyAlgorithms(config *ssh.ClientConfig, address string) *ssh.ClientConfig {
+	var algorithms []string
+
+	keyTypes := knownHostKeyTypes(address)
+	for i := 0; i < len(keyTypes); i++ {
+		if keyTypes[i] == ssh.KeyAlgoRSA {
+			// RSA keys are used with SHA-2 signatures where the host supports them
+			algorithms = appendMissing(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+
+		algorithms = appendMissing(algorithms, keyTypes[i])
+	}
+
+	if len(algorithms) == 0 {
+		return config
+	}
+
+	withAlgorithms := *config
+	withAlgorithms.HostKeyAlgorithms = appendMissing(algorithms, ssh.SupportedAlgorithms().HostKeys...)
+
+	return &withAlgorithms
+}
+
+// knownHostKeyTypes returns the types of the keys known_hosts has for the
+// address, including those added by this run.
+func knownHostKeyTypes(address string) []string {
+	var keyTypes []string
+
+	if knownHostKeys != nil && probeHostKey != nil {
+		var keyErr *knownhosts.KeyError
+		if errors.As(knownHostKeys(address, &net.TCPAddr{}, probeHostKey), &keyErr) {
+			for i := 0; i < len(keyErr.Want); i++ {
+				keyTypes = append(keyTypes, keyErr.Want[i].Key.Type())
+			}
+		}
+	}
+
+	knownHostsLock.Lock()
+	added, ok := addedHostKeys[address]
+	knownHostsLock.Unlock()
+
+	if ok {
+		if key, err := ssh.ParsePublicKey(added); err == nil {
+			keyTypes = append(keyTypes, key.Type())
+		}
+	}
+
+	return keyTypes
+}
+
+func appendMissing(values []string, more ...string) []string {
+	for i := 0; i < len(more); i++ {
+		found := false
+		for j := 0; j < len(values); j++ {
+			if values[j] == more[i] {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			values = append(values, more[i])
+		}
+	}
+
+	return values
+}
+
+func addKnownHost(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	if added, ok := addedHostKeys[hostname]; ok {
+		if !bytes.Equal(added, key.Marshal()) {
+			return stateError("Host key for " + hostname + " has changed since it was added to " + path)
+		}
+
+		return nil
+	}
+
+	addedHostKeys[hostname] = key.Marshal()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	addresses := []string{knownhosts.Normalize(hostname)}
+	if remote != nil && knownhosts.Normalize(remote.String()) != addresses[0] {
+		addresses = append(addresses, knownhosts.Normalize(remote.String()))
+	}
+
+	fmt.Fprintf(os.Stderr, "Permanently added %s (%s) to the list of known hosts\n", hostname, key.Type())
+
+	_, err = fmt.Fprintln(file, knownhosts.Line(addresses, key))
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostKeyAlgorithmsPreferKnownKeyType(t *testing.T) {
+	defer func(file, check string) { knownHostsFile, hostKeyCheck = file, check }(knownHostsFile, hostKeyCheck)
+
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edKey, err := ssh.NewPublicKey(edPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	hostKeyCheck = hostKeyStrict
+
+	err = ioutil.WriteFile(knownHostsFile, []byte(knownhosts.Line([]string{"10.0.0.1"}, edKey)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := sshHostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := withHostKeyAlgorithms(&ssh.ClientConfig{HostKeyCallback: callback}, "10.0.0.1:22")
+	if len(config.HostKeyAlgorithms) == 0 || config.HostKeyAlgorithms[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("Expected %s first, got %v", ssh.KeyAlgoED25519, config.HostKeyAlgorithms)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+	if err := callback("10.0.0.1:22", remote, edKey); err != nil {
+		t.Errorf("Known key rejected: %v", err)
+	}
+
+	// A host presenting another key of a known type has really changed
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ssh.NewPublicKey(&ecPrivate.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := callback("10.0.0.1:22", remote, ecKey); err == nil {
+		t.Error("Unknown key accepted with strict host key checking")
+	}
+
+	unknown := withHostKeyAlgorithms(&ssh.ClientConfig{}, "10.0.0.2:22")
+	if unknown.HostKeyAlgorithms != nil {
+		t.Errorf("Expected the default algorithms for an unknown host, got %v", unknown.HostKeyAlgorithms)
+	}
+}
+
+// startBastion starts an SSH server that lets anyone in and refuses to
+// forward connections, and returns its address and the server side of the
+// connections to it.
+func startBastion(t *testing.T) (string, func() []net.Conn) {
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		//noinspection GoUnhandledErrorResult
+		listener.Close()
+	})
+
+	var connections []net.Conn
+	var lock sync.Mutex
+
+	go func() {
+		for {
+			connection, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			lock.Lock()
+			connections = append(connections, connection)
+			lock.Unlock()
+
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(connection, config)
+				if err != nil {
+					return
+				}
+
+				go ssh.DiscardRequests(requests)
+
+				for channel := range channels {
+					//noinspection GoUnhandledErrorResult
+					channel.Reject(ssh.Prohibited, "no forwarding")
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), func() []net.Conn {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return append([]net.Conn{}, connections...)
+	}
+}
+
+func TestBastionRedialedAfterConnectionLost(t *testing.T) {
+	defer func(host string) { bastion = host }(bastion)
+
+	address, connections := startBastion(t)
+	bastion = "ec2-user@" + address
+
+	config := &ssh.ClientConfig{User: "ec2-user", HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	first, err := dialBastion(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer forgetBastion(first)
+
+	// A refused forward says nothing about the connection to the bastion
+	instance := &ec2.Instance{PrivateIpAddress: aws.String("10.0.0.1"), Tags: []*ec2.Tag{}}
+	if _, err := dialThroughBastion(instance, config); err == nil {
+		t.Fatal("Expected the bastion to refuse forwarding")
+	}
+
+	if shared, err := dialBastion(config); err != nil || shared != first {
+		t.Fatalf("Expected the connection to be shared, got %v, %v", shared, err)
+	}
+
+	if len(connections()) != 1 {
+		t.Fatalf("Expected 1 connection to the bastion, got %d", len(connections()))
+	}
+
+	//noinspection GoUnhandledErrorResult
+	connections()[0].Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		bastionLock.Lock()
+		lost := bastionClient == nil
+		bastionLock.Unlock()
+
+		if lost {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Lost connection to the bastion is still shared")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := dialBastion(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer forgetBastion(second)
+
+	if second == first || len(connections()) != 2 {
+		t.Errorf("Expected a new connection to the bastion, got %d connections", len(connections()))
+	}
+}
@@ -1,102 +1,513 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
-func SshLogin(instance *ec2.Instance, pemFile string) {
-	path, err := exec.LookPath("ssh")
+func SshLogin(instance *ec2.Instance, pemFile string) error {
+	if transport == transportSsm {
+		return SsmLogin(instance)
+	}
+
+	client, err := dialInstance(instance, pemFile)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer client.Close()
 
+	session, err := client.NewSession()
 	if err != nil {
-		errUsage("Could not find binary 'ssh' in path")
+		return stateError("Could not open SSH session: " + err.Error())
 	}
 
-	if instance.PublicIpAddress == nil {
-		errUsage("No public IP number on instance: " + getName(instance.Tags))
+	//noinspection GoUnhandledErrorResult
+	defer session.Close()
+
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	fd := int(os.Stdin.Fd())
+
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+
+		//noinspection GoUnhandledErrorResult
+		defer term.Restore(fd, state)
+
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			width, height = 80, 24
+		}
+
+		terminal := os.Getenv("TERM")
+		if terminal == "" {
+			terminal = "xterm"
+		}
+
+		modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+
+		err = session.RequestPty(terminal, height, width, modes)
+		if err != nil {
+			return stateError("Could not get a terminal on the instance: " + err.Error())
+		}
+
+		go forwardWindowChanges(session, fd)
 	}
 
-	if pemFile == "" {
-		pemFile = getPemFile()
+	err = session.Shell()
+	if err != nil {
+		return stateError("Could not start a shell on the instance: " + err.Error())
 	}
 
-	args := []string{"ssh", "-i", pemFile, "ec2-user@" + *instance.PublicIpAddress}
-	env := os.Environ()
-	execErr := syscall.Exec(path, args, env)
+	return remoteExitStatus(session.Wait(), "Login")
+}
+
+// forwardWindowChanges tells the remote terminal when the local one is resized.
+func forwardWindowChanges(session *ssh.Session, fd int) {
+	changes := make(chan os.Signal, 1)
+	signal.Notify(changes, syscall.SIGWINCH)
 
-	if execErr != nil {
-		errState(execErr.Error())
+	for range changes {
+		width, height, err := term.GetSize(fd)
+		if err == nil {
+			//noinspection GoUnhandledErrorResult
+			session.WindowChange(height, width)
+		}
 	}
 }
 
-func Ssh(instance *ec2.Instance, pemFile string, commands []string) {
-	path, err := exec.LookPath("ssh")
+func Ssh(instance *ec2.Instance, pemFile string, commands []string) error {
+	if len(commands) == 0 {
+		return usageError("A command to execute must be given")
+	}
 
-	if err != nil {
-		errUsage("Could not find binary 'ssh' in path")
+	return remoteExitStatus(runRemoteCommand(instance, pemFile, strings.Join(commands, " "), os.Stdout, os.Stderr, nil), "Command")
+}
+
+// runRemoteCommand runs the command on the instance over the transport given
+// by -transport, see runCommand.
+func runRemoteCommand(instance *ec2.Instance, pemFile, command string, stdout, stderr io.Writer, cancel <-chan struct{}) error {
+	if transport != transportSsm {
+		return runCommand(instance, pemFile, command, stdout, stderr, cancel)
 	}
 
-	var arguments []string
-	arguments = append(arguments, "-i", pemFile, "ec2-user@"+*instance.PublicIpAddress)
-	arguments = append(arguments, commands...)
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
 
-	doExec(path, arguments, true)
+	return runSsmCommand(clients.Ssm, instance, command, stdout, stderr, cancel)
 }
 
-func Scp(instance *ec2.Instance, pemFile string, commands []string) {
-	path, err := exec.LookPath("scp")
+// runCommand runs the command on the instance, writing its output as it comes.
+// Closing cancel disconnects from the instance. Connection failures are
+// returned as command errors, while the result of the command itself is
+// returned as is, e.g. an *ssh.ExitError.
+func runCommand(instance *ec2.Instance, pemFile, command string, stdout, stderr io.Writer, cancel <-chan struct{}) error {
+	client, err := dialInstance(instance, pemFile)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer client.Close()
 
+	session, err := client.NewSession()
 	if err != nil {
-		errUsage("Could not find binary 'scp' in path")
+		return stateError("Could not open SSH session: " + err.Error())
 	}
 
-	if len(commands) != 1 {
-		errUsage("The Scp command requires 1 parameter")
+	//noinspection GoUnhandledErrorResult
+	defer session.Close()
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	defer closeOnCancel(client, cancel)()
+
+	return session.Run(command)
+}
+
+// closeOnCancel closes the connection when cancel is closed, until the returned
+// function is called.
+func closeOnCancel(connection io.Closer, cancel <-chan struct{}) func() {
+	finished := make(chan struct{})
+
+	if cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				//noinspection GoUnhandledErrorResult
+				connection.Close()
+			case <-finished:
+			}
+		}()
 	}
 
-	var arguments []string
-	rflag := ""
+	return func() { close(finished) }
+}
+
+// exitStatusError is an error carrying the exit status of a remote command,
+// like *ssh.ExitError
+type exitStatusError interface {
+	error
+	ExitStatus() int
+}
 
+// remoteExitStatus turns the result of a remote command into an error that
+// ends the process with the exit status of the command.
+func remoteExitStatus(err error, what string) error {
+	if err == nil {
+		return nil
+	}
+
+	// Failures to connect already have their exit code
+	if _, ok := err.(*commandError); ok {
+		return err
+	}
+
+	if exitErr, ok := err.(exitStatusError); ok {
+		return remoteError(exitErr.ExitStatus(), what+" exited with status "+strconv.Itoa(exitErr.ExitStatus()))
+	}
+
+	return stateError(what + " failed: " + err.Error())
+}
+
+// Scp copies the remote paths, which may be patterns, from the instance to a
+// directory of its own below -output, or below ~/.writer-tool with a timestamp.
+// Each file copied is reported to progress.
+func Scp(instance *ec2.Instance, pemFile string, paths []string, progress io.Writer, cancel <-chan struct{}) error {
+	dir, err := createInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+
+	if transport == transportSsm {
+		clients, err := getClients()
+		if err != nil {
+			return err
+		}
+
+		return ssmScp(clients.Ssm, instance, paths, dir, progress, cancel)
+	}
+
+	// The remote scp is run in source mode, sending the files to us
+	remoteCommand := "scp -f -p "
 	if recursive {
-		rflag = "-r"
+		remoteCommand += "-r "
 	}
 
+	return runScp(instance, pemFile, remoteCommand+strings.Join(paths, " "), cancel,
+		func(in *bufio.Reader, out io.Writer) error {
+			return receiveFiles(in, out, dir, progress)
+		})
+}
+
+// createInstanceDir creates the directory that files copied from the instance
+// are written to.
+func createInstanceDir(instance *ec2.Instance) (string, error) {
 	name := getName(instance.Tags) + "-" + *instance.InstanceId
-	arguments = append(arguments, "-i", pemFile, rflag, "-p", "ec2-user@"+*instance.PublicIpAddress+":"+commands[0])
 
 	if output == "" {
-		arguments = append(arguments, CreateDirUsingServerPathWithDate(name))
-	} else {
-		mode := GetFileMode(output)
-		if !mode.IsDir() {
-			errUsage("Output '" + output + "' must be directory")
+		return CreateDirUsingServerPathWithDate(name)
+	}
+
+	mode, err := GetFileMode(output)
+	if err != nil {
+		return "", err
+	}
+
+	if !mode.IsDir() {
+		return "", usageError("Output '" + output + "' must be directory")
+	}
+
+	return CreateDir(output, name)
+}
+
+// runScp starts scp on the instance with the remote command, and has transfer
+// talk the scp protocol with it.
+func runScp(instance *ec2.Instance, pemFile, remoteCommand string, cancel <-chan struct{},
+	transfer func(in *bufio.Reader, out io.Writer) error) error {
+
+	client, err := dialInstance(instance, pemFile)
+	if err != nil {
+		return err
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer client.Close()
+
+	defer closeOnCancel(client, cancel)()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return stateError("Could not open SSH session: " + err.Error())
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer session.Close()
+
+	remoteIn, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	remoteOut, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stdErr bytes.Buffer
+	session.Stderr = &stdErr
+
+	err = session.Start(remoteCommand)
+	if err != nil {
+		return stateError("Could not start scp on the instance: " + err.Error())
+	}
+
+	transferErr := transfer(bufio.NewReader(remoteOut), remoteIn)
+
+	//noinspection GoUnhandledErrorResult
+	remoteIn.Close()
+	waitErr := session.Wait()
+
+	if transferErr != nil {
+		return transferErr
+	}
+
+	if waitErr != nil {
+		message := strings.TrimSpace(stdErr.String())
+		if message == "" {
+			message = waitErr.Error()
+		}
+
+		return stateError(message)
+	}
+
+	return nil
+}
+
+// Times given by a T message, applied to the file or directory that follows
+type scpTimes struct {
+	set              bool
+	modified, access time.Time
+}
+
+// receiveFiles is the sink side of the scp protocol, writing the files sent by
+// the remote scp below dir. Each message from the remote is acknowledged with
+// a zero byte.
+func receiveFiles(in *bufio.Reader, out io.Writer, dir string, progress io.Writer) error {
+	var times scpTimes
+	var dirs []string
+	var dirTimes []scpTimes
+	var warnings []string
+
+	current := dir
+
+	if err := scpAck(out); err != nil {
+		return err
+	}
+
+	for {
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+
+		if err != nil {
+			return stateError("scp: " + err.Error())
+		}
+
+		message := strings.TrimSuffix(line[1:], "\n")
+
+		switch line[0] {
+		case 1:
+			// Warning, e.g. one of several files could not be read
+			warnings = append(warnings, message)
+			continue
+		case 2:
+			return stateError(message)
+		case 'T':
+			times, err = parseScpTimes(message)
+			if err != nil {
+				return err
+			}
+		case 'C':
+			mode, size, name, err := parseScpEntry(message)
+			if err != nil {
+				return err
+			}
+
+			err = scpAck(out)
+			if err != nil {
+				return err
+			}
+
+			path := filepath.Join(current, name)
+
+			err = receiveFile(in, path, mode, size)
+			if err != nil {
+				return err
+			}
+
+			err = setScpTimes(path, times)
+			if err != nil {
+				return err
+			}
+
+			printTransferred(progress, path, size)
+
+			times = scpTimes{}
+		case 'D':
+			mode, _, name, err := parseScpEntry(message)
+			if err != nil {
+				return err
+			}
+
+			current = filepath.Join(current, name)
+
+			err = os.MkdirAll(current, mode|0700)
+			if err != nil {
+				return err
+			}
+
+			dirs = append(dirs, current)
+			dirTimes = append(dirTimes, times)
+			times = scpTimes{}
+		case 'E':
+			if len(dirs) == 0 {
+				return stateError("scp: unexpected end of directory")
+			}
+
+			err = setScpTimes(dirs[len(dirs)-1], dirTimes[len(dirTimes)-1])
+			if err != nil {
+				return err
+			}
+
+			dirs = dirs[:len(dirs)-1]
+			dirTimes = dirTimes[:len(dirTimes)-1]
+			current = filepath.Dir(current)
+		default:
+			return stateError("scp: unexpected message from remote: " + strings.TrimSpace(line))
 		}
 
-		dir := CreateDir(output, name)
-		arguments = append(arguments, dir)
+		err = scpAck(out)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(warnings) > 0 {
+		return stateError(strings.Join(warnings, "\n"))
 	}
 
-	doExec(path, arguments, false)
+	return nil
 }
 
-func doExec(path string, arguments []string, doOutput bool) {
-	cmd := exec.Command(path, arguments...)
+func receiveFile(in *bufio.Reader, path string, mode os.FileMode, size int64) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(file, in, size)
+	closeErr := file.Close()
+
+	if err != nil {
+		return stateError("scp: " + path + ": " + err.Error())
+	}
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	// The file content is followed by a status byte
+	status, err := in.ReadByte()
+	if err != nil {
+		return stateError("scp: " + err.Error())
+	}
+
+	if status != 0 {
+		message, _ := in.ReadString('\n')
+		return stateError(strings.TrimSpace(message))
+	}
 
-	var out, stdErr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stdErr
-	errRun := cmd.Run()
+	return nil
+}
 
-	if errRun != nil {
-		fmt.Println(stdErr.String())
-		os.Exit(1)
+// parseScpEntry parses the "<mode> <size> <name>" of C and D messages.
+func parseScpEntry(message string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(message, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", stateError("scp: invalid entry from remote: " + message)
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", stateError("scp: invalid mode from remote: " + message)
 	}
 
-	if doOutput {
-		fmt.Println(out.String())
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", stateError("scp: invalid size from remote: " + message)
 	}
+
+	// The remote may only name entries inside the directory being written
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return 0, 0, "", stateError("scp: refusing unsafe file name from remote: " + name)
+	}
+
+	return os.FileMode(mode) & os.ModePerm, size, name, nil
+}
+
+// parseScpTimes parses the "<mtime> 0 <atime> 0" of T messages.
+func parseScpTimes(message string) (scpTimes, error) {
+	parts := strings.Fields(message)
+	if len(parts) != 4 {
+		return scpTimes{}, stateError("scp: invalid times from remote: " + message)
+	}
+
+	modified, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return scpTimes{}, stateError("scp: invalid times from remote: " + message)
+	}
+
+	access, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return scpTimes{}, stateError("scp: invalid times from remote: " + message)
+	}
+
+	return scpTimes{set: true, modified: time.Unix(modified, 0), access: time.Unix(access, 0)}, nil
+}
+
+func setScpTimes(path string, times scpTimes) error {
+	if !times.set {
+		return nil
+	}
+
+	return os.Chtimes(path, times.access, times.modified)
+}
+
+func scpAck(out io.Writer) error {
+	_, err := out.Write([]byte{0})
+	return err
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// RemoteResult is the outcome of a command run on one of several targets
+type RemoteResult struct {
+	Id       string
+	Name     string
+	ExitCode int // Exit status of the command, -1 if it didn't run to completion
+	Duration time.Duration
+	Error    string
+}
+
+// remoteTarget is somewhere to run a command, like an instance or the
+// container of a task. Closing cancel stops the command.
+type remoteTarget struct {
+	id   string
+	name string
+	run  func(stdout, stderr io.Writer, cancel <-chan struct{}) error
+}
+
+// SshInstances runs the command on all instances, see runOnTargets.
+func SshInstances(instances []*ec2.Instance, pemFile string, commands []string) error {
+	if len(commands) == 0 {
+		return usageError("A command to execute must be given")
+	}
+
+	// Ask for a passphrase before starting, rather than from several instances at once
+	if transport == transportSsh {
+		if _, err := sshClientConfig(pemFile); err != nil {
+			return err
+		}
+	}
+
+	command := strings.Join(commands, " ")
+
+	var targets []remoteTarget
+	for i := 0; i < len(instances); i++ {
+		instance := instances[i]
+
+		targets = append(targets, remoteTarget{
+			id:   *instance.InstanceId,
+			name: getName(instance.Tags),
+			run: func(stdout, stderr io.Writer, cancel <-chan struct{}) error {
+				return runRemoteCommand(instance, pemFile, command, stdout, stderr, cancel)
+			},
+		})
+	}
+
+	return runOnTargets(targets, "instance")
+}
+
+// runOnTargets runs a command on all targets, -parallel at a time. Each line of
+// output is prefixed with the target it came from, and a summary of exit codes
+// and durations is printed when all are done. With -failFast, the first
+// failure stops the command on the other targets.
+func runOnTargets(targets []remoteTarget, kind string) error {
+	if parallel < 1 {
+		return usageError("-parallel must be at least 1")
+	}
+
+	prefixes := targetPrefixes(targets)
+
+	results := make([]RemoteResult, len(targets))
+	done := make(chan bool, len(targets))
+	slots := make(chan bool, parallel)
+	cancel := make(chan struct{})
+	var cancelOnce sync.Once
+	var outputLock sync.Mutex
+
+	started := 0
+
+	for i := 0; i < len(targets); i++ {
+		results[i] = RemoteResult{Id: targets[i].id, Name: targets[i].name, ExitCode: -1}
+
+		slots <- true
+
+		if isClosed(cancel) {
+			results[i].Error = "Skipped after failure (-failFast)"
+			<-slots
+			continue
+		}
+
+		started++
+
+		go func(index int) {
+			defer func() { <-slots }()
+
+			stdout := &prefixWriter{prefix: prefixes[index], out: os.Stdout, lock: &outputLock}
+			stderr := &prefixWriter{prefix: prefixes[index], out: os.Stderr, lock: &outputLock}
+
+			start := time.Now()
+			err := targets[index].run(stdout, stderr, cancel)
+			results[index].Duration = time.Since(start)
+
+			stdout.Flush()
+			stderr.Flush()
+
+			if exitErr, ok := err.(exitStatusError); ok {
+				results[index].ExitCode = exitErr.ExitStatus()
+			} else if isClosed(cancel) && err != nil {
+				results[index].Error = "Cancelled after failure (-failFast)"
+			} else if err != nil {
+				results[index].Error = err.Error()
+			} else {
+				results[index].ExitCode = 0
+			}
+
+			if results[index].ExitCode != 0 && failFast {
+				cancelOnce.Do(func() { close(cancel) })
+			}
+
+			done <- true
+		}(i)
+	}
+
+	for i := 0; i < started; i++ {
+		<-done
+	}
+
+	err := printRemoteResults(results, kind)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i := 0; i < len(results); i++ {
+		if results[i].ExitCode != 0 {
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("Command failed on %d of %d %ss", failed, len(results), kind)
+	if failed < len(results) {
+		return partialError(message)
+	}
+
+	return stateError(message)
+}
+
+// targetPrefixes returns the output prefix of each target, padded to the same
+// width so that the output lines up.
+func targetPrefixes(targets []remoteTarget) []string {
+	var prefixes []string
+	width := 0
+
+	for i := 0; i < len(targets); i++ {
+		prefix := "[" + targets[i].name + " " + targets[i].id + "]"
+		prefixes = append(prefixes, prefix)
+
+		if len(prefix) > width {
+			width = len(prefix)
+		}
+	}
+
+	for i := 0; i < len(prefixes); i++ {
+		prefixes[i] += strings.Repeat(" ", width-len(prefixes[i])+1)
+	}
+
+	return prefixes
+}
+
+// printRemoteResults prints the summary to stderr, keeping stdout for the
+// output of the command.
+func printRemoteResults(results []RemoteResult, kind string) error {
+	writer := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+
+	//noinspection GoUnhandledErrorResult
+	fmt.Fprintln(writer, "\n"+strings.ToUpper(kind)+"\tNAME\tEXIT\tDURATION\tERROR")
+	for i := 0; i < len(results); i++ {
+		exitCode := "-"
+		if results[i].ExitCode >= 0 {
+			exitCode = strconv.Itoa(results[i].ExitCode)
+		}
+
+		//noinspection GoUnhandledErrorResult
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", results[i].Id, results[i].Name, exitCode,
+			results[i].Duration.Round(time.Millisecond), results[i].Error)
+	}
+
+	return writer.Flush()
+}
+
+func isClosed(channel chan struct{}) bool {
+	select {
+	case <-channel:
+		return true
+	default:
+		return false
+	}
+}
+
+// prefixWriter writes each line prefixed, holding back incomplete lines so that
+// lines from several instances don't get mixed up.
+type prefixWriter struct {
+	prefix  string
+	out     io.Writer
+	lock    *sync.Mutex
+	partial []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+
+		err := w.writeLine(w.partial[:end+1])
+		if err != nil {
+			return 0, err
+		}
+
+		w.partial = w.partial[end+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes what is left of an incomplete last line.
+func (w *prefixWriter) Flush() {
+	if len(w.partial) > 0 {
+		//noinspection GoUnhandledErrorResult
+		w.writeLine(append(w.partial, '\n'))
+		w.partial = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	_, err := w.out.Write(append([]byte(w.prefix), line...))
+	return err
+}
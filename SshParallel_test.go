@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRunOnTargetsFailFastSkipsWithoutBlocking(t *testing.T) {
+	defer func(p int, f bool) { parallel, failFast = p, f }(parallel, failFast)
+	parallel, failFast = 2, true
+
+	// The first target fails once the second has started, so that the failure
+	// is seen before any of the others start
+	secondStarted := make(chan struct{})
+
+	var targets []remoteTarget
+	for i := 0; i < 6; i++ {
+		index := i
+		targets = append(targets, remoteTarget{
+			id:   "i-" + strconv.Itoa(i),
+			name: "target",
+			run: func(stdout, stderr io.Writer, cancel <-chan struct{}) error {
+				if index == 0 {
+					<-secondStarted
+					return errors.New("failed")
+				}
+
+				if index == 1 {
+					close(secondStarted)
+				}
+
+				select {
+				case <-cancel:
+					return errors.New("cancelled")
+				case <-time.After(time.Second):
+					return nil
+				}
+			},
+		})
+	}
+
+	type result struct {
+		summary string
+		err     error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		summary, err := captureStderr(t, func() error { return runOnTargets(targets, "instance") })
+		done <- result{summary, err}
+	}()
+
+	select {
+	case result := <-done:
+		if exitCodeFor(result.err) != exitState {
+			t.Errorf("Expected exit code %d, got %v", exitState, result.err)
+		}
+
+		for i := 0; i < len(targets); i++ {
+			want := "Skipped after failure (-failFast)"
+			switch i {
+			case 0:
+				want = "failed"
+			case 1:
+				want = "Cancelled after failure (-failFast)"
+			}
+
+			line := regexp.MustCompile(`(?m)^` + targets[i].id + ` .*  ` + regexp.QuoteMeta(want) + `$`)
+			if !line.MatchString(result.summary) {
+				t.Errorf("Expected %s to be reported as %q in the summary:\n%s", targets[i].id, want, result.summary)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runOnTargets blocked after skipping targets")
+	}
+}
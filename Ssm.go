@@ -0,0 +1,618 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Transports for ssh, scp, login and execService, selected with -transport
+const (
+	transportSsh = "ssh" // SSH to the public IP of the instance
+	transportSsm = "ssm" // SSM Session Manager and Run Command, needing neither a public IP nor a PEM file
+	transportEcs = "ecs" // ECS Exec into the container of a task, only for execService
+)
+
+// Commands run over SSM are polled with exponential backoff between these
+const ssmMinPollInterval = 250 * time.Millisecond
+const ssmMaxPollInterval = 5 * time.Second
+
+// Characters of output SSM returns for a command, the rest is cut off
+const ssmOutputLimit = 24000
+
+// Bytes of an archive fetched per command by scp over SSM. Base64 encoded they
+// stay below the ssmOutputLimit.
+const ssmChunkSize = 16384
+
+func validateTransport() error {
+	switch transport {
+	case transportSsh, transportSsm, transportEcs:
+		return nil
+	default:
+		return usageError("Unknown transport: " + transport + ", use one of ssh, ssm or ecs")
+	}
+}
+
+// validateInstanceTransport checks that the transport reaches instances, as
+// ECS Exec only reaches containers.
+func validateInstanceTransport() error {
+	if transport == transportEcs {
+		return usageError("-transport ecs is only for execService, use ssh or ssm")
+	}
+
+	return nil
+}
+
+// ssmExitError carries the exit status of a command run through SSM, like
+// *ssh.ExitError does for commands run over SSH.
+type ssmExitError struct {
+	status int
+}
+
+func (e *ssmExitError) Error() string {
+	return "Process exited with status " + strconv.Itoa(e.status)
+}
+
+func (e *ssmExitError) ExitStatus() int {
+	return e.status
+}
+
+// runSsmCommand runs the command on the instance through SSM Run Command. SSM
+// only returns the output when the command is done, so unlike over SSH it is
+// written all at once, and cut off after ssmOutputLimit characters, which is
+// warned about on stderr. Commands with more output write it to a file with
+// ssmCommandToFile, to be fetched with ssmFetch.
+func runSsmCommand(svc ssmiface.SSMAPI, instance *ec2.Instance, command string, stdout, stderr io.Writer, cancel <-chan struct{}) error {
+	invocation, err := ssmCommand(svc, instance, command, cancel)
+	if err != nil {
+		return err
+	}
+
+	output := aws.StringValue(invocation.StandardOutputContent)
+	errorOutput := aws.StringValue(invocation.StandardErrorContent)
+
+	_, err = io.WriteString(stdout, output)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(stderr, errorOutput)
+	if err != nil {
+		return err
+	}
+
+	if utf8.RuneCountInString(output) >= ssmOutputLimit || utf8.RuneCountInString(errorOutput) >= ssmOutputLimit {
+		_, err = fmt.Fprintf(stderr, "\nOutput of the command on instance %s may be cut off, SSM returns at most %d characters "+
+			"of stdout and of stderr. Use -transport ssh to get all of it.\n", *instance.InstanceId, ssmOutputLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ssmResult(invocation)
+}
+
+// ssmResult returns the error for a finished command, which carries the exit
+// status if the command itself failed.
+func ssmResult(invocation *ssm.GetCommandInvocationOutput) error {
+	instanceId := aws.StringValue(invocation.InstanceId)
+
+	switch aws.StringValue(invocation.Status) {
+	case ssm.CommandInvocationStatusSuccess:
+		return nil
+	case ssm.CommandInvocationStatusFailed:
+		return &ssmExitError{status: int(aws.Int64Value(invocation.ResponseCode))}
+	case ssm.CommandInvocationStatusTimedOut:
+		return timeoutError("Command timed out on instance " + instanceId)
+	default:
+		return stateError("Command " + strings.ToLower(aws.StringValue(invocation.Status)) + " on instance " + instanceId + ": " +
+			aws.StringValue(invocation.StatusDetails))
+	}
+}
+
+// ssmCommand sends the shell command to the instance and waits until it is
+// done, or until -timeout has passed. Closing cancel cancels the command.
+func ssmCommand(svc ssmiface.SSMAPI, instance *ec2.Instance, command string, cancel <-chan struct{}) (*ssm.GetCommandInvocationOutput, error) {
+	sent, err := svc.SendCommand(&ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []*string{instance.InstanceId},
+		Parameters:   map[string][]*string{"commands": {aws.String(command)}},
+		Comment:      aws.String("writer-tool"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	commandId := sent.Command.CommandId
+	deadline := time.Now().Add(deploymentTimeout)
+	interval := ssmMinPollInterval
+
+	for {
+		select {
+		case <-cancel:
+			cancelSsmCommand(svc, commandId, instance)
+			return nil, stateError("Command cancelled on instance " + *instance.InstanceId)
+		case <-time.After(interval):
+		}
+
+		invocation, err := svc.GetCommandInvocation(&ssm.GetCommandInvocationInput{
+			CommandId:  commandId,
+			InstanceId: instance.InstanceId,
+		})
+
+		// The invocation shows up once the command has reached the instance
+		if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != ssm.ErrCodeInvocationDoesNotExist {
+			if err != nil {
+				return nil, err
+			}
+
+			switch *invocation.Status {
+			case ssm.CommandInvocationStatusPending, ssm.CommandInvocationStatusInProgress,
+				ssm.CommandInvocationStatusDelayed, ssm.CommandInvocationStatusCancelling:
+			default:
+				return invocation, nil
+			}
+		}
+
+		if time.Now().After(deadline) {
+			cancelSsmCommand(svc, commandId, instance)
+			return nil, timeoutError("Command did not finish on instance " + *instance.InstanceId + " within " + deploymentTimeout.String())
+		}
+
+		interval *= 2
+		if interval > ssmMaxPollInterval {
+			interval = ssmMaxPollInterval
+		}
+	}
+}
+
+func cancelSsmCommand(svc ssmiface.SSMAPI, commandId *string, instance *ec2.Instance) {
+	_, err := svc.CancelCommand(&ssm.CancelCommandInput{
+		CommandId:   commandId,
+		InstanceIds: []*string{instance.InstanceId},
+	})
+
+	if err != nil && verbose {
+		fmt.Fprintln(os.Stderr, "Could not cancel command on instance "+*instance.InstanceId+": "+err.Error())
+	}
+}
+
+// SsmLogin starts a Session Manager session on the instance and hands it over
+// to the session-manager-plugin, like the AWS CLI does.
+func SsmLogin(instance *ec2.Instance) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	path, args, err := sessionManagerPlugin(clients.Region, map[string]string{"Target": *instance.InstanceId}, "ssm", func() (interface{}, error) {
+		return clients.Ssm.StartSession(&ssm.StartSessionInput{Target: instance.InstanceId})
+	})
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// sessionManagerPlugin starts a session with start, once the session-manager-plugin
+// is found, and returns the path of the plugin and the arguments, starting with
+// its name, that hand the session over to it. The endpoint is the one given by
+// -endpoint, or else the one of the api, ssm or ecs, in the region.
+func sessionManagerPlugin(region string, parameters interface{}, api string, start func() (interface{}, error)) (string, []string, error) {
+	path, err := exec.LookPath("session-manager-plugin")
+	if err != nil {
+		return "", nil, usageError("Could not find binary 'session-manager-plugin' in path, see " +
+			"https://docs.aws.amazon.com/systems-manager/latest/userguide/session-manager-working-with-install-plugin.html")
+	}
+
+	session, err := start()
+	if err != nil {
+		return "", nil, err
+	}
+
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return "", nil, err
+	}
+
+	parametersJson, err := json.Marshal(parameters)
+	if err != nil {
+		return "", nil, err
+	}
+
+	pluginEndpoint := endpoint
+	if pluginEndpoint == "" {
+		pluginEndpoint = "https://" + api + "." + region + ".amazonaws.com"
+	}
+
+	args := []string{"session-manager-plugin", string(sessionJson), region, "StartSession", profile, string(parametersJson), pluginEndpoint}
+
+	return path, args, nil
+}
+
+// ssmScp copies the remote paths to dir over SSM, which has no file transfer of
+// its own. The files of each path are put in a tar archive on the instance,
+// which is then fetched base64 encoded in chunks small enough for the output of
+// a command.
+func ssmScp(svc ssmiface.SSMAPI, instance *ec2.Instance, remotePaths []string, dir string, progress io.Writer, cancel <-chan struct{}) error {
+	for i := 0; i < len(remotePaths); i++ {
+		err := ssmFetch(svc, instance, remotePaths[i], dir, progress, cancel)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ssmFetch(svc ssmiface.SSMAPI, instance *ec2.Instance, remotePath, dir string, progress io.Writer, cancel <-chan struct{}) error {
+	archive, size, err := ssmCreateArchive(svc, instance, remotePath)
+	if err != nil {
+		return err
+	}
+
+	defer ssmRemove(svc, instance, archive)
+
+	var content bytes.Buffer
+
+	for offset := int64(0); offset < size; offset += ssmChunkSize {
+		command := fmt.Sprintf("dd if=%s bs=%d skip=%d count=1 2>/dev/null | base64 | tr -d '\\n'", archive, ssmChunkSize, offset/ssmChunkSize)
+
+		invocation, err := ssmCommand(svc, instance, command, cancel)
+		if err != nil {
+			return err
+		}
+
+		err = ssmResult(invocation)
+		if err != nil {
+			return remoteExitStatus(err, "Fetching archive")
+		}
+
+		chunk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(aws.StringValue(invocation.StandardOutputContent)))
+		if err != nil {
+			return stateError("Invalid archive chunk from instance: " + err.Error())
+		}
+
+		content.Write(chunk)
+	}
+
+	if int64(content.Len()) != size {
+		return stateError(fmt.Sprintf("Fetched %d bytes of archive from instance, expected %d", content.Len(), size))
+	}
+
+	return extractArchive(&content, dir, progress)
+}
+
+// ssmScpTo copies the local files to the remote directory over SSM, like
+// ssmScp the other way around. The files are put in a tar archive that is sent
+// base64 encoded in chunks, appended to a file on the instance and extracted.
+func ssmScpTo(svc ssmiface.SSMAPI, instance *ec2.Instance, files []string, remoteDir string, progress io.Writer, cancel <-chan struct{}) error {
+	content, err := createArchive(files)
+	if err != nil {
+		return err
+	}
+
+	archive, err := ssmMktemp(svc, instance, "", cancel)
+	if err != nil {
+		return err
+	}
+
+	defer ssmRemove(svc, instance, archive)
+
+	data := content.Bytes()
+
+	for offset := 0; offset < len(data); offset += ssmChunkSize {
+		end := offset + ssmChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		command := "printf %s " + base64.StdEncoding.EncodeToString(data[offset:end]) + " | base64 -d >> " + archive
+
+		invocation, err := ssmCommand(svc, instance, command, cancel)
+		if err != nil {
+			return err
+		}
+
+		err = ssmResult(invocation)
+		if err != nil {
+			return remoteExitStatus(err, "Sending archive")
+		}
+	}
+
+	script := "set -e\n" +
+		"if [ ! -d " + remoteDir + " ]; then echo \"scp: " + remoteDir + ": No such directory\" >&2; exit 1; fi\n" +
+		"tar -xzpf " + archive + " -C " + remoteDir
+
+	invocation, err := ssmCommand(svc, instance, script, cancel)
+	if err != nil {
+		return err
+	}
+
+	err = ssmResult(invocation)
+	if err != nil {
+		message := strings.TrimSpace(aws.StringValue(invocation.StandardErrorContent))
+		if message == "" {
+			return remoteExitStatus(err, "Extracting archive")
+		}
+
+		return stateError(message)
+	}
+
+	for i := 0; i < len(files); i++ {
+		err = filepath.Walk(files[i], func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				printTransferred(progress, path, info.Size())
+			}
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ssmCreateArchive archives the remote path, which like with scp may be a
+// pattern, and returns the name and size of the archive. Directories are only
+// archived with -recursive.
+func ssmCreateArchive(svc ssmiface.SSMAPI, instance *ec2.Instance, remotePath string) (string, int64, error) {
+	dir, base := path.Split(remotePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	notRegular := ""
+	if !recursive {
+		notRegular = `if [ -d "$f" ]; then echo "scp: $f: not a regular file" >&2; exit 1; fi; `
+	}
+
+	script := "set -e\n" +
+		"cd " + dir + "\n" +
+		`for f in ` + base + `; do if [ ! -e "$f" ]; then echo "scp: ` + remotePath + `: No such file or directory" >&2; exit 1; fi; ` + notRegular + "done\n" +
+		"archive=$(mktemp)\n" +
+		`tar -czhf "$archive" ` + base + "\n" +
+		`echo "$archive $(wc -c < "$archive")"`
+
+	invocation, err := ssmCommand(svc, instance, script, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = ssmResult(invocation)
+	if err != nil {
+		message := strings.TrimSpace(aws.StringValue(invocation.StandardErrorContent))
+		if message == "" {
+			return "", 0, remoteExitStatus(err, "Archiving "+remotePath)
+		}
+
+		return "", 0, stateError(message)
+	}
+
+	fields := strings.Fields(aws.StringValue(invocation.StandardOutputContent))
+	if len(fields) != 2 {
+		return "", 0, stateError("Unexpected output when archiving " + remotePath + ": " + aws.StringValue(invocation.StandardOutputContent))
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", 0, stateError("Unexpected archive size when archiving " + remotePath + ": " + fields[1])
+	}
+
+	return fields[0], size, nil
+}
+
+// ssmMktemp creates a temporary file on the instance, or a directory given the
+// option -d, and returns its name.
+func ssmMktemp(svc ssmiface.SSMAPI, instance *ec2.Instance, options string, cancel <-chan struct{}) (string, error) {
+	invocation, err := ssmCommand(svc, instance, strings.TrimSpace("mktemp "+options), cancel)
+	if err != nil {
+		return "", err
+	}
+
+	err = ssmResult(invocation)
+	if err != nil {
+		return "", remoteExitStatus(err, "Creating temporary file")
+	}
+
+	name := strings.TrimSpace(aws.StringValue(invocation.StandardOutputContent))
+	if name == "" || strings.ContainsAny(name, " \n") {
+		return "", stateError("Unexpected output when creating temporary file: " + aws.StringValue(invocation.StandardOutputContent))
+	}
+
+	return name, nil
+}
+
+// ssmCommandToFile runs the command on the instance with its output written
+// to the file there, which unlike the output SSM returns isn't cut off.
+func ssmCommandToFile(svc ssmiface.SSMAPI, instance *ec2.Instance, command, file string, cancel <-chan struct{}) error {
+	invocation, err := ssmCommand(svc, instance, "("+command+") > "+file+" 2>&1", cancel)
+	if err != nil {
+		return err
+	}
+
+	return ssmResult(invocation)
+}
+
+// ssmRemove removes the file or directory from the instance.
+func ssmRemove(svc ssmiface.SSMAPI, instance *ec2.Instance, path string) {
+	invocation, err := ssmCommand(svc, instance, "rm -rf "+path, nil)
+	if err == nil {
+		err = ssmResult(invocation)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not remove "+path+" from instance "+*instance.InstanceId+": "+err.Error())
+	}
+}
+
+// extractArchive writes the files and directories in the gzipped tar archive
+// below dir, keeping modes and modification times. Entries that would end up
+// outside dir are refused, and other entry types are skipped. Each file
+// written is reported to progress.
+func extractArchive(reader io.Reader, dir string, progress io.Writer) error {
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return stateError("Invalid archive from instance: " + err.Error())
+	}
+
+	archive := tar.NewReader(gzipReader)
+
+	var dirs []*tar.Header
+
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return stateError("Invalid archive from instance: " + err.Error())
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return stateError("Refusing unsafe file name from instance: " + header.Name)
+		}
+
+		target := filepath.Join(dir, name)
+		mode := os.FileMode(header.Mode) & os.ModePerm
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+			if err != nil {
+				return err
+			}
+
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err != nil {
+				return err
+			}
+
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(file, archive)
+			closeErr := file.Close()
+
+			if err != nil {
+				return err
+			}
+
+			if closeErr != nil {
+				return closeErr
+			}
+
+			err = os.Chtimes(target, header.ModTime, header.ModTime)
+			if err != nil {
+				return err
+			}
+
+			printTransferred(progress, target, header.Size)
+		}
+	}
+
+	// Directory times are set last, as writing the files changes them
+	for i := 0; i < len(dirs); i++ {
+		target := filepath.Join(dir, filepath.Clean(filepath.FromSlash(dirs[i].Name)))
+
+		err = os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createArchive puts the local files, and the directories with everything
+// below them, in a gzipped tar archive, named relative to their parent.
+func createArchive(files []string) (*bytes.Buffer, error) {
+	var content bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&content)
+	archive := tar.NewWriter(gzipWriter)
+
+	for i := 0; i < len(files); i++ {
+		base := filepath.Dir(files[i])
+
+		err := filepath.Walk(files[i], func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+
+			name, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+
+			header.Name = filepath.ToSlash(name)
+
+			err = archive.WriteHeader(header)
+			if err != nil || info.IsDir() {
+				return err
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			//noinspection GoUnhandledErrorResult
+			defer file.Close()
+
+			_, err = io.Copy(archive, file)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	err = gzipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &content, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+	"testing"
+)
+
+func TestRunSsmCommandWarnsWhenOutputIsCutOff(t *testing.T) {
+	tests := []struct {
+		name   string
+		stdout string
+		stderr string
+		warned bool
+	}{
+		{name: "short output", stdout: "up 3 days\n"},
+		{name: "stdout at the limit", stdout: strings.Repeat("x", ssmOutputLimit), warned: true},
+		{name: "stderr at the limit", stderr: strings.Repeat("x", ssmOutputLimit), warned: true},
+		{name: "multibyte stdout below the limit", stdout: strings.Repeat("å", ssmOutputLimit-1)},
+	}
+
+	instance := &ec2.Instance{InstanceId: aws.String("i-1")}
+
+	for i := 0; i < len(tests); i++ {
+		test := tests[i]
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			err := runSsmCommand(&fakeSsm{stdout: test.stdout, stderr: test.stderr}, instance, "uptime", &stdout, &stderr, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if stdout.String() != test.stdout {
+				t.Errorf("stdout has %d characters, want %d", stdout.Len(), len(test.stdout))
+			}
+
+			warned := strings.Contains(stderr.String(), "Output of the command on instance i-1 may be cut off")
+			if warned != test.warned {
+				t.Errorf("warned = %t, want %t", warned, test.warned)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time between keepalives sent to the instance, so that an idle tunnel is not
+// dropped along the way, and a dead one is noticed
+const tunnelKeepAlive = 30 * time.Second
+
+// Session Manager document forwarding a local port to a host reachable from the instance
+const ssmPortForwardDocument = "AWS-StartPortForwardingSessionToRemoteHost"
+
+// Tunnel forwards a local port to the host and port given by -remote, as seen
+// from the first running of the instances, until interrupted. Over SSH the
+// connection to the instance is made again when it's lost.
+func Tunnel(instances []*ec2.Instance, pemFile string) error {
+	host, port, err := parseTunnelRemote()
+	if err != nil {
+		return err
+	}
+
+	instance, err := firstRunningInstance(instances)
+	if err != nil {
+		return err
+	}
+
+	local := localPort
+	if local == 0 {
+		local = port
+	}
+
+	if local < 1 || local > 65535 {
+		return usageError("-localPort must be between 1 and 65535")
+	}
+
+	remote := net.JoinHostPort(host, strconv.Itoa(port))
+
+	if transport == transportSsm {
+		return ssmTunnel(instance, host, port, local)
+	}
+
+	tunnel := &sshTunnel{instance: instance, pemFile: pemFile, remote: remote}
+
+	// Connect up front, so that problems are reported before anyone uses the tunnel
+	_, err = tunnel.client()
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(local)))
+	if err != nil {
+		return stateError("Could not listen on local port " + strconv.Itoa(local) + ": " + err.Error())
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-interrupts
+
+		//noinspection GoUnhandledErrorResult
+		listener.Close()
+	}()
+
+	fmt.Printf("Forwarding localhost:%d to %s through %s %s, press Ctrl-C to stop\n", local, remote,
+		getName(instance.Tags), *instance.InstanceId)
+
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			tunnel.close()
+			return nil
+		}
+
+		go tunnel.forward(connection)
+	}
+}
+
+// parseTunnelRemote parses -remote, which is host:port, or only a port on the
+// instance itself.
+func parseTunnelRemote() (string, int, error) {
+	if remoteAddress == "" {
+		return "", 0, usageError("The host and port to forward to must be given with -remote, e.g. -remote localhost:8080")
+	}
+
+	host, portText, err := net.SplitHostPort(remoteAddress)
+	if err != nil {
+		host, portText = "localhost", remoteAddress
+	}
+
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, usageError("Invalid -remote " + remoteAddress + ", expected host:port or port")
+	}
+
+	return host, port, nil
+}
+
+func firstRunningInstance(instances []*ec2.Instance) (*ec2.Instance, error) {
+	for i := 0; i < len(instances); i++ {
+		if instances[i].State == nil || aws.StringValue(instances[i].State.Name) == ec2.InstanceStateNameRunning {
+			return instances[i], nil
+		}
+	}
+
+	return nil, stateError("None of the instances is running")
+}
+
+// sshTunnel forwards connections to the remote address over an SSH connection
+// to the instance, which is made on demand.
+type sshTunnel struct {
+	instance *ec2.Instance
+	pemFile  string
+	remote   string
+
+	lock       sync.Mutex
+	connection *ssh.Client
+}
+
+// client returns the connection to the instance, connecting if there is none.
+func (t *sshTunnel) client() (*ssh.Client, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.connection != nil {
+		return t.connection, nil
+	}
+
+	client, err := dialInstance(t.instance, t.pemFile)
+	if err != nil {
+		return nil, err
+	}
+
+	t.connection = client
+
+	go t.keepAlive(client)
+
+	go func() {
+		err := client.Wait()
+
+		t.lock.Lock()
+		if t.connection == client {
+			t.connection = nil
+			fmt.Fprintln(os.Stderr, "Lost connection to "+*t.instance.InstanceId+", reconnecting on next use: "+fmt.Sprint(err))
+		}
+		t.lock.Unlock()
+	}()
+
+	return client, nil
+}
+
+func (t *sshTunnel) keepAlive(client *ssh.Client) {
+	ticker := time.NewTicker(tunnelKeepAlive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err != nil {
+			//noinspection GoUnhandledErrorResult
+			client.Close()
+			return
+		}
+	}
+}
+
+func (t *sshTunnel) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.connection != nil {
+		//noinspection GoUnhandledErrorResult
+		t.connection.Close()
+		t.connection = nil
+	}
+}
+
+// forward copies between the local connection and a new connection to the
+// remote address, until either side closes.
+func (t *sshTunnel) forward(local net.Conn) {
+	//noinspection GoUnhandledErrorResult
+	defer local.Close()
+
+	client, err := t.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return
+	}
+
+	remote, err := client.Dial("tcp", t.remote)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not connect to "+t.remote+" from "+*t.instance.InstanceId+": "+err.Error())
+		return
+	}
+
+	//noinspection GoUnhandledErrorResult
+	defer remote.Close()
+
+	if verbose {
+		fmt.Fprintln(os.Stderr, "Forwarding connection from "+local.RemoteAddr().String())
+	}
+
+	done := make(chan bool, 2)
+
+	go func() {
+		//noinspection GoUnhandledErrorResult
+		io.Copy(remote, local)
+		done <- true
+	}()
+
+	go func() {
+		//noinspection GoUnhandledErrorResult
+		io.Copy(local, remote)
+		done <- true
+	}()
+
+	<-done
+}
+
+// ssmTunnel starts a port forwarding session through the instance and hands it
+// over to the session-manager-plugin, which listens on the local port.
+func ssmTunnel(instance *ec2.Instance, host string, port, local int) error {
+	clients, err := getClients()
+	if err != nil {
+		return err
+	}
+
+	parameters := map[string][]*string{
+		"host":            {aws.String(host)},
+		"portNumber":      {aws.String(strconv.Itoa(port))},
+		"localPortNumber": {aws.String(strconv.Itoa(local))},
+	}
+
+	pluginParameters := map[string]interface{}{
+		"Target":       *instance.InstanceId,
+		"DocumentName": ssmPortForwardDocument,
+		"Parameters":   parameters,
+	}
+
+	path, args, err := sessionManagerPlugin(clients.Region, pluginParameters, "ssm", func() (interface{}, error) {
+		return clients.Ssm.StartSession(&ssm.StartSessionInput{
+			Target:       instance.InstanceId,
+			DocumentName: aws.String(ssmPortForwardDocument),
+			Parameters:   parameters,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Forwarding localhost:%d to %s through %s %s, press Ctrl-C to stop\n", local,
+		net.JoinHostPort(host, strconv.Itoa(port)), getName(instance.Tags), *instance.InstanceId)
+
+	return syscall.Exec(path, args, os.Environ())
+}
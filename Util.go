@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"os"
 	"os/user"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,65 +19,98 @@ func buildPath(pathElement ...string) string {
 	return strings.Join(pathElement[:], ""+string(os.PathSeparator))
 }
 
-func getSessionAndConfigForParams(paramProfile string, paramRegion string) (*session.Session, *aws.Config) {
+// getSessionAndConfigForParams creates a session for the profile, or for the
+// default credential chain if no profile is given, and a config for the region
+// and the role to assume.
+func getSessionAndConfigForParams(paramProfile, paramRegion, paramRoleArn string) (*session.Session, *aws.Config, error) {
 	var sess *session.Session
 	var cfg *aws.Config
+	var err error
 
 	if verbose {
 		fmt.Printf(
-			"Get session and config using profile \"%s\" and region \"%s\"\n",
-			paramProfile, paramRegion,
+			"Get session and config using profile \"%s\", region \"%s\" and role \"%s\"\n",
+			paramProfile, paramRegion, paramRoleArn,
 		)
 	}
 
-	if paramProfile == "" {
-		errUsage("Invalid request. Missing explicit parameter for profile")
+	// The fake endpoint needs no credentials, so there is no need for the profile to exist
+	if paramProfile != "" && !fakeEndpoint {
+		sess, err = session.NewSessionWithOptions(session.Options{
+			SharedConfigState: session.SharedConfigEnable,
+			Profile:           paramProfile,
+		})
+	} else {
+		sess, err = session.NewSession()
 	}
 
-	sess = session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Profile:           paramProfile,
-	}))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if recordFile != "" {
+		sess.Handlers.Send.PushBack(recordResponse)
+	}
 
 	if paramRegion != "" {
 		cfg = &aws.Config{Region: aws.String(paramRegion)}
 	}
 
-	return sess, cfg
+	return sess, withAssumedRole(sess, withEndpoint(cfg), paramProfile, paramRoleArn), nil
 }
 
-func getSessionAndConfig() (*session.Session, *aws.Config) {
-	var sess *session.Session
-	var cfg *aws.Config
-
-	if verbose {
-		fmt.Printf(
-			"Get session and config using profile \"%s\" and region \"%s\"\n",
-			profile, region,
-		)
+// Credentials for assumed roles, shared between sessions so that each role is
+// only assumed (and the MFA token only asked for) once per run.
+var assumedRoles = make(map[string]*credentials.Credentials)
+var assumedRolesLock sync.Mutex
+
+// withAssumedRole returns a config using temporary credentials for the role,
+// obtained through STS with the session's own credentials. The config is
+// returned untouched if no role is given.
+func withAssumedRole(sess *session.Session, cfg *aws.Config, paramProfile, paramRoleArn string) *aws.Config {
+	if paramRoleArn == "" {
+		return cfg
 	}
 
-	if profile != "" {
-		sess = session.Must(session.NewSessionWithOptions(session.Options{
-			SharedConfigState: session.SharedConfigEnable,
-			Profile:           profile,
-		}))
-	} else {
-		sess = session.Must(session.NewSession())
+	if cfg == nil {
+		cfg = &aws.Config{}
 	}
 
-	if region != "" {
-		cfg = &aws.Config{Region: aws.String(region)}
+	assumedRolesLock.Lock()
+	defer assumedRolesLock.Unlock()
+
+	key := paramProfile + "|" + paramRoleArn
+	creds, exists := assumedRoles[key]
+
+	if !exists {
+		if verbose {
+			fmt.Printf("Assuming role \"%s\" with session name \"%s\"\n", paramRoleArn, roleSessionName)
+		}
+
+		creds = stscreds.NewCredentials(sess.Copy(cfg), paramRoleArn, func(provider *stscreds.AssumeRoleProvider) {
+			provider.RoleSessionName = roleSessionName
+
+			if externalId != "" {
+				provider.ExternalID = aws.String(externalId)
+			}
+
+			if mfaSerial != "" {
+				provider.SerialNumber = aws.String(mfaSerial)
+				provider.TokenProvider = stscreds.StdinTokenProvider
+			}
+		})
+		assumedRoles[key] = creds
 	}
 
-	return sess, cfg
+	cfg.Credentials = creds
+	return cfg
 }
 
-func createDirFromToolkitPath(elements ...string) string {
+func createDirFromToolkitPath(elements ...string) (string, error) {
 	currUser, err := user.Current()
 
 	if err != nil {
-		errUsage("Error looking up current user")
+		return "", stateError("Error looking up current user")
 	}
 
 	var targetPath []string
@@ -85,46 +121,119 @@ func createDirFromToolkitPath(elements ...string) string {
 	err = os.MkdirAll(path, 0755)
 
 	if err != nil {
-		errUsage(fmt.Sprintf("Problem creating dir [%s]", targetPath))
+		return "", stateError(fmt.Sprintf("Problem creating dir [%s]", targetPath))
 	}
 
-	return path
+	return path, nil
 }
 
-func CreateDirUsingServerPathWithDate(server string) string {
+func CreateDirUsingServerPathWithDate(server string) (string, error) {
 	timestamp := time.Now().Format("20060102-150405")
 
 	return createDirFromToolkitPath(server, timestamp)
 }
 
-func CreateDir(source, target string) string {
+func CreateDir(source, target string) (string, error) {
 	path := buildPath(source, target)
 	err := os.MkdirAll(path, 0755)
 
 	if err != nil {
-		errUsage(fmt.Sprintf("Problem creating dir [%s]", path))
+		return "", stateError(fmt.Sprintf("Problem creating dir [%s]", path))
 	}
 
-	return path
+	return path, nil
 }
 
-func GetFileMode(path string) os.FileMode {
+func GetFileMode(path string) (os.FileMode, error) {
 	f, err := os.Open(path)
-	assertError(err)
+	if err != nil {
+		return 0, err
+	}
 
 	//noinspection GoUnhandledErrorResult
 	defer f.Close()
 
 	fi, err := f.Stat()
-	assertError(err)
+	if err != nil {
+		return 0, err
+	}
 
-	return fi.Mode()
+	return fi.Mode(), nil
 }
 
-func getPemFile() string {
+func getPemFile() (string, error) {
 	if profile != "" {
 		return getPemfileFromProfile(profile)
 	}
 
-	return ""
+	return "", nil
+}
+
+// diffLines compares two texts line by line and returns the changed lines
+// prefixed with "- " or "+ ", surrounded by a few unchanged lines of context.
+func diffLines(from, to string) []string {
+	const contextLines = 2
+
+	a := strings.Split(from, "\n")
+	b := strings.Split(to, "\n")
+
+	// Longest common subsequence lengths for the suffixes of a and b
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []string
+	var changed []bool
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		if i < len(a) && j < len(b) && a[i] == b[j] {
+			lines = append(lines, "  "+a[i])
+			changed = append(changed, false)
+			i++
+			j++
+		} else if i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]) {
+			lines = append(lines, "- "+a[i])
+			changed = append(changed, true)
+			i++
+		} else {
+			lines = append(lines, "+ "+b[j])
+			changed = append(changed, true)
+			j++
+		}
+	}
+
+	var result []string
+	lastIncluded := -1
+
+	for n := 0; n < len(lines); n++ {
+		include := false
+		for m := n - contextLines; m <= n+contextLines; m++ {
+			if m >= 0 && m < len(lines) && changed[m] {
+				include = true
+				break
+			}
+		}
+
+		if include {
+			if lastIncluded != -1 && n-lastIncluded > 1 {
+				result = append(result, "...")
+			}
+			result = append(result, lines[n])
+			lastIncluded = n
+		}
+	}
+
+	return result
 }
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 // Build version variables
@@ -18,14 +19,22 @@ var appVersion string
 var cluster, command, containerName, instanceId, instanceName, service, sshPem,
 output, profile, version, loadBalancer, reportJson, releaseDate, reportTemplate,
 runtime, functionName, alias, bucket, filename, publish, updatesFile,
-dependenciesFile, login, region, password, roleArn string
+dependenciesFile, login, region, password, roleArn, roleSessionName, externalId,
+mfaSerial, healthCheckUrl, healthCheckBody, environmentName, outputFormat,
+endpoint, recordFile, sshUser, knownHostsFile, hostKeyCheck, transport, bastion,
+target, remoteAddress, filter, columnNames string
 
-var recursive, verbose, moreVerbose bool
+var recursive, verbose, moreVerbose, dryRun, failFast, zipDiagnostics bool
 var verboseLevel = 0
 var maxResult int64
+var healthCheckStatus, healthCheckCount, parallel, threadDumps, logLines, localPort int
+var healthCheckInterval, deploymentTimeout, pollInterval, threadDumpInterval time.Duration
+
+// Upper limit for the exponential backoff when polling for deployments
+const maxPollInterval = 30 * time.Second
 
 func init() {
-	flag.Int64Var(&maxResult, "maxResults", 100, "Max items to return in list operations")
+	flag.Int64Var(&maxResult, "maxResults", 100, "Max items to return in list operations, 0 for no limit")
 	flag.StringVar(&alias, "alias", "", "Lambda alias")
 	flag.StringVar(&bucket, "s3bucket", "", "The S3 bucket name.")
 	flag.StringVar(&containerName, "containerName", "", "The name of the container inside a task definition.")
@@ -36,16 +45,33 @@ func init() {
 	flag.StringVar(&functionName, "functionName", "", "Lambda function name")
 	flag.StringVar(&runtime, "runtime", "", "Runtime for lambda function, see: https://docs.aws.amazon.com/cli/latest/reference/lambda/update-function-configuration.html. Example: 'nodejs8.10'")
 	flag.StringVar(&instanceId, "instanceId", "", "Specify the EC2 instance")
-	flag.StringVar(&instanceName, "instanceName", "", "Specify the EC2 instance(s) name")
+	flag.StringVar(&instanceName, "instanceName", "", "Specify the EC2 instance(s) name, which may contain the wildcards * and ?")
+	flag.StringVar(&filter, "filter", "", "Select EC2 instances with filters like tag:Team=editor,instance-state-name=stopped, see the Filters of https://docs.aws.amazon.com/AWSEC2/latest/APIReference/API_DescribeInstances.html")
+	flag.StringVar(&columnNames, "columns", "", "Columns to list with listEc2Instances, comma separated from id, name, state, public-ip, private-ip, type, az, launch-time, ami and cluster")
 	flag.StringVar(&service, "service", "", "Specify ECS service")
 	flag.StringVar(&sshPem, "pemfile", "", "Specify PEM file for SSH access")
 	flag.StringVar(&sshPem, "i", "", "Specify PEM file for SSH access")
+	flag.StringVar(&sshUser, "sshUser", "ec2-user", "User to log in as on instances over SSH")
+	flag.StringVar(&knownHostsFile, "knownHosts", "", "Known hosts file used to verify instance host keys, default ~/.ssh/known_hosts")
+	flag.StringVar(&hostKeyCheck, "hostKeyCheck", hostKeyAcceptNew, "How to handle instances missing from known hosts: accept-new adds them on first use, strict refuses to connect")
+	flag.StringVar(&bastion, "bastion", "", "Jump host to reach the private IP of instances through, as [user@]host[:port] where host may be an instance name")
+	flag.StringVar(&transport, "transport", transportSsh, "How ssh, scp and login reach instances: ssh to the public IP, or ssm through SSM Session Manager and Run Command")
+	flag.StringVar(&remoteAddress, "remote", "", "Host and port to forward to with tunnel, as seen from the instance, e.g. localhost:8080 or a database endpoint")
+	flag.IntVar(&localPort, "localPort", 0, "Local port to forward from with tunnel, default the port given by -remote")
+	flag.IntVar(&parallel, "parallel", 10, "Max number of instances to run a command on at the same time")
+	flag.BoolVar(&failFast, "failFast", false, "Stop running a command on the other instances as soon as it fails on one")
+	flag.IntVar(&threadDumps, "threadDumps", 3, "Number of thread dumps collectDiagnostics takes of each task")
+	flag.DurationVar(&threadDumpInterval, "threadDumpInterval", 5*time.Second, "Time between the thread dumps taken by collectDiagnostics")
+	flag.IntVar(&logLines, "logLines", 1000, "Number of the latest container log lines collectDiagnostics downloads")
+	flag.BoolVar(&zipDiagnostics, "zip", false, "Zip the diagnostics collected by collectDiagnostics. Implied by -s3bucket, which uploads the zip")
 	flag.BoolVar(&recursive, "recursive", false, "Specify recursive operation")
 	flag.StringVar(&output, "output", "", "Specify output directory")
+	flag.StringVar(&target, "target", "", "Specify remote directory to copy files to with scpTo")
 	flag.StringVar(&login, "login", "", "Specify login for external service")
 	flag.StringVar(&password, "password", "", "Specify password for external service")
 	flag.StringVar(&profile, "profile", "", "Specify profile for ./aws/credentials file used for accessing AWS.")
 	flag.StringVar(&profile, "p", "", "Specify profile for ./aws/credentials file used for accessing AWS.")
+	flag.StringVar(&environmentName, "env", "", "Name of environment in ~/.writer-tool/environments.json to take missing flags from. Comma separated for several environments")
 	flag.StringVar(&version, "version", "", "The version to use for docker image in the task definition")
 	flag.StringVar(&releaseDate, "releaseDate", "", "The date for a release, used in release notes generation")
 	flag.StringVar(&loadBalancer, "loadBalancer", "", "Specifies the load balancer name to use")
@@ -57,6 +83,20 @@ func init() {
 	flag.BoolVar(&moreVerbose, "vv", false, "Making output more verbose, where applicable")
 	flag.StringVar(&region, "region", "", "The region to use")
 	flag.StringVar(&roleArn, "roleArn", "", "ARN of the role to assume when executing AWS command")
+	flag.StringVar(&roleSessionName, "roleSessionName", "writer-tool", "Session name used when assuming the role given by -roleArn")
+	flag.StringVar(&externalId, "externalId", "", "External ID required by the role given by -roleArn")
+	flag.StringVar(&mfaSerial, "mfaSerial", "", "Serial number or ARN of the MFA device required by the role given by -roleArn. The token is read from stdin")
+	flag.StringVar(&healthCheckUrl, "healthCheckUrl", "", "URL to probe after a release has reached a steady state. A failing probe rolls back the release")
+	flag.IntVar(&healthCheckStatus, "healthCheckStatus", 200, "HTTP status expected from the health check URL")
+	flag.StringVar(&healthCheckBody, "healthCheckBody", "", "Text expected in the response body from the health check URL")
+	flag.IntVar(&healthCheckCount, "healthCheckCount", 3, "Number of consecutive health check probes that must pass")
+	flag.DurationVar(&healthCheckInterval, "healthCheckInterval", 5*time.Second, "Time between health check probes")
+	flag.DurationVar(&deploymentTimeout, "timeout", 8*time.Minute, "Max time to wait for a deployment to become stable, for an instance to drain or be replaced, or for a command run with -transport ssm")
+	flag.DurationVar(&pollInterval, "pollInterval", 2*time.Second, "Initial time between polls for deployment status, doubled after each poll up to 30s")
+	flag.StringVar(&outputFormat, "format", formatText, "Output format for list and describe commands: text, table, json or yaml")
+	flag.BoolVar(&dryRun, "dryRun", false, "Print what a release would change without registering task definitions or updating services, or which instances rollInstances would replace")
+	flag.StringVar(&endpoint, "endpoint", os.Getenv("WRITER_TOOL_ENDPOINT"), "URL to send all AWS requests to instead of AWS. 'fake:<file>' serves the responses in the file from within the tool")
+	flag.StringVar(&recordFile, "record", "", "File to record all AWS responses to, in the format read by -endpoint fake:<file>")
 }
 
 func sortKeys(m map[string]string) []string {
@@ -68,90 +108,98 @@ func sortKeys(m map[string]string) []string {
 	return keys
 }
 
-func errUsage(message string) {
-	fmt.Println(message)
-	os.Exit(1)
-}
+func readConfigFromFile() ([]byte, error) {
+	if reportJson == "" {
+		return nil, usageError("You must specify a report config file with: -reportConfig")
+	}
 
-func errState(message string) {
-	fmt.Println(message)
-	os.Exit(2)
+	return ioutil.ReadFile(reportJson)
 }
 
-func readConfigFromFile() []byte {
-	if reportJson == "" {
-		errUsage("You must specify a report config file with: -reportConfig")
+func readReportConfig() ([]byte, error) {
+	if reportJson == "" && environmentName != "" {
+		return environmentReportConfig()
 	}
 
-	content, err := ioutil.ReadFile(reportJson)
-	assertError(err)
-
-	return content
+	return readConfigFromFile()
 }
 
-func readTemplateFromFile() string {
+func readTemplateFromFile() (string, error) {
 	if reportTemplate == "" {
-		errUsage("You must specify a report template file with: -reportTemplate")
+		return "", usageError("You must specify a report template file with: -reportTemplate")
 	}
 
 	content, err := ioutil.ReadFile(reportTemplate)
-	assertError(err)
+	if err != nil {
+		return "", err
+	}
 
-	return string(content)
+	return string(content), nil
 }
 
-func readDependenciesFromFile() string {
+func readDependenciesFromFile() (string, error) {
 	if dependenciesFile == "" {
-		return ""
+		return "", nil
 	}
 
 	content, err := ioutil.ReadFile(dependenciesFile)
-	assertError(err)
+	if err != nil {
+		return "", err
+	}
 
-	return string(content)
+	return string(content), nil
 }
 
-func getClusterArn() string {
+func getClusterArn() (string, error) {
 	if cluster == "" {
-		errUsage("You must specify a cluster name with: -cluster")
+		return "", usageError("You must specify a cluster name with: -cluster")
 	}
 
-	arn := GetClusterArn(cluster, nil)
-	if arn == "" {
-		errUsage("Could not find cluster ARN for name: " + cluster)
+	clients, err := getClients()
+	if err != nil {
+		return "", err
 	}
 
-	return arn
+	return GetClusterArn(cluster, clients.Ecs)
 }
 
-func getServiceArn() string {
+func getServiceArn() (string, error) {
 	if cluster == "" {
-		errUsage("You must specify a cluster name with: -cluster")
+		return "", usageError("You must specify a cluster name with: -cluster")
 	}
 
 	if service == "" {
-		errUsage("You must specify a service name with: -service")
+		return "", usageError("You must specify a service name with: -service")
 	}
 
-	clusterArn := getClusterArn()
-	serviceArn := GetServiceArn(clusterArn, service, nil)
+	clusterArn, err := getClusterArn()
+	if err != nil {
+		return "", err
+	}
+
+	clients, err := getClients()
+	if err != nil {
+		return "", err
+	}
 
-	return serviceArn
+	return GetServiceArn(clusterArn, service, clients.Ecs)
 }
 
-func getVersion() string {
+func getVersion() (string, error) {
 	if version == "" {
-		errUsage("You must specify a version with: -version")
+		return "", usageError("You must specify a version with: -version")
 	}
 
-	return version
+	return version, nil
 }
 
-func getPemfileFromProfile(profile string) string {
+func getPemfileFromProfile(profile string) (string, error) {
 	var pemregex = regexp.MustCompile("\\[\\s*" + profile + "\\s*\\]\\s*\n\\s*aws_access_key_id.*\n\\s*aws_secret_access_key.*\n\\s*pemfile\\s*=\\s*(.*)")
 
 	currUser, err := user.Current()
-	assertError(err)
+	if err != nil {
+		return "", err
+	}
 
 	var path string
 	if os.Getenv("AWS_CONFIG_FILE") != "" {
@@ -161,31 +209,28 @@ func getPemfileFromProfile(profile string) string {
 	}
 
 	file, err := ioutil.ReadFile(path)
-	assertError(err)
+	if err != nil {
+		return "", err
+	}
 
 	matches := pemregex.FindStringSubmatch(string(file))
 	if len(matches) < 2 {
-		errUsage("Could not find pemfile in config file, please specify with -pemfile")
+		return "", usageError("Could not find pemfile in config file, please specify with -pemfile")
 	}
 
-	return strings.TrimSpace(matches[1])
+	return strings.TrimSpace(matches[1]), nil
 }
 
-func getUpdatesFile() []byte {
-	if updatesFile == "" {
-		errUsage("An updates file needs to be provided with -updatesFile")
+func getUpdatesFile() ([]byte, error) {
+	if updatesFile == "" && environmentName != "" {
+		return environmentUpdates()
 	}
 
-	file, err := ioutil.ReadFile(updatesFile)
-	assertError(err)
-
-	return file
-}
-
-func assertError(err error) {
-	if err != nil {
-		errState(err.Error())
+	if updatesFile == "" {
+		return nil, usageError("An updates file needs to be provided with -updatesFile or -env")
 	}
+
+	return ioutil.ReadFile(updatesFile)
 }
 
 func main() {
@@ -204,5 +249,33 @@ func main() {
 		return
 	}
 
-	executeCommand()
+	err := resolveEnvironmentFlags()
+	if err == nil {
+		err = validateFormat()
+	}
+
+	if err == nil {
+		err = validateTransport()
+	}
+
+	if err == nil {
+		err = validateWaiting()
+	}
+
+	if err == nil {
+		err = startEndpoint()
+	}
+
+	if err == nil {
+		err = executeCommand()
+	}
+
+	if recordErr := writeRecordedResponses(); err == nil {
+		err = recordErr
+	}
+
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(exitCodeFor(err))
+	}
 }
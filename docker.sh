@@ -11,7 +11,10 @@ rm -rf target
 mkdir target
 
 echo -n "Building writer toolbox ... "
-docker run -i --rm -v "$PWD":/usr/src/myapp -w /usr/src/myapp -e GOOS=linux -e GOARCH=amd64 -e CGO_ENABLED=0 golang:1.7 bash -c 'go get -d -v ; go build -ldflags -s -v -o target/writer-tool'
+# The sources have no go.mod, so the module is set up on a copy of them, leaving the working tree as is. The
+# golang.org/x/crypto SSH client needs Go 1.25 or later.
+docker run -i --rm -v "$PWD":/usr/src/myapp -w /usr/src/myapp -e GOOS=linux -e GOARCH=amd64 -e CGO_ENABLED=0 golang:1.25 bash -c \
+  'mkdir /tmp/build && cp *.go /tmp/build && cd /tmp/build && go mod init github.com/Infomaker/writer-toolbox && go get github.com/aws/aws-sdk-go@v1.55.5 golang.org/x/crypto@v0.54.0 gopkg.in/yaml.v2@v2.4.0 && go mod tidy && go build -ldflags -s -v -o /usr/src/myapp/target/writer-tool'
 echo "done"
 
 cp Dockerfile target
@@ -0,0 +1,219 @@
+#!/usr/bin/env bash
+# Runs commands end to end against the fake AWS endpoint, with the scripts in
+# examples/fake. No network access or AWS credentials are needed.
+
+fake=examples/fake
+failed=0
+
+rm -rf target/e2e
+mkdir -p target/e2e/output
+
+echo -n "Compiling ... "
+go build -o target/e2e/writer-tool || exit 1
+echo "done"
+
+# Usage: expect {description} {expected exit code} {writer-tool arguments}
+expect() {
+  description=$1
+  expected=$2
+  shift 2
+
+  echo -n "${description} ... "
+  target/e2e/writer-tool "$@" > target/e2e/output.log 2>&1
+  actual=$?
+
+  if [[ ${actual} -eq ${expected} ]]; then
+    echo "ok"
+  else
+    echo "FAILED, exit code ${actual}, expected ${expected}"
+    cat target/e2e/output.log
+    failed=1
+  fi
+}
+
+expect "listEc2Instances with throttling and pagination" 0 \
+  -endpoint fake:${fake}/listEc2Instances.json -command listEc2Instances -format json
+
+expect "releaseServices with a slow deployment" 0 \
+  -endpoint fake:${fake}/releaseServices.json -command releaseServices \
+  -updatesFile ${fake}/updates.json -version 1.1.0 -pollInterval 100ms
+
+expect "releaseService that times out" 5 \
+  -endpoint fake:${fake}/releaseServices.json -command releaseService \
+  -cluster writer -service editorservice -version 1.1.0 -pollInterval 100ms -timeout 1s
+
+expect "releaseService with a zero -pollInterval" 1 \
+  -endpoint fake:${fake}/releaseServices.json -command releaseService \
+  -cluster writer -service editorservice -version 1.1.0 -pollInterval 0s
+
+expect "releaseService with a negative -timeout" 1 \
+  -endpoint fake:${fake}/releaseServices.json -command releaseService \
+  -cluster writer -service editorservice -version 1.1.0 -timeout -1m
+
+expect "copyFileFromS3Bucket" 0 \
+  -endpoint fake:${fake}/copyFileFromS3Bucket.json -command copyFileFromS3Bucket \
+  -s3bucket writer-lambda-releases -s3filename ImageMetadata-develop.zip -output target/e2e/output
+
+expect "copyFileFromS3Bucket for missing file" 4 \
+  -endpoint fake:${fake}/copyFileFromS3Bucket.json -command copyFileFromS3Bucket \
+  -s3bucket writer-lambda-releases -s3filename missing.zip -output target/e2e/output
+
+expect "ssh over SSM" 0 \
+  -endpoint fake:${fake}/ssm.json -command ssh -transport ssm -instanceName imageservice uptime
+
+expect "ssh over SSM to instances selected with -filter" 0 \
+  -endpoint fake:${fake}/ssm.json -command ssh -transport ssm -filter tag:Team=imaging uptime
+
+expect "listEc2Instances with an unknown column" 1 \
+  -endpoint fake:${fake}/ec2Filters.json -command listEc2Instances -columns id,bogus
+
+expect "ssh over SSM with the exit status of the remote command" 3 \
+  -endpoint fake:${fake}/ssm.json -command ssh -transport ssm -instanceId i-0c3 'exit 3'
+
+expect "ssh over SSH to instance without public IP" 1 \
+  -endpoint fake:${fake}/ssm.json -command ssh -instanceId i-0c3 uptime
+
+expect "scp over SSM" 0 \
+  -endpoint fake:${fake}/ssm.json -command scp -transport ssm -instanceId i-0c3 -output target/e2e/output \
+  /var/log/imageservice.log
+
+expect "scp over SSM with several paths" 0 \
+  -endpoint fake:${fake}/ssm.json -command scp -transport ssm -instanceId i-0c3 -output target/e2e/output \
+  /var/log/imageservice.log '/var/log/imageservice.log.*'
+
+expect "clusterCapacity of a service with a static host port" 0 \
+  -endpoint fake:${fake}/clusterCapacity.json -command clusterCapacity -cluster writer -service imageservice -format json
+
+expect "clusterCapacity of a missing service" 4 \
+  -endpoint fake:${fake}/clusterCapacity.json -command clusterCapacity -cluster writer -service missing
+
+expect "drainInstance waiting for the tasks to stop" 0 \
+  -endpoint fake:${fake}/rollInstances.json -command drainInstance -cluster writer -instanceId i-0e1 -pollInterval 50ms
+
+expect "drainInstance of an instance outside the cluster" 4 \
+  -endpoint fake:${fake}/rollInstances.json -command drainInstance -cluster writer -instanceId i-0e9
+
+expect "rollInstances waiting for the auto scaling group to replace each instance" 0 \
+  -endpoint fake:${fake}/rollInstances.json -command rollInstances -cluster writer -pollInterval 50ms
+
+expect "tunnel without -remote" 1 \
+  -endpoint fake:${fake}/ssm.json -command tunnel -instanceId i-0c3
+
+expect "scpTo over SSM with a local pattern" 0 \
+  -endpoint fake:${fake}/scpTo.json -command scpTo -transport ssm -instanceId i-0c3 -target /etc/imageservice \
+  "${fake}/exec*.json"
+
+expect "scpTo without -target" 1 \
+  -endpoint fake:${fake}/scpTo.json -command scpTo -transport ssm -instanceId i-0c3 ${fake}/scpTo.json
+
+expect "scpTo with a missing local file" 4 \
+  -endpoint fake:${fake}/scpTo.json -command scpTo -transport ssm -instanceId i-0c3 -target /etc/imageservice \
+  ${fake}/missing.json
+
+expect "execService over SSM in every task of the service" 0 \
+  -endpoint fake:${fake}/execService.json -command execService -transport ssm -cluster writer -service editorservice \
+  -containerName editorservice -- jstack 1
+
+expect "execService without -containerName for tasks with several containers" 1 \
+  -endpoint fake:${fake}/execService.json -command execService -transport ssm -cluster writer -service editorservice \
+  -- jstack 1
+
+expect "collectDiagnostics over SSM, zipped and uploaded to S3" 0 \
+  -endpoint fake:${fake}/collectDiagnostics.json -command collectDiagnostics -transport ssm -cluster writer \
+  -service editorservice -threadDumps 2 -threadDumpInterval 10ms -logLines 100 -output target/e2e/diagnostics \
+  -s3bucket support-diagnostics -s3filename diagnostics/editorservice.zip
+
+# Usage: expect_file {description} {file} {expected content}
+expect_file() {
+  echo -n "$1 ... "
+
+  if grep -q "$3" "$2" 2>/dev/null; then
+    echo "ok"
+  else
+    echo "FAILED, $2 does not contain '$3'"
+    failed=1
+  fi
+}
+
+expect_file "scp over SSM wrote the file" target/e2e/output/imageservice-i-0c3/imageservice.log "Image service started"
+expect_file "collectDiagnostics wrote the second thread dump" \
+  target/e2e/diagnostics/editorservice/*/7f3e0a1b2c3d4e5f60718293a4b5c6d7/thread-dump-2.txt "os_prio=0"
+expect_file "collectDiagnostics wrote the heap histogram" \
+  target/e2e/diagnostics/editorservice/*/7f3e0a1b2c3d4e5f60718293a4b5c6d7/heap-histogram.txt "#instances"
+expect_file "collectDiagnostics wrote free" \
+  target/e2e/diagnostics/editorservice/*/7f3e0a1b2c3d4e5f60718293a4b5c6d7/free.txt "Mem:"
+expect_file "collectDiagnostics zipped the diagnostics" target/e2e/diagnostics/editorservice/*.zip "df.txt"
+
+# Usage: expect_lines {description} {expected number of output lines} {writer-tool arguments}
+expect_lines() {
+  description=$1
+  expected=$2
+  shift 2
+
+  echo -n "${description} ... "
+  target/e2e/writer-tool "$@" > target/e2e/output.log 2>&1
+  actual=$?
+  lines=$(wc -l < target/e2e/output.log | tr -d ' ')
+
+  if [[ ${actual} -eq 0 && ${lines} -eq ${expected} ]]; then
+    echo "ok"
+  else
+    echo "FAILED, exit code ${actual} with ${lines} lines, expected ${expected} lines"
+    cat target/e2e/output.log
+    failed=1
+  fi
+}
+
+expect_lines "listClusters over three pages" 4 \
+  -endpoint fake:${fake}/pagination.json -command listClusters
+
+expect_lines "listClusters limited by -maxResults" 2 \
+  -endpoint fake:${fake}/pagination.json -command listClusters -maxResults 2
+
+expect_lines "listTasks sending the next token" 3 \
+  -endpoint fake:${fake}/pagination.json -command listTasks -cluster writer -service editorservice
+
+expect_lines "listFilesInS3Bucket over two pages" 3 \
+  -endpoint fake:${fake}/pagination.json -command listFilesInS3Bucket -s3bucket writer-lambda-releases
+
+expect_lines "listLambdaFunctions over two pages" 3 \
+  -endpoint fake:${fake}/pagination.json -command listLambdaFunctions
+
+expect_lines "listLoadBalancers over two pages" 2 \
+  -endpoint fake:${fake}/pagination.json -command listLoadBalancers
+
+expect_lines "listEc2Instances over two pages" 3 \
+  -endpoint fake:${fake}/pagination.json -command listEc2Instances
+
+expect_lines "listEc2Instances limited by -maxResults" 2 \
+  -endpoint fake:${fake}/pagination.json -command listEc2Instances -maxResults 2
+
+expect_lines "listEc2Instances with a wildcard name, filtered by EC2" 2 \
+  -endpoint fake:${fake}/ec2Filters.json -command listEc2Instances -instanceName 'editor*'
+
+expect_lines "listEc2Instances with -filter for stopped instances and -columns" 2 \
+  -endpoint fake:${fake}/ec2Filters.json -command listEc2Instances -instanceName 'editor*' \
+  -filter tag:Team=writer,instance-state-name=stopped -columns id,state,launch-time
+
+expect_lines "listEc2Instances with the cluster column" 3 \
+  -endpoint fake:${fake}/ec2Filters.json -command listEc2Instances -instanceName 'editor*' -columns id,cluster
+
+expect_lines "describeContainerInstances in chunks of 100" 601 \
+  -endpoint fake:${fake}/pagination.json -command describeContainerInstances -cluster writer -maxResults 0
+
+expect_lines "clusterCapacity with the tasks of a service that would fit" 7 \
+  -endpoint fake:${fake}/clusterCapacity.json -command clusterCapacity -cluster writer -service editorservice
+
+expect_lines "rollInstances with -dryRun" 2 \
+  -endpoint fake:${fake}/rollInstances.json -command rollInstances -cluster writer -dryRun
+
+expect_lines "clusterCapacity in table format" 5 \
+  -endpoint fake:${fake}/clusterCapacity.json -command clusterCapacity -cluster writer -format table
+
+expect_lines "clusterCapacity of every instance regardless of -maxResults" 5 \
+  -endpoint fake:${fake}/clusterCapacity.json -command clusterCapacity -cluster writer -format table -maxResults 1
+
+expect_lines "describeContainerInstances with -v" 31 \
+  -endpoint fake:${fake}/clusterCapacity.json -command describeContainerInstances -cluster writer -v
+
+exit ${failed}